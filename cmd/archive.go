@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxArchiveMetadataSize is the size up to which the blobs of an OCI image
+// layout are kept in memory while reading the metadata of an archive, so that
+// manifests and configs are found without knowing the layers in advance.
+const maxArchiveMetadataSize = 1 << 20
+
+// walkArchive calls fn for every regular file of a bundle archive, in the
+// order they are stored. fn must consume the reader before returning.
+func walkArchive(tarballPath string, fn func(name string, size int64, r io.Reader) error) error {
+	file, err := openArchive(tarballPath)
+	if err != nil {
+		return fmt.Errorf("error opening tarball: %v", err)
+	}
+	defer file.Close()
+	return walkArchiveReader(file, fn)
+}
+
+// walkArchiveReader is walkArchive for an archive read from a reader.
+func walkArchiveReader(archive io.Reader, fn func(name string, size int64, r io.Reader) error) error {
+	zstdReader, err := zstd.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %v", err)
+	}
+	defer zstdReader.Close()
+
+	tarReader := tar.NewReader(zstdReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil // End of archive
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar header: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		cleanName := path.Clean(filepath.ToSlash(header.Name))
+		if strings.Contains(cleanName, "..") {
+			return fmt.Errorf("invalid file path: %s", header.Name)
+		}
+		err = fn(cleanName, header.Size, tarReader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveSource holds the metadata files of a bundle archive in memory, layers
+// are not available from it and are streamed with streamArchiveLayers.
+type archiveSource struct {
+	files map[string][]byte
+}
+
+func (a *archiveSource) ReadFile(path string) ([]byte, error) {
+	data, ok := a.files[filepath.ToSlash(path)]
+	if !ok {
+		return nil, fmt.Errorf("%s is not available when streaming the archive", path)
+	}
+	return data, nil
+}
+
+func (a *archiveSource) Open(path string) (io.ReadCloser, error) {
+	data, err := a.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// isArchiveMetadata reports whether an entry of the archive may be a manifest
+// or a config, which are kept in memory when the archive is streamed.
+func isArchiveMetadata(name string, size int64) bool {
+	return name == "manifest.json" || name == ociIndexFile || name == ociLayoutFile ||
+		name == signatureFile("manifest.json") || name == signatureFile(ociIndexFile) || name == deltaFile ||
+		name == chartsFile || isChartEntry(name) ||
+		strings.HasPrefix(name, "manifests/") || strings.HasPrefix(name, "configs/") ||
+		(strings.HasPrefix(name, "blobs/") && size <= maxArchiveMetadataSize)
+}
+
+// readArchiveMetadata reads the manifests and configs of a bundle archive
+// without extracting its layers, every entry is recorded in check.
+func readArchiveMetadata(tarballPath string, check *bundleCheck) (*archiveSource, error) {
+	file, err := openArchive(tarballPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening tarball: %v", err)
+	}
+	defer file.Close()
+	return readArchiveReaderMetadata(file, check)
+}
+
+// readArchiveReaderMetadata is readArchiveMetadata for an archive read from a
+// reader.
+func readArchiveReaderMetadata(archive io.Reader, check *bundleCheck) (*archiveSource, error) {
+	source := &archiveSource{files: make(map[string][]byte)}
+	err := walkArchiveReader(archive, func(name string, size int64, r io.Reader) error {
+		if !isArchiveMetadata(name, size) {
+			return check.add(name, r)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		source.files[name] = data
+		return check.add(name, bytes.NewReader(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// archiveLayer is a layer of the archive and the repositories it is pushed to.
+type archiveLayer struct {
+	desc  v1.Descriptor
+	repos []name.Repository
+}
+
+// streamArchiveLayers uploads the layers of a bundle archive while reading it.
+// A layer needed by a single repository is streamed straight to the registry,
+// otherwise it is spooled to a temporary file so that the other repositories
+// can mount it or upload it again.
+func streamArchiveLayers(tarballPath string, layers map[string]*archiveLayer, uploads *blobUploads, out printer, options ...remote.Option) error {
+	return walkArchive(tarballPath, func(name string, size int64, r io.Reader) error {
+		layer, ok := layers[name]
+		if !ok {
+			return nil
+		}
+
+		open := func() (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		}
+		if len(layer.repos) > 1 {
+			spool, err := os.CreateTemp("", "helm-datarobot-layer-*")
+			if err != nil {
+				return fmt.Errorf("error creating temporary file: %v", err)
+			}
+			defer os.Remove(spool.Name())
+			defer spool.Close()
+			_, err = io.Copy(spool, r)
+			if err != nil {
+				return fmt.Errorf("error spooling layer %s: %v", layer.desc.Digest, err)
+			}
+			open = func() (io.ReadCloser, error) {
+				return os.Open(spool.Name())
+			}
+		}
+
+		compressed, err := partial.CompressedToLayer(&streamedLayer{desc: layer.desc, open: open})
+		if err != nil {
+			return err
+		}
+		for _, repo := range layer.repos {
+			// A failed layer is reported with the images using it when their
+			// manifests are pushed
+			err := uploads.upload(compressed, repo, options...)
+			if err != nil {
+				out.Printf("Error pushing layer %s to %s: %v\n", layer.desc.Digest, repo, err)
+			}
+		}
+		return nil
+	})
+}
+
+// streamedLayer is a compressed layer read from the archive being streamed.
+type streamedLayer struct {
+	desc v1.Descriptor
+	open func() (io.ReadCloser, error)
+}
+
+var _ partial.CompressedLayer = (*streamedLayer)(nil)
+
+func (l *streamedLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *streamedLayer) Compressed() (io.ReadCloser, error) {
+	return l.open()
+}
+
+func (l *streamedLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *streamedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// archiveWriter writes the files of a bundle directly into a zstd compressed
+// tar archive. Streamed blobs are first spooled to a temporary file next to the
+// archive, so that pulls run concurrently and a failed pull can be retried,
+// then entries are written one at a time.
+type archiveWriter struct {
+	mu       sync.Mutex
+	file     io.WriteCloser
+	encoder  *zstd.Encoder
+	tar      *tar.Writer
+	sizes    map[string]int64
+	spoolDir string
+	// err is set once an entry could not be written completely, the archive
+	// is then unusable and every later write fails
+	err error
+}
+
+var _ bundleWriter = (*archiveWriter)(nil)
+
+func newArchiveWriter(outputTarball string, level zstd.EncoderLevel, splitSize int64) (*archiveWriter, error) {
+	file, err := createArchive(outputTarball, splitSize)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(file, zstd.WithEncoderLevel(level))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &archiveWriter{
+		file:     file,
+		encoder:  encoder,
+		tar:      tar.NewWriter(encoder),
+		sizes:    make(map[string]int64),
+		spoolDir: filepath.Dir(outputTarball),
+	}, nil
+}
+
+func (a *archiveWriter) WriteFile(path string, data []byte) error {
+	return a.writeEntry(path, int64(len(data)), bytes.NewReader(data))
+}
+
+// WriteStream spools the blob before adding it to the archive, an error while
+// reading it leaves the archive usable.
+func (a *archiveWriter) WriteStream(path string, size int64, r io.Reader) error {
+	spool, err := os.CreateTemp(a.spoolDir, ".blob-*")
+	if err != nil {
+		return fmt.Errorf("error spooling %s: %v", path, err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	n, err := io.Copy(spool, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("read %d bytes instead of %d", n, size)
+	}
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("error spooling %s: %v", path, err)
+	}
+	return a.writeEntry(path, size, spool)
+}
+
+func (a *archiveWriter) writeEntry(path string, size int64, r io.Reader) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+
+	name := filepath.ToSlash(path)
+	err := a.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	if err == nil {
+		_, err = io.Copy(a.tar, r)
+	}
+	if err == nil {
+		// Flush fails when fewer bytes than announced were written
+		err = a.tar.Flush()
+	}
+	if err != nil {
+		a.err = fmt.Errorf("error writing %s to the tarball: %v", name, err)
+		return a.err
+	}
+	a.sizes[name] = size
+	return nil
+}
+
+func (a *archiveWriter) Size(path string) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	size, ok := a.sizes[filepath.ToSlash(path)]
+	if !ok {
+		return 0, fmt.Errorf("%s was not written to the tarball", path)
+	}
+	return size, nil
+}
+
+// Close completes the archive, it returns the first write error if any.
+func (a *archiveWriter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.err
+	for _, closeErr := range []error{a.tar.Close(), a.encoder.Close(), a.file.Close()} {
+		if err == nil && closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLoad(t *testing.T) {
+	shared, err := random.Layer(1024, types.DockerLayer)
+	assert.NoError(t, err)
+	sharedDigest, err := shared.Digest()
+	assert.NoError(t, err)
+
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+	var manifests []ImageManifest
+	var images []v1.Image
+	layers := newBlobSet()
+	for _, imageName := range []string{"test/a:1", "test/b:1"} {
+		base, err := random.Image(512, 1)
+		assert.NoError(t, err)
+		image, err := mutate.AppendLayers(base, shared)
+		assert.NoError(t, err)
+		manifest, err := exportImage(image, dirWriter(outputDir), formatNative, layers)
+		assert.NoError(t, err)
+		manifest.ImageName = imageName
+		manifest.OriginalImage = "docker.io/" + imageName
+		manifests = append(manifests, manifest)
+		images = append(images, image)
+	}
+	assert.NoError(t, saveManifest(dirWriter(outputDir), manifests))
+	tarballPath := filepath.Join(t.TempDir(), "bundle.tar.zst")
+	assert.NoError(t, createTarball(tarballPath, outputDir, formatNative, zstd.SpeedFastest, 0))
+
+	var sharedUploads atomic.Int32
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Query().Get("digest") == sharedDigest.String() {
+			sharedUploads.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var buf strings.Builder
+	cmd := &cobra.Command{}
+	cmd.SetOut(&buf)
+	// The extraction directory must not be used when streaming
+	c := loadConfig{RegistryHost: host, OutputDir: filepath.Join(t.TempDir(), "unused"), RetryAttempts: 1, Concurrency: 1}
+	err = streamLoad(tarballPath, c, &bundleSignature{}, cmd)
+	assert.NoError(t, err)
+	expectedOutput := `Successfully pushed image ` + host + `/test/a:1
+Successfully pushed image ` + host + `/test/b:1
+Summary: 2 pushed, 0 already in the registry, 0 failed
+`
+	assert.Equal(t, expectedOutput, buf.String())
+	assert.Equal(t, int32(1), sharedUploads.Load())
+	assert.NoDirExists(t, c.OutputDir)
+
+	for idx, manifest := range manifests {
+		ref, err := name.ParseReference(host + "/" + manifest.ImageName)
+		assert.NoError(t, err)
+		desc, err := remote.Head(ref)
+		assert.NoError(t, err)
+		digest, err := images[idx].Digest()
+		assert.NoError(t, err)
+		assert.Equal(t, digest, desc.Digest)
+	}
+}
+
+func TestReadArchiveMetadata(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+	image, err := random.Image(1024, 2)
+	assert.NoError(t, err)
+	manifest, err := exportImage(image, dirWriter(outputDir), formatNative, newBlobSet())
+	assert.NoError(t, err)
+	manifest.ImageName = "test/a:1"
+	assert.NoError(t, saveManifest(dirWriter(outputDir), []ImageManifest{manifest}))
+	tarballPath := filepath.Join(t.TempDir(), "bundle.tar.zst")
+	assert.NoError(t, createTarball(tarballPath, outputDir, formatNative, zstd.SpeedFastest, 0))
+
+	source, err := readArchiveMetadata(tarballPath, newBundleCheck())
+	assert.NoError(t, err)
+	manifests, format, err := readBundleManifests(source)
+	assert.NoError(t, err)
+	assert.Equal(t, formatNative, format)
+	assert.Equal(t, []ImageManifest{manifest}, manifests)
+
+	_, err = source.ReadFile(manifest.ConfigFile)
+	assert.NoError(t, err)
+	_, err = source.ReadFile(formatNative.layerFile(v1.Hash{Algorithm: "sha256", Hex: manifest.Layers[0]}))
+	assert.ErrorContains(t, err, "is not available when streaming the archive")
+}
+
+func TestCreateTarball(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+	image, err := random.Image(1024, 1)
+	assert.NoError(t, err)
+	manifest, err := exportImage(image, dirWriter(outputDir), formatNative, newBlobSet())
+	assert.NoError(t, err)
+	assert.NoError(t, saveManifest(dirWriter(outputDir), []ImageManifest{manifest}))
+	// Files save did not write are left out, the tarball itself included
+	assert.NoError(t, os.WriteFile(filepath.Join(outputDir, "notes.txt"), []byte("notes"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(outputDir, saveStateFile), []byte("{}"), 0644))
+	tarballPath := filepath.Join(outputDir, "bundle.tar.zst")
+	assert.NoError(t, createTarball(tarballPath, outputDir, formatNative, zstd.SpeedFastest, 0))
+
+	var names []string
+	err = walkArchive(tarballPath, func(name string, size int64, r io.Reader) error {
+		names = append(names, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	layerFile := formatNative.layerFile(v1.Hash{Algorithm: "sha256", Hex: manifest.Layers[0]})
+	assert.ElementsMatch(t, []string{filepath.ToSlash(layerFile), filepath.ToSlash(manifest.ConfigFile), filepath.ToSlash(manifest.ManifestFile), "manifest.json"}, names)
+
+	// The archive is flushed when it is closed, a failure then is returned
+	err = writeTarball(fullDisk{}, outputDir, formatNative, zstd.SpeedFastest)
+	assert.EqualError(t, err, "no space left on device")
+}
+
+// fullDisk fails every write, as a file on a full disk.
+type fullDisk struct{}
+
+func (fullDisk) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func (fullDisk) Close() error {
+	return nil
+}
+
+func TestArchiveWriter(t *testing.T) {
+	image, err := random.Image(1024, 3)
+	assert.NoError(t, err)
+
+	tarballPath := filepath.Join(t.TempDir(), "bundle.tar.zst")
+	writer, err := newArchiveWriter(tarballPath, zstd.SpeedFastest, 0)
+	assert.NoError(t, err)
+	manifest, err := exportImage(image, writer, formatOCILayout, newBlobSet())
+	assert.NoError(t, err)
+	manifest.ImageName = "test/a:1"
+	manifest.OriginalImage = "docker.io/test/a:1"
+	assert.NoError(t, writeOCILayout(writer, []ImageManifest{manifest}))
+	assert.NoError(t, writer.Close())
+
+	// The streamed archive extracts to a standard OCI image layout
+	outputDir := t.TempDir()
+	assert.NoError(t, extractTarball(tarballPath, outputDir, newBundleCheck()))
+	index, err := layout.ImageIndexFromPath(outputDir)
+	assert.NoError(t, err)
+	indexManifest, err := index.IndexManifest()
+	assert.NoError(t, err)
+	assert.Len(t, indexManifest.Manifests, 1)
+	layoutImage, err := index.Image(indexManifest.Manifests[0].Digest)
+	assert.NoError(t, err)
+	assert.NoError(t, validate.Image(layoutImage))
+	digest, err := image.Digest()
+	assert.NoError(t, err)
+	assert.Equal(t, digest, indexManifest.Manifests[0].Digest)
+
+	// A blob that could not be pulled completely is left out and written
+	// again when it is retried
+	tarballPath = filepath.Join(t.TempDir(), "bundle.tar.zst")
+	writer, err = newArchiveWriter(tarballPath, zstd.SpeedFastest, 0)
+	assert.NoError(t, err)
+	err = writer.WriteStream("layers/retried.tar.gz", 10, strings.NewReader("short"))
+	assert.ErrorContains(t, err, "error spooling layers/retried.tar.gz: read 5 bytes instead of 10")
+	err = writer.WriteStream("layers/retried.tar.gz", 10, io.MultiReader(strings.NewReader("short"), iotest.ErrReader(errors.New("connection reset"))))
+	assert.ErrorContains(t, err, "connection reset")
+	assert.NoError(t, writer.WriteStream("layers/retried.tar.gz", 10, strings.NewReader("retried ok")))
+	assert.NoError(t, writer.Close())
+	var names []string
+	err = walkArchive(tarballPath, func(name string, size int64, r io.Reader) error {
+		names = append(names, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"layers/retried.tar.gz"}, names)
+	// Spooled blobs are removed
+	entries, err := os.ReadDir(filepath.Dir(tarballPath))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
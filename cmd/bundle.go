@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// bundleFormat is the on-disk structure of a bundle.
+type bundleFormat string
+
+const (
+	// formatNative stores a manifest.json next to the layers, configs and
+	// manifests directories.
+	formatNative bundleFormat = "native"
+	// formatOCILayout stores a standard OCI image layout, readable by skopeo,
+	// crane or containerd.
+	formatOCILayout bundleFormat = "oci-layout"
+	// formatDockerArchive writes a `docker save` compatible archive, the
+	// images are first exported with the native structure.
+	formatDockerArchive bundleFormat = "docker-archive"
+)
+
+// dirs returns the directories the blobs of the bundle are written to.
+func (f bundleFormat) dirs() []string {
+	if f == formatOCILayout {
+		return []string{filepath.Join("blobs", "sha256")}
+	}
+	return []string{"layers", "configs", "manifests"}
+}
+
+// layerFile returns the path of a compressed layer relative to the bundle root.
+func (f bundleFormat) layerFile(h v1.Hash) string {
+	if f == formatOCILayout {
+		return blobFile(h)
+	}
+	return filepath.Join("layers", h.Hex+".tar.gz")
+}
+
+// configFile returns the path of a config file relative to the bundle root.
+func (f bundleFormat) configFile(h v1.Hash) string {
+	if f == formatOCILayout {
+		return blobFile(h)
+	}
+	return filepath.Join("configs", h.Hex+".json")
+}
+
+// manifestFile returns the path of a manifest or index relative to the bundle root.
+func (f bundleFormat) manifestFile(h v1.Hash) string {
+	if f == formatOCILayout {
+		return blobFile(h)
+	}
+	return filepath.Join("manifests", h.Hex+".json")
+}
+
+// entries returns the top-level files and directories of the bundle.
+func (f bundleFormat) entries() []string {
+	if f == formatOCILayout {
+		return []string{"blobs", ociLayoutFile, ociIndexFile, signatureFile(ociIndexFile), deltaFile, chartsDir, chartsFile}
+	}
+	return []string{"layers", "configs", "manifests", "manifest.json", signatureFile("manifest.json"), deltaFile, chartsDir, chartsFile}
+}
+
+// manifestEntry returns the file listing the images of the bundle.
+func (f bundleFormat) manifestEntry() string {
+	if f == formatOCILayout {
+		return ociIndexFile
+	}
+	return "manifest.json"
+}
+
+func blobFile(h v1.Hash) string {
+	return filepath.Join("blobs", h.Algorithm, h.Hex)
+}
+
+// bundleSource reads the files of a bundle, either extracted to a directory or
+// read from the archive while it is streamed.
+type bundleSource interface {
+	ReadFile(path string) ([]byte, error)
+	Open(path string) (io.ReadCloser, error)
+}
+
+// dirSource is a bundle extracted to a directory.
+type dirSource string
+
+func (d dirSource) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), path))
+}
+
+func (d dirSource) Open(path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), path))
+}
+
+// bundleWriter writes the files of a bundle, either to an export directory or
+// directly into the archive.
+type bundleWriter interface {
+	WriteFile(path string, data []byte) error
+	// WriteStream writes size bytes read from r, size must be known in advance
+	// since archive entries are written without being buffered.
+	WriteStream(path string, size int64, r io.Reader) error
+	// Size returns the size of a file already written to the bundle.
+	Size(path string) (int64, error)
+}
+
+// dirWriter is a bundle exported to a directory.
+type dirWriter string
+
+func (d dirWriter) WriteFile(path string, data []byte) error {
+	path = filepath.Join(string(d), path)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (d dirWriter) WriteStream(path string, size int64, r io.Reader) error {
+	file, err := os.Create(filepath.Join(string(d), path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, r)
+	return err
+}
+
+func (d dirWriter) Size(path string) (int64, error) {
+	info, err := os.Stat(filepath.Join(string(d), path))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// bundleImage is an image backed by the raw manifest, config and layer files
+// of a bundle, so that it is pushed byte-for-byte with its original digest.
+// The config is read when needed, delta bundles leave out the configs of the
+// base the registry already has.
+type bundleImage struct {
+	rawManifest []byte
+	mediaType   types.MediaType
+	manifest    *v1.Manifest
+	configFile  string
+	source      bundleSource
+	format      bundleFormat
+}
+
+var _ partial.CompressedImageCore = (*bundleImage)(nil)
+
+func (i *bundleImage) RawConfigFile() ([]byte, error) {
+	rawConfig, err := i.source.ReadFile(i.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	return rawConfig, nil
+}
+
+// ConfigLayer returns the config as stored in the bundle, it is only read when
+// the registry does not have it yet.
+func (i *bundleImage) ConfigLayer() (v1.Layer, error) {
+	return partial.CompressedToLayer(&bundleLayer{
+		source: i.source,
+		path:   i.configFile,
+		desc:   i.manifest.Config,
+	})
+}
+
+func (i *bundleImage) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *bundleImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *bundleImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == h {
+			return &bundleLayer{
+				source: i.source,
+				path:   i.format.layerFile(h),
+				desc:   desc,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %s not found in manifest", h)
+}
+
+// bundleLayer is a compressed layer stored in a bundle.
+type bundleLayer struct {
+	source bundleSource
+	path   string
+	desc   v1.Descriptor
+}
+
+var _ partial.CompressedLayer = (*bundleLayer)(nil)
+
+func (l *bundleLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *bundleLayer) Compressed() (io.ReadCloser, error) {
+	return l.source.Open(l.path)
+}
+
+func (l *bundleLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *bundleLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// bundleIndex is a multi-architecture index backed by its raw manifest and the
+// child images saved in a bundle.
+type bundleIndex struct {
+	rawManifest []byte
+	mediaType   types.MediaType
+	images      map[v1.Hash]v1.Image
+}
+
+var _ v1.ImageIndex = (*bundleIndex)(nil)
+
+func (i *bundleIndex) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *bundleIndex) Digest() (v1.Hash, error) {
+	digest, _, err := v1.SHA256(bytes.NewReader(i.rawManifest))
+	return digest, err
+}
+
+func (i *bundleIndex) Size() (int64, error) {
+	return int64(len(i.rawManifest)), nil
+}
+
+func (i *bundleIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return v1.ParseIndexManifest(bytes.NewReader(i.rawManifest))
+}
+
+func (i *bundleIndex) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *bundleIndex) Image(h v1.Hash) (v1.Image, error) {
+	image, ok := i.images[h]
+	if !ok {
+		return nil, fmt.Errorf("manifest %s not found in bundle", h)
+	}
+	return image, nil
+}
+
+func (i *bundleIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	return nil, fmt.Errorf("nested index %s is not supported", h)
+}
+
+// loadBundleImage returns the image described by a manifest entry exactly as
+// it was saved.
+func loadBundleImage(manifest ImageManifest, source bundleSource, format bundleFormat) (v1.Image, error) {
+	rawManifest, err := source.ReadFile(manifest.ManifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest file: %v", err)
+	}
+	parsed, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifest file: %v", err)
+	}
+
+	mediaType := types.MediaType(manifest.MediaType)
+	if mediaType == "" {
+		mediaType = parsed.MediaType
+	}
+	return partial.CompressedToImage(&bundleImage{
+		rawManifest: rawManifest,
+		mediaType:   mediaType,
+		manifest:    parsed,
+		configFile:  manifest.ConfigFile,
+		source:      source,
+		format:      format,
+	})
+}
+
+// loadBundleIndex returns the index described by a manifest entry exactly as
+// it was saved, together with its child images.
+func loadBundleIndex(manifest ImageManifest, source bundleSource, format bundleFormat) (v1.ImageIndex, error) {
+	rawManifest, err := source.ReadFile(manifest.ManifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest file: %v", err)
+	}
+
+	images := make(map[v1.Hash]v1.Image)
+	for _, child := range manifest.Manifests {
+		image, err := loadBundleImage(child, source, format)
+		if err != nil {
+			return nil, fmt.Errorf("error loading manifest %s: %v", child.Digest, err)
+		}
+		digest, err := image.Digest()
+		if err != nil {
+			return nil, err
+		}
+		images[digest] = image
+	}
+
+	return &bundleIndex{
+		rawManifest: rawManifest,
+		mediaType:   types.MediaType(manifest.MediaType),
+		images:      images,
+	}, nil
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundleImageRoundTrip(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, dir := range []string{"layers", "configs", "manifests"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+
+	image, err := random.Image(1024, 3)
+	assert.NoError(t, err)
+
+	manifest, err := exportImage(image, dirWriter(outputDir), formatNative, newBlobSet())
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Layers, 3)
+
+	loaded, err := loadBundleImage(manifest, dirSource(outputDir), formatNative)
+	assert.NoError(t, err)
+
+	expectedDigest, err := image.Digest()
+	assert.NoError(t, err)
+	digest, err := loaded.Digest()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedDigest, digest)
+	assert.Equal(t, expectedDigest.String(), manifest.Digest)
+
+	expectedConfig, err := image.RawConfigFile()
+	assert.NoError(t, err)
+	config, err := loaded.RawConfigFile()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedConfig, config)
+
+	layers, err := loaded.Layers()
+	assert.NoError(t, err)
+	for i, layer := range layers {
+		layerDigest, err := layer.Digest()
+		assert.NoError(t, err)
+		assert.Equal(t, manifest.Layers[i], layerDigest.Hex)
+	}
+}
+
+func TestOCILayoutRoundTrip(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, dir := range formatOCILayout.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+
+	image, err := random.Image(1024, 2)
+	assert.NoError(t, err)
+
+	manifest, err := exportImage(image, dirWriter(outputDir), formatOCILayout, newBlobSet())
+	assert.NoError(t, err)
+	manifest.ImageName = "datarobot/test-image:1.0.0"
+	manifest.OriginalImage = "docker.io/datarobot/test-image:1.0.0"
+	assert.NoError(t, writeOCILayout(dirWriter(outputDir), []ImageManifest{manifest}))
+	assert.True(t, isOCILayout(dirSource(outputDir)))
+
+	// The bundle must be readable as a standard OCI image layout
+	index, err := layout.ImageIndexFromPath(outputDir)
+	assert.NoError(t, err)
+	indexManifest, err := index.IndexManifest()
+	assert.NoError(t, err)
+	assert.Len(t, indexManifest.Manifests, 1)
+	assert.Equal(t, "docker.io/datarobot/test-image:1.0.0", indexManifest.Manifests[0].Annotations[imageNameAnnotation])
+	assert.Equal(t, "docker.io/datarobot/test-image:1.0.0", indexManifest.Manifests[0].Annotations[refNameAnnotation])
+	layoutImage, err := index.Image(indexManifest.Manifests[0].Digest)
+	assert.NoError(t, err)
+	assert.NoError(t, validate.Image(layoutImage))
+
+	manifests, err := readOCILayout(dirSource(outputDir))
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageManifest{manifest}, manifests)
+
+	loaded, err := loadBundleImage(manifests[0], dirSource(outputDir), formatOCILayout)
+	assert.NoError(t, err)
+	expectedDigest, err := image.Digest()
+	assert.NoError(t, err)
+	digest, err := loaded.Digest()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedDigest, digest)
+
+	// Images of different repositories sharing a tag, or without a tag, are
+	// told apart by their ref name
+	other := manifest
+	other.ImageName = "datarobot/other-image:1.0.0"
+	other.OriginalImage = "docker.io/datarobot/other-image:1.0.0"
+	pinned := manifest
+	pinned.ImageName = "datarobot/pinned-image@" + manifest.Digest
+	pinned.OriginalImage = "docker.io/datarobot/pinned-image@" + manifest.Digest
+	assert.NoError(t, writeOCILayout(dirWriter(outputDir), []ImageManifest{manifest, other, pinned}))
+	index, err = layout.ImageIndexFromPath(outputDir)
+	assert.NoError(t, err)
+	indexManifest, err = index.IndexManifest()
+	assert.NoError(t, err)
+	var refNames []string
+	for _, desc := range indexManifest.Manifests {
+		refNames = append(refNames, desc.Annotations[refNameAnnotation])
+	}
+	assert.Equal(t, []string{"docker.io/datarobot/test-image:1.0.0", "docker.io/datarobot/other-image:1.0.0", pinned.OriginalImage}, refNames)
+	manifests, err = readOCILayout(dirSource(outputDir))
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageManifest{manifest, other, pinned}, manifests)
+
+	// Official images keep the path written in the chart, the containerd
+	// annotation has the normalized name
+	manifest.ImageName = "busybox:1.36.1"
+	manifest.OriginalImage = "docker.io/library/busybox:1.36.1"
+	assert.NoError(t, writeOCILayout(dirWriter(outputDir), []ImageManifest{manifest}))
+	manifests, err = readOCILayout(dirSource(outputDir))
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageManifest{manifest}, manifests)
+}
@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	helmchartutil "helm.sh/helm/v3/pkg/chartutil"
+)
+
+const (
+	// chartsFile lists the Helm charts saved with --include-charts, which are
+	// stored in the charts directory of the bundle.
+	chartsFile = "charts.json"
+	chartsDir  = "charts"
+
+	// Media types of the charts pushed by helm push.
+	chartConfigMediaType  types.MediaType = "application/vnd.cncf.helm.config.v1+json"
+	chartContentMediaType types.MediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// bundleChart is a packaged Helm chart of the bundle.
+type bundleChart struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	File    string `json:"file"`
+	Digest  string `json:"digest"`
+
+	data []byte
+}
+
+// packageCharts packages the charts given to save as helm package does, with
+// the dependencies vendored in their charts directory. Charts given as an
+// archive are kept as they are.
+func packageCharts(chartPaths []string) ([]bundleChart, error) {
+	var charts []bundleChart
+	seen := make(map[string]bool)
+	for _, chartPath := range chartPaths {
+		ch, err := loader.Load(chartPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading chart %s: %v", chartPath, err)
+		}
+		err = action.CheckDependencies(ch, ch.Metadata.Dependencies)
+		if err != nil {
+			return nil, fmt.Errorf("chart %s is missing dependencies, run 'helm dependency build' first: %v", chartPath, err)
+		}
+
+		info, err := os.Stat(chartPath)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		if info.IsDir() {
+			dir, err := os.MkdirTemp("", "helm-datarobot-chart-*")
+			if err != nil {
+				return nil, fmt.Errorf("error creating temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			file, err := helmchartutil.Save(ch, dir)
+			if err != nil {
+				return nil, fmt.Errorf("error packaging chart %s: %v", chartPath, err)
+			}
+			data, err = os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			data, err = os.ReadFile(chartPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		file := filepath.ToSlash(filepath.Join(chartsDir, fmt.Sprintf("%s-%s.tgz", ch.Name(), ch.Metadata.Version)))
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		digest, _, err := v1.SHA256(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		charts = append(charts, bundleChart{
+			Name:    ch.Name(),
+			Version: ch.Metadata.Version,
+			File:    file,
+			Digest:  digest.String(),
+			data:    data,
+		})
+	}
+	return charts, nil
+}
+
+// writeBundleCharts writes the packaged charts and the file listing them.
+func writeBundleCharts(w bundleWriter, charts []bundleChart, out printer) error {
+	if len(charts) == 0 {
+		return nil
+	}
+	for _, chart := range charts {
+		out.Printf("Including chart: %s\n", chart.File)
+		err := w.WriteFile(filepath.FromSlash(chart.File), chart.data)
+		if err != nil {
+			return fmt.Errorf("error writing chart %s: %v", chart.File, err)
+		}
+	}
+	data, err := json.MarshalIndent(charts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", chartsFile, err)
+	}
+	return w.WriteFile(chartsFile, data)
+}
+
+// readBundleCharts returns the charts of a bundle, bundles saved without
+// --include-charts have none.
+func readBundleCharts(source bundleSource) ([]bundleChart, error) {
+	data, err := source.ReadFile(chartsFile)
+	if err != nil {
+		return nil, nil
+	}
+	var charts []bundleChart
+	err = json.Unmarshal(data, &charts)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", chartsFile, err)
+	}
+	for _, chart := range charts {
+		if !isChartEntry(chart.File) {
+			return nil, fmt.Errorf("invalid chart file %s in %s", chart.File, chartsFile)
+		}
+	}
+	return charts, nil
+}
+
+// isChartEntry reports whether an entry of the bundle is a packaged chart.
+func isChartEntry(name string) bool {
+	return strings.HasPrefix(name, chartsDir+"/") && strings.HasSuffix(name, ".tgz") && !strings.Contains(name, "..")
+}
+
+// loadBundleCharts extracts the charts of a bundle to --charts-dir and pushes
+// them to the charts repository of the registry with --push-charts. It
+// returns an error when any of them failed.
+func loadBundleCharts(charts []bundleChart, source bundleSource, c loadConfig, out printer) error {
+	if len(charts) == 0 || (c.ChartsDir == "" && !c.PushCharts) {
+		return nil
+	}
+	var options []remote.Option
+	if c.PushCharts && !c.DryRun {
+		var err error
+		options, err = registryOptions(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, chart := range charts {
+		err := loadBundleChart(chart, source, c, options, out)
+		if err != nil {
+			out.Printf("Error loading chart %s: %v\n", chart.File, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to load %d of %d charts", failed, len(charts))
+	}
+	return nil
+}
+
+func loadBundleChart(chart bundleChart, source bundleSource, c loadConfig, options []remote.Option, out printer) error {
+	data, err := source.ReadFile(chart.File)
+	if err != nil {
+		return fmt.Errorf("error reading chart: %v", err)
+	}
+
+	if c.ChartsDir != "" {
+		chartPath := filepath.Join(c.ChartsDir, filepath.Base(chart.File))
+		if c.DryRun {
+			out.Printf("[Dry-Run] Extracting chart: %s\n", chartPath)
+		} else {
+			err = os.MkdirAll(c.ChartsDir, 0755)
+			if err == nil {
+				err = os.WriteFile(chartPath, data, 0644)
+			}
+			if err != nil {
+				return fmt.Errorf("error extracting chart: %v", err)
+			}
+			out.Printf("Extracted chart %s\n", chartPath)
+		}
+	}
+
+	if c.PushCharts {
+		// OCI tags cannot hold the "+" of SemVer build metadata, helm push
+		// replaces it with "_" and helm pull replaces it back
+		tag := strings.ReplaceAll(chart.Version, "+", "_")
+		ref, err := name.ParseReference(path.Join(c.RegistryHost, c.ChartsRepo, chart.Name) + ":" + tag)
+		if err != nil {
+			return fmt.Errorf("error parsing chart reference: %v", err)
+		}
+		if c.DryRun {
+			out.Printf("[Dry-Run] Pushing chart: %s\n", ref)
+			return nil
+		}
+		image, err := chartImage(data)
+		if err != nil {
+			return err
+		}
+		err = pushWithRetry(c.RetryAttempts, c.RetryDelay, out, ref.String(), func() error {
+			return remote.Write(ref, image, options...)
+		})
+		if err != nil {
+			return err
+		}
+		out.Printf("Successfully pushed chart %s\n", ref)
+	}
+	return nil
+}
+
+// chartImage returns a packaged chart as the OCI artifact helm push creates:
+// the chart metadata as config and the archive as single layer.
+func chartImage(data []byte) (v1.Image, error) {
+	ch, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error loading chart: %v", err)
+	}
+	rawConfig, err := json.Marshal(ch.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding chart metadata: %v", err)
+	}
+	layer := static.NewLayer(data, chartContentMediaType)
+	layerDigest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{
+		"org.opencontainers.image.title":   ch.Metadata.Name,
+		"org.opencontainers.image.version": ch.Metadata.Version,
+	}
+	if ch.Metadata.Description != "" {
+		annotations["org.opencontainers.image.description"] = ch.Metadata.Description
+	}
+	rawManifest, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: chartConfigMediaType,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: chartContentMediaType,
+			Digest:    layerDigest,
+			Size:      int64(len(data)),
+		}},
+		Annotations: annotations,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding chart manifest: %v", err)
+	}
+	return partial.CompressedToImage(&chartArtifact{rawManifest: rawManifest, rawConfig: rawConfig, layer: layer})
+}
+
+// chartArtifact is a chart pushed with the media types of helm push.
+type chartArtifact struct {
+	rawManifest []byte
+	rawConfig   []byte
+	layer       v1.Layer
+}
+
+var _ partial.CompressedImageCore = (*chartArtifact)(nil)
+
+func (a *chartArtifact) RawConfigFile() ([]byte, error) {
+	return a.rawConfig, nil
+}
+
+func (a *chartArtifact) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (a *chartArtifact) RawManifest() ([]byte, error) {
+	return a.rawManifest, nil
+}
+
+func (a *chartArtifact) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	digest, err := a.layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if h != digest {
+		return nil, fmt.Errorf("layer %s not found in chart", h)
+	}
+	return a.layer, nil
+}
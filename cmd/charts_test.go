@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart/loader"
+)
+
+func TestPackageCharts(t *testing.T) {
+	subchart := "../tests/charts/test-chart1/charts/test-chart2-0.1.0.tgz"
+	charts, err := packageCharts([]string{"../tests/charts/test-chart1", "../tests/charts/test-chart4", subchart, "../tests/charts/test-chart4"})
+	assert.NoError(t, err)
+	assert.Len(t, charts, 3)
+	assert.Equal(t, "test-chart1", charts[0].Name)
+	assert.Equal(t, "0.1.0", charts[0].Version)
+	assert.Equal(t, "charts/test-chart1-0.1.0.tgz", charts[0].File)
+
+	// The dependencies are packaged with the chart
+	ch, err := loader.LoadArchive(bytes.NewReader(charts[0].data))
+	assert.NoError(t, err)
+	assert.Len(t, ch.Dependencies(), 1)
+	assert.Equal(t, "test-chart2", ch.Dependencies()[0].Name())
+
+	// Archives are kept as they are
+	data, err := os.ReadFile(subchart)
+	assert.NoError(t, err)
+	assert.Equal(t, data, charts[2].data)
+
+	t.Run("missing-dependency", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte(`apiVersion: v2
+name: parent
+version: 1.0.0
+dependencies:
+  - name: child
+    version: 1.0.0
+    repository: file://../child
+`), 0644))
+		_, err := packageCharts([]string{dir})
+		assert.ErrorContains(t, err, "chart "+dir+" is missing dependencies, run 'helm dependency build' first")
+	})
+}
+
+func TestSaveLoadCharts(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	image, err := random.Image(256, 1)
+	assert.NoError(t, err)
+	ref, err := name.ParseReference(host + "/src/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, image))
+
+	charts, err := packageCharts([]string{"../tests/charts/test-chart1"})
+	assert.NoError(t, err)
+	var buf strings.Builder
+	cmd := &cobra.Command{}
+	cmd.SetOut(&buf)
+	tarballPath := filepath.Join(t.TempDir(), "images.tar.zst")
+	s := saveConfig{Output: tarballPath, OutputDir: filepath.Join(t.TempDir(), "export"), Format: string(formatOCILayout), Concurrency: 1, Stream: true, charts: charts}
+	images := []chartutil.DatarobotImageDeclaration{{Image: ref.String()}}
+	assert.NoError(t, streamSave(images, s, zstd.SpeedFastest, cmd))
+	assert.Contains(t, buf.String(), "Including chart: charts/test-chart1-0.1.0.tgz\n")
+
+	output, err := executeCommand(rootCmd, "verify "+tarballPath)
+	assert.NoError(t, err)
+	assert.Contains(t, output, "Chart test-chart1 0.1.0: charts/test-chart1-0.1.0.tgz")
+
+	for _, mode := range []string{"extract", "stream"} {
+		t.Run(mode, func(t *testing.T) {
+			target := httptest.NewServer(registry.New())
+			defer target.Close()
+			targetHost := strings.TrimPrefix(target.URL, "http://")
+			chartsDir := filepath.Join(t.TempDir(), "charts")
+			l := loadConfig{RegistryHost: targetHost, Concurrency: 1, OutputDir: filepath.Join(t.TempDir(), "export"), ChartsDir: chartsDir, PushCharts: true, ChartsRepo: "helm/charts"}
+			signature, err := newBundleSignature("", false)
+			assert.NoError(t, err)
+			var buf strings.Builder
+			cmd := &cobra.Command{}
+			cmd.SetOut(&buf)
+			if mode == "stream" {
+				err = streamLoad(tarballPath, l, signature, cmd)
+			} else {
+				err = extractLoad(tarballPath, l, signature, cmd)
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, buf.String(), "Successfully pushed chart "+targetHost+"/helm/charts/test-chart1:0.1.0\n")
+
+			extracted, err := os.ReadFile(filepath.Join(chartsDir, "test-chart1-0.1.0.tgz"))
+			assert.NoError(t, err)
+			assert.Equal(t, charts[0].data, extracted)
+
+			// The chart is pushed with the media types of helm push
+			chartRef, err := name.ParseReference(targetHost + "/helm/charts/test-chart1:0.1.0")
+			assert.NoError(t, err)
+			pushed, err := remote.Image(chartRef)
+			assert.NoError(t, err)
+			manifest, err := pushed.Manifest()
+			assert.NoError(t, err)
+			assert.Equal(t, chartConfigMediaType, manifest.Config.MediaType)
+			assert.Equal(t, "test-chart1", manifest.Annotations["org.opencontainers.image.title"])
+			rawConfig, err := pushed.RawConfigFile()
+			assert.NoError(t, err)
+			assert.Contains(t, string(rawConfig), `"name":"test-chart1"`)
+			layers, err := pushed.Layers()
+			assert.NoError(t, err)
+			assert.Len(t, layers, 1)
+			mediaType, err := layers[0].MediaType()
+			assert.NoError(t, err)
+			assert.Equal(t, chartContentMediaType, mediaType)
+			reader, err := layers[0].Compressed()
+			assert.NoError(t, err)
+			content, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, charts[0].data, content)
+		})
+	}
+
+	t.Run("build-metadata", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte(`apiVersion: v2
+name: build
+version: 1.2.3+build.4
+`), 0644))
+		built, err := packageCharts([]string{dir})
+		assert.NoError(t, err)
+		bundleDir := t.TempDir()
+		assert.NoError(t, dirWriter(bundleDir).WriteFile(built[0].File, built[0].data))
+
+		target := httptest.NewServer(registry.New())
+		defer target.Close()
+		targetHost := strings.TrimPrefix(target.URL, "http://")
+		l := loadConfig{RegistryHost: targetHost, PushCharts: true, ChartsRepo: "charts"}
+		var buf strings.Builder
+		cmd := &cobra.Command{}
+		cmd.SetOut(&buf)
+		assert.NoError(t, loadBundleChart(built[0], dirSource(bundleDir), l, nil, cmd))
+		assert.Contains(t, buf.String(), "Successfully pushed chart "+targetHost+"/charts/build:1.2.3_build.4\n")
+		chartRef, err := name.ParseReference(targetHost + "/charts/build:1.2.3_build.4")
+		assert.NoError(t, err)
+		_, err = remote.Image(chartRef)
+		assert.NoError(t, err)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		check := newBundleCheck()
+		assert.NoError(t, check.add(charts[0].File, strings.NewReader("tampered")))
+		check.charts = charts
+		err := check.report(nil, formatNative, &cobra.Command{})
+		assert.EqualError(t, err, "bundle is corrupted: 1 corrupted and 0 missing entries")
+
+		check = newBundleCheck()
+		check.charts = charts
+		assert.Equal(t, []string{charts[0].File}, check.missing(nil, formatNative))
+	})
+}
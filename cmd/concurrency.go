@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+// printer is implemented by *cobra.Command and syncPrinter.
+type printer interface {
+	Printf(format string, i ...interface{})
+}
+
+// syncPrinter serializes the output of images processed concurrently.
+type syncPrinter struct {
+	mu  sync.Mutex
+	cmd *cobra.Command
+}
+
+func newSyncPrinter(cmd *cobra.Command) *syncPrinter {
+	return &syncPrinter{cmd: cmd}
+}
+
+func (p *syncPrinter) Printf(format string, i ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cmd.Printf(format, i...)
+}
+
+// forEachConcurrently calls fn for every index lower than n, with at most
+// concurrency calls running at the same time.
+func forEachConcurrently(n int, concurrency int, fn func(idx int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				fn(idx)
+			}
+		}()
+	}
+	for idx := range n {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// pushWithRetry calls push until it succeeds or the retry attempts are
+// exhausted, see retry.
+func pushWithRetry(retryAttempts int, retryDelay int, out printer, imageName string, push func() error) error {
+	err := retry("push", retryAttempts, retryDelay, out, imageName, push)
+	if err != nil {
+		return fmt.Errorf("error pushing image: %v", err)
+	}
+	return nil
+}
+
+// pullWithRetry calls pull until it succeeds or the retry attempts are
+// exhausted, see retry.
+func pullWithRetry(retryAttempts int, retryDelay int, out printer, imageName string, pull func() error) error {
+	return retry("pull", retryAttempts, retryDelay, out, imageName, pull)
+}
+
+// retry calls fn once and again up to retryAttempts times while it fails, the
+// delay between attempts doubles after each of them. It returns the error of
+// the last attempt.
+func retry(action string, retryAttempts int, retryDelay int, out printer, imageName string, fn func() error) error {
+	var err error
+	delay := time.Duration(retryDelay) * time.Second
+	for i := range retryAttempts + 1 {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if i == retryAttempts {
+			break
+		}
+		out.Printf("Failed to %s image: %s. Attempt %d/%d, retrying in %s. Error: %v\n", action, imageName, i+1, retryAttempts+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+type pushStatus int
+
+const (
+	statusPushed pushStatus = iota
+	statusExists
+	// statusResumed is an image pushed by the previous load of the bundle
+	statusResumed
+)
+
+// pushResult is the outcome of pushing one image with load or sync.
+type pushResult struct {
+	image  string
+	status pushStatus
+	err    error
+}
+
+// printPushSummary prints the aggregated results of load or sync and returns
+// an error when any image failed.
+func printPushSummary(out printer, results []pushResult) error {
+	var pushed, existing int
+	var failed []pushResult
+	for _, result := range results {
+		switch {
+		case result.err != nil:
+			failed = append(failed, result)
+		case result.status == statusExists || result.status == statusResumed:
+			existing++
+		default:
+			pushed++
+		}
+	}
+
+	out.Printf("Summary: %d pushed, %d already in the registry, %d failed\n", pushed, existing, len(failed))
+	for _, result := range failed {
+		out.Printf("Failed image %s: %v\n", result.image, result.err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to push %d of %d images", len(failed), len(results))
+	}
+	return nil
+}
+
+// blobUploads shares the layers uploaded by the images pushed concurrently: a
+// layer is uploaded once, other repositories mount it from the first one.
+type blobUploads struct {
+	mu      sync.Mutex
+	uploads map[v1.Hash]*blobUpload
+	// journal records the layers pushed by load, they are not uploaded again
+	// when it is resumed
+	journal *loadJournal
+}
+
+type blobUpload struct {
+	done chan struct{}
+	repo name.Repository
+	err  error
+}
+
+func newBlobUploads() *blobUploads {
+	return &blobUploads{uploads: make(map[v1.Hash]*blobUpload)}
+}
+
+// upload pushes a layer to repo, or mounts it from the repository it was
+// already pushed to. A failed upload is attempted again by the next caller.
+func (u *blobUploads) upload(layer v1.Layer, repo name.Repository, options ...remote.Option) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return fmt.Errorf("error getting layer digest: %v", err)
+	}
+
+	if u.journal.pushedBlob(repo, digest) {
+		return nil
+	}
+
+	u.mu.Lock()
+	upload, inFlight := u.uploads[digest]
+	if !inFlight {
+		upload = &blobUpload{done: make(chan struct{}), repo: repo}
+		u.uploads[digest] = upload
+	}
+	u.mu.Unlock()
+
+	if !inFlight {
+		upload.err = remote.WriteLayer(repo, layer, options...)
+		if upload.err != nil {
+			u.mu.Lock()
+			delete(u.uploads, digest)
+			u.mu.Unlock()
+			upload.err = fmt.Errorf("error pushing layer %s: %v", digest, upload.err)
+		} else {
+			upload.err = u.journal.recordBlob(repo, digest)
+		}
+		close(upload.done)
+		return upload.err
+	}
+
+	<-upload.done
+	if upload.err != nil {
+		return u.upload(layer, repo, options...)
+	}
+	if upload.repo.String() == repo.String() {
+		return nil
+	}
+	mount := &remote.MountableLayer{Layer: layer, Reference: upload.repo.Digest(digest.String())}
+	err = remote.WriteLayer(repo, mount, options...)
+	if err != nil {
+		return fmt.Errorf("error mounting layer %s: %v", digest, err)
+	}
+	return u.journal.recordBlob(repo, digest)
+}
+
+// uploadLayers uploads the layers of images before their manifests are pushed.
+func (u *blobUploads) uploadLayers(images []v1.Image, repo name.Repository, options ...remote.Option) error {
+	for _, image := range images {
+		layers, err := image.Layers()
+		if err != nil {
+			return fmt.Errorf("error getting layers: %v", err)
+		}
+		for _, layer := range layers {
+			err = u.upload(layer, repo, options...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexImages returns the child images of an index.
+func indexImages(index v1.ImageIndex) ([]v1.Image, error) {
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var images []v1.Image
+	for _, child := range indexManifest.Manifests {
+		image, err := index.Image(child.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("error loading manifest %s: %v", child.Digest, err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
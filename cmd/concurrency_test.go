@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForEachConcurrently(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+
+	forEachConcurrently(20, 3, func(idx int) {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			previous := maxRunning.Load()
+			if current <= previous || maxRunning.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		mu.Lock()
+		seen[idx] = true
+		mu.Unlock()
+	})
+
+	assert.Len(t, seen, 20)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(3))
+}
+
+func TestPrintPushSummary(t *testing.T) {
+	var buf strings.Builder
+	cmd := &cobra.Command{}
+	cmd.SetOut(&buf)
+	err := printPushSummary(cmd, []pushResult{
+		{image: "docker.io/alpine/curl:8.9.1", status: statusPushed},
+		{image: "docker.io/library/busybox:1.36.1", status: statusExists},
+		{image: "docker.io/alpine/curl:8.10.0", err: errors.New("unauthorized")},
+	})
+	assert.EqualError(t, err, "failed to push 1 of 3 images")
+	expectedOutput := `Summary: 1 pushed, 1 already in the registry, 1 failed
+Failed image docker.io/alpine/curl:8.10.0: unauthorized
+`
+	assert.Equal(t, expectedOutput, buf.String())
+}
+
+func TestPushWithRetry(t *testing.T) {
+	var buf strings.Builder
+	cmd := &cobra.Command{}
+	cmd.SetOut(&buf)
+	attempts := 0
+	err := pushWithRetry(2, 0, cmd, "docker.io/alpine/curl:8.9.1", func() error {
+		attempts++
+		return errors.New("unauthorized")
+	})
+	assert.EqualError(t, err, "error pushing image: unauthorized")
+	assert.Equal(t, 3, attempts)
+	// The last attempt is not followed by a retry
+	expectedOutput := `Failed to push image: docker.io/alpine/curl:8.9.1. Attempt 1/3, retrying in 0s. Error: unauthorized
+Failed to push image: docker.io/alpine/curl:8.9.1. Attempt 2/3, retrying in 0s. Error: unauthorized
+`
+	assert.Equal(t, expectedOutput, buf.String())
+
+	attempts = 0
+	err = pushWithRetry(2, 0, cmd, "docker.io/alpine/curl:8.9.1", func() error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("unauthorized")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestBlobUploadsShareLayers(t *testing.T) {
+	shared, err := random.Layer(1024, types.DockerLayer)
+	assert.NoError(t, err)
+	sharedDigest, err := shared.Digest()
+	assert.NoError(t, err)
+
+	var sharedUploads atomic.Int32
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Query().Get("digest") == sharedDigest.String() {
+			sharedUploads.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var refs []name.Reference
+	var images []v1.Image
+	for _, repo := range []string{"test/a:1", "test/a:2", "test/b:1"} {
+		base, err := random.Image(512, 1)
+		assert.NoError(t, err)
+		image, err := mutate.AppendLayers(base, shared)
+		assert.NoError(t, err)
+		ref, err := name.ParseReference(host + "/" + repo)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+		images = append(images, image)
+	}
+
+	uploads := newBlobUploads()
+	forEachConcurrently(len(images), len(images), func(idx int) {
+		err := uploads.uploadLayers([]v1.Image{images[idx]}, refs[idx].Context())
+		assert.NoError(t, err)
+		assert.NoError(t, remote.Write(refs[idx], images[idx]))
+	})
+
+	assert.Equal(t, int32(1), sharedUploads.Load())
+	for idx, ref := range refs {
+		desc, err := remote.Head(ref)
+		assert.NoError(t, err)
+		digest, err := images[idx].Digest()
+		assert.NoError(t, err)
+		assert.Equal(t, digest, desc.Digest)
+	}
+}
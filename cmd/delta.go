@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"gopkg.in/yaml.v2"
+)
+
+// deltaFile describes a delta bundle, saved against the bundle of a previous
+// release with --base.
+const deltaFile = "delta.json"
+
+// bundleDelta names the base a delta bundle was saved against and the layers
+// and configs it leaves out because the base already has them, in the
+// repositories of every image using them. They must be in the target registry,
+// loaded with the base, when the delta is loaded.
+type bundleDelta struct {
+	Base       string   `json:"base"`
+	BaseDigest string   `json:"base_digest"`
+	Blobs      []string `json:"blobs"`
+}
+
+// omits reports whether the blob was left out of the bundle.
+func (d *bundleDelta) omits(digest v1.Hash) bool {
+	if d == nil {
+		return false
+	}
+	for _, blob := range d.Blobs {
+		if blob == digest.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestBlobs returns the layers and configs of an image, of the platform
+// images of an index and of its referrers.
+func manifestBlobs(manifest ImageManifest) []v1.Hash {
+	var blobs []v1.Hash
+	if digest, ok := entryDigest(filepath.ToSlash(manifest.ConfigFile)); ok {
+		blobs = append(blobs, digest)
+	}
+	for _, layer := range manifest.Layers {
+		blobs = append(blobs, v1.Hash{Algorithm: "sha256", Hex: layer})
+	}
+	for _, child := range manifest.Manifests {
+		blobs = append(blobs, manifestBlobs(child)...)
+	}
+	for _, referrer := range manifest.Referrers {
+		blobs = append(blobs, manifestBlobs(referrer)...)
+	}
+	return blobs
+}
+
+// baseBlobs maps the layers and configs of a base to the repositories of the
+// images using them.
+type baseBlobs map[v1.Hash]map[string]bool
+
+func (b baseBlobs) add(blob v1.Hash, repository string) {
+	if b[blob] == nil {
+		b[blob] = make(map[string]bool)
+	}
+	b[blob][repository] = true
+}
+
+// has reports whether the repository had the blob in the base.
+func (b baseBlobs) has(blob v1.Hash, repository string) bool {
+	return b[blob][repository]
+}
+
+// imageRepository returns the repository of an image name of a bundle, the
+// images of a repository are loaded to the same target repository.
+func imageRepository(imageName string) string {
+	iUri, err := image_uri.NewDockerUri(imageName)
+	if err != nil {
+		return imageName
+	}
+	iUri.Tag = ""
+	iUri.Digest = ""
+	return iUri.RefName()
+}
+
+// readBaseBlobs returns the layers and configs of a base, either a bundle
+// saved by a previous release or a release manifest whose images are looked
+// up in their source registry. It returns the digest of the base file too,
+// computed while the base is read.
+func readBaseBlobs(basePath string) (baseBlobs, v1.Hash, error) {
+	file, err := openArchive(basePath)
+	if err != nil {
+		return nil, v1.Hash{}, fmt.Errorf("error reading base %s: %v", basePath, err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(file, hash))
+	header, err := reader.Peek(4)
+	if err != nil {
+		return nil, v1.Hash{}, fmt.Errorf("error reading base %s: %v", basePath, err)
+	}
+
+	var blobs baseBlobs
+	if bytes.Equal(header, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		blobs, err = readBundleBlobs(reader)
+	} else {
+		blobs, err = readReleaseManifestBlobs(basePath, reader)
+	}
+	if err != nil {
+		return nil, v1.Hash{}, err
+	}
+	// The padding after the end of the tar archive is part of the digest
+	_, err = io.Copy(io.Discard, reader)
+	if err != nil {
+		return nil, v1.Hash{}, fmt.Errorf("error reading base %s: %v", basePath, err)
+	}
+	return blobs, v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// readBundleBlobs returns the layers and configs of a bundle archive, the ones
+// a delta bundle leaves out to its own base included.
+func readBundleBlobs(archive io.Reader) (baseBlobs, error) {
+	source, err := readArchiveReaderMetadata(archive, newBundleCheck())
+	if err != nil {
+		return nil, fmt.Errorf("error reading base bundle: %v", err)
+	}
+	manifests, _, err := readBundleManifests(source)
+	if err != nil {
+		return nil, fmt.Errorf("error reading base bundle: %v", err)
+	}
+
+	blobs := make(baseBlobs)
+	for _, manifest := range manifests {
+		repository := imageRepository(manifest.ImageName)
+		for _, blob := range manifestBlobs(manifest) {
+			blobs.add(blob, repository)
+		}
+	}
+	return blobs, nil
+}
+
+// readReleaseManifestBlobs returns the layers and configs of the images of a
+// release manifest, as found in the registry they are pulled from.
+func readReleaseManifestBlobs(manifestPath string, r io.Reader) (baseBlobs, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var release releaseManifestOutput
+	err = yaml.Unmarshal(data, &release)
+	if err != nil || len(release.Images) == 0 {
+		return nil, fmt.Errorf("base %s is neither a bundle nor a release manifest", manifestPath)
+	}
+
+	blobs := make(baseBlobs)
+	for _, image := range release.Images {
+		iUri, err := image_uri.NewDockerUri(image.Source)
+		if err != nil {
+			return nil, err
+		}
+		written := iUri.AsWritten()
+		repository := imageRepository(written.RefName())
+		ref, err := name.ParseReference(image.Source)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return nil, fmt.Errorf("error pulling base image %s: %v", image.Source, err)
+		}
+
+		var images []v1.Image
+		if desc.MediaType.IsIndex() {
+			index, err := desc.ImageIndex()
+			if err != nil {
+				return nil, err
+			}
+			images, err = indexImages(index)
+			if err != nil {
+				return nil, fmt.Errorf("error pulling base image %s: %v", image.Source, err)
+			}
+		} else {
+			img, err := desc.Image()
+			if err != nil {
+				return nil, err
+			}
+			images = []v1.Image{img}
+		}
+		for _, img := range images {
+			manifest, err := img.Manifest()
+			if err != nil {
+				return nil, fmt.Errorf("error pulling base image %s: %v", image.Source, err)
+			}
+			blobs.add(manifest.Config.Digest, repository)
+			for _, layer := range manifest.Layers {
+				blobs.add(layer.Digest, repository)
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// newBundleDelta records the blobs left out of a delta bundle, the ones the
+// repositories of every image using them had in the base.
+func newBundleDelta(basePath string, baseDigest v1.Hash, base baseBlobs, manifests []ImageManifest) *bundleDelta {
+	delta := &bundleDelta{Base: filepath.Base(basePath), BaseDigest: baseDigest.String(), Blobs: []string{}}
+	omitted := make(map[v1.Hash]bool)
+	for _, manifest := range manifests {
+		repository := imageRepository(manifest.ImageName)
+		for _, blob := range manifestBlobs(manifest) {
+			previous, seen := omitted[blob]
+			omitted[blob] = base.has(blob, repository) && (previous || !seen)
+		}
+	}
+	for blob, omit := range omitted {
+		if omit {
+			delta.Blobs = append(delta.Blobs, blob.String())
+		}
+	}
+	sort.Strings(delta.Blobs)
+	return delta
+}
+
+// writeBundleDelta writes the description of a delta bundle.
+func writeBundleDelta(w bundleWriter, delta *bundleDelta) error {
+	data, err := json.MarshalIndent(delta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", deltaFile, err)
+	}
+	err = w.WriteFile(deltaFile, data)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", deltaFile, err)
+	}
+	return nil
+}
+
+// readBundleDelta reads the description of a delta bundle, it returns nil for
+// complete bundles.
+func readBundleDelta(source bundleSource) (*bundleDelta, error) {
+	data, err := source.ReadFile(deltaFile)
+	if err != nil {
+		return nil, nil
+	}
+	var delta bundleDelta
+	err = json.Unmarshal(data, &delta)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", deltaFile, err)
+	}
+	return &delta, nil
+}
+
+// checkBaseBlobs checks that the target registry already has the blobs a
+// delta bundle leaves out, in the repository of every image using them.
+func checkBaseBlobs(manifests []ImageManifest, delta *bundleDelta, c loadConfig, options []remote.Option, out printer) error {
+	missing := 0
+	checked := make(map[string]bool)
+	for _, manifest := range manifests {
+		iUri, err := targetUri(manifest, c)
+		if err != nil {
+			return err
+		}
+		repo, err := name.NewRepository(iUri.Base())
+		if err != nil {
+			return fmt.Errorf("error creating repository from URI %s: %v", iUri.String(), err)
+		}
+		for _, blob := range manifestBlobs(manifest) {
+			key := repo.String() + "@" + blob.String()
+			if !delta.omits(blob) || checked[key] {
+				continue
+			}
+			checked[key] = true
+			if !blobExists(repo.Digest(blob.String()), options) {
+				out.Printf("Missing base blob %s in %s\n", blob, repo)
+				missing++
+			}
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d blobs of the base bundle %s are missing from the target registry, load it first", missing, delta.Base)
+	}
+	return nil
+}
+
+// blobExists reports whether the registry has a blob, with a HEAD request.
+func blobExists(ref name.Digest, options []remote.Option) bool {
+	layer, err := remote.Layer(ref, options...)
+	if err != nil {
+		return false
+	}
+	_, err = layer.Size()
+	return err == nil
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// saveTestDelta saves the images into a bundle archive, as a delta of base
+// when it is not empty, and returns its path.
+func saveTestDelta(t *testing.T, format bundleFormat, base string, images ...string) string {
+	outputDir := t.TempDir()
+	for _, dir := range format.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+	c := saveConfig{Format: string(format), Concurrency: 1, Base: base}
+	if base != "" {
+		blobs, digest, err := readBaseBlobs(base)
+		assert.NoError(t, err)
+		c.baseBlobs, c.baseDigest = blobs, digest
+	}
+	var declarations []chartutil.DatarobotImageDeclaration
+	for _, image := range images {
+		declarations = append(declarations, chartutil.DatarobotImageDeclaration{Image: image})
+	}
+
+	cmd := &cobra.Command{}
+	cmd.SetOut(&strings.Builder{})
+	manifests, err := exportLayersAndConfigs(declarations, c, dirWriter(outputDir), cmd)
+	assert.NoError(t, err)
+	assert.Len(t, manifests, len(images))
+	assert.NoError(t, writeSaveDelta(dirWriter(outputDir), c, manifests, cmd))
+	assert.NoError(t, writeBundleManifest(dirWriter(outputDir), format, manifests))
+
+	tarballPath := filepath.Join(t.TempDir(), "images.tar.zst")
+	assert.NoError(t, createTarball(tarballPath, outputDir, format, zstd.SpeedFastest, 0))
+	return tarballPath
+}
+
+func TestSaveLoadDelta(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// The second release adds a layer on top of the first one
+	release1, err := random.Image(512, 2)
+	assert.NoError(t, err)
+	extra, err := random.Layer(512, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	assert.NoError(t, err)
+	release2, err := mutate.AppendLayers(release1, extra)
+	assert.NoError(t, err)
+	ref1, err := name.ParseReference(host + "/src/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref1, release1))
+	ref2, err := name.ParseReference(host + "/src/app:2")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref2, release2))
+
+	for _, format := range []bundleFormat{formatNative, formatOCILayout} {
+		t.Run(string(format), func(t *testing.T) {
+			base := saveTestDelta(t, format, "", ref1.String())
+			delta := saveTestDelta(t, format, base, ref2.String())
+
+			source, err := readArchiveMetadata(delta, newBundleCheck())
+			assert.NoError(t, err)
+			bundleDelta, err := readBundleDelta(source)
+			assert.NoError(t, err)
+			assert.NotNil(t, bundleDelta)
+			baseDigest, err := fileDigest(base)
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Base(base), bundleDelta.Base)
+			assert.Equal(t, baseDigest.String(), bundleDelta.BaseDigest)
+			layers, err := release1.Layers()
+			assert.NoError(t, err)
+			var expected []string
+			for _, layer := range layers {
+				digest, err := layer.Digest()
+				assert.NoError(t, err)
+				expected = append(expected, digest.String())
+			}
+			assert.ElementsMatch(t, expected, bundleDelta.Blobs)
+
+			// Only the new layer and config are in the delta bundle
+			check := newBundleCheck()
+			_, err = readArchiveMetadata(delta, check)
+			assert.NoError(t, err)
+			for _, digest := range expected {
+				hash, err := v1.NewHash(digest)
+				assert.NoError(t, err)
+				assert.NotContains(t, check.entries, filepath.ToSlash(format.layerFile(hash)))
+			}
+			extraDigest, err := extra.Digest()
+			assert.NoError(t, err)
+			assert.Contains(t, check.entries, filepath.ToSlash(format.layerFile(extraDigest)))
+			manifests, _, err := readBundleManifests(source)
+			assert.NoError(t, err)
+			assert.Len(t, check.missing(manifests, format), 2)
+			check.delta = bundleDelta
+			assert.Empty(t, check.missing(manifests, format))
+
+			// The delta is refused until the base is loaded, to another registry
+			// since the test registry shares blobs between repositories
+			target := httptest.NewServer(registry.New())
+			defer target.Close()
+			targetHost := strings.TrimPrefix(target.URL, "http://")
+			var buf strings.Builder
+			cmd := &cobra.Command{}
+			cmd.SetOut(&buf)
+			l := loadConfig{RegistryHost: targetHost, ImagePrefix: "dst", RetryAttempts: 1, Concurrency: 1}
+			signature, err := newBundleSignature("", false)
+			assert.NoError(t, err)
+			err = streamLoad(delta, l, signature, cmd)
+			assert.ErrorContains(t, err, "2 blobs of the base bundle "+filepath.Base(base)+" are missing from the target registry, load it first")
+			assert.Contains(t, buf.String(), "Missing base blob "+expected[0])
+
+			assert.NoError(t, streamLoad(base, l, signature, cmd))
+			assert.NoError(t, streamLoad(delta, l, signature, cmd))
+			pushedRef, err := name.ParseReference(targetHost + "/dst/src/app:2")
+			assert.NoError(t, err)
+			pushed, err := remote.Head(pushedRef)
+			assert.NoError(t, err)
+			digest, err := release2.Digest()
+			assert.NoError(t, err)
+			assert.Equal(t, digest, pushed.Digest)
+		})
+	}
+}
+
+func TestSaveDeltaNewRepository(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	release1, err := random.Image(512, 2)
+	assert.NoError(t, err)
+	layers, err := release1.Layers()
+	assert.NoError(t, err)
+	// A new image of another repository shares the first layer of release1
+	base, err := random.Image(512, 1)
+	assert.NoError(t, err)
+	other, err := mutate.AppendLayers(base, layers[0])
+	assert.NoError(t, err)
+	ref1, err := name.ParseReference(host + "/src/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref1, release1))
+	ref2, err := name.ParseReference(host + "/src/app:2")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref2, release1))
+	refOther, err := name.ParseReference(host + "/src/other:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(refOther, other))
+
+	baseBundle := saveTestDelta(t, formatNative, "", ref1.String())
+	delta := saveTestDelta(t, formatNative, baseBundle, ref2.String(), refOther.String())
+
+	check := newBundleCheck()
+	source, err := readArchiveMetadata(delta, check)
+	assert.NoError(t, err)
+	bundleDelta, err := readBundleDelta(source)
+	assert.NoError(t, err)
+	// The shared layer is left out only where src/app already had it
+	shared, err := layers[0].Digest()
+	assert.NoError(t, err)
+	omitted, err := layers[1].Digest()
+	assert.NoError(t, err)
+	config, err := release1.ConfigName()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{config.String(), omitted.String()}, bundleDelta.Blobs)
+	assert.Contains(t, check.entries, filepath.ToSlash(formatNative.layerFile(shared)))
+	assert.NotContains(t, check.entries, filepath.ToSlash(formatNative.layerFile(omitted)))
+	manifests, _, err := readBundleManifests(source)
+	assert.NoError(t, err)
+	check.delta = bundleDelta
+	assert.Empty(t, check.missing(manifests, formatNative))
+}
+
+func TestReadBundleDelta(t *testing.T) {
+	source := &archiveSource{files: make(map[string][]byte)}
+	delta, err := readBundleDelta(source)
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+	assert.False(t, delta.omits(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}))
+
+	data, err := json.Marshal(bundleDelta{Base: "images-1.0.tar.zst", Blobs: []string{"sha256:" + strings.Repeat("a", 64)}})
+	assert.NoError(t, err)
+	source.files[deltaFile] = data
+	delta, err = readBundleDelta(source)
+	assert.NoError(t, err)
+	assert.Equal(t, "images-1.0.tar.zst", delta.Base)
+	assert.True(t, delta.omits(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}))
+	assert.False(t, delta.omits(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("b", 64)}))
+
+	source.files[deltaFile] = []byte("{")
+	_, err = readBundleDelta(source)
+	assert.ErrorContains(t, err, "error decoding delta.json")
+}
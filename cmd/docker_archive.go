@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/spf13/cobra"
+)
+
+// defaultDockerArchivePlatform is saved for multi-architecture images when no
+// platform is requested, a docker archive only holds one platform per image.
+var defaultDockerArchivePlatform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+// writeDockerArchives writes the images saved in outputDir as a `docker save`
+// compatible archive, or as one archive per image in the output directory when
+// split is set.
+func writeDockerArchives(output string, outputDir string, manifests []ImageManifest, split bool, key crypto.Signer, cmd *cobra.Command) error {
+	refToImage := make(map[name.Reference]v1.Image)
+	images := make(map[string]v1.Image)
+	for _, manifest := range manifests {
+		ref, image, err := dockerArchiveImage(manifest, outputDir, images)
+		if err != nil {
+			return err
+		}
+		if !split {
+			refToImage[ref] = image
+			continue
+		}
+
+		err = os.MkdirAll(output, 0755)
+		if err != nil {
+			return fmt.Errorf("error creating output directory: %v", err)
+		}
+		archive := filepath.Join(output, dockerArchiveName(ref))
+		cmd.Printf("Writing image archive: %s\n", archive)
+		err = tarball.WriteToFile(archive, ref, image)
+		if err != nil {
+			return fmt.Errorf("error writing docker archive %s: %v", archive, err)
+		}
+		err = writeArchiveChecksum(archive, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if split {
+		return nil
+	}
+	if len(refToImage) == 0 {
+		return fmt.Errorf("no image to write in the docker archive")
+	}
+	err := tarball.MultiRefWriteToFile(output, refToImage)
+	if err != nil {
+		return fmt.Errorf("error writing docker archive: %v", err)
+	}
+	return writeArchiveChecksum(output, key)
+}
+
+// dockerArchiveImage returns the reference and the single platform image saved
+// for a manifest entry. Images are cached by digest so that an image saved
+// under several names is only written once.
+func dockerArchiveImage(manifest ImageManifest, outputDir string, images map[string]v1.Image) (name.Reference, v1.Image, error) {
+	iUri, err := image_uri.NewDockerUri(manifest.OriginalImage)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, err := name.ParseReference(iUri.TagRef())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing reference %s: %v", iUri.TagRef(), err)
+	}
+
+	if _, ok := ref.(name.Tag); !ok {
+		return nil, nil, fmt.Errorf("image %s has no tag but a docker archive names its images with one, declare it with a tag or retag it", manifest.OriginalImage)
+	}
+
+	if len(manifest.Manifests) > 1 {
+		return nil, nil, fmt.Errorf("image %s has %d platforms but a docker archive holds a single one, select it with --platform", manifest.OriginalImage, len(manifest.Manifests))
+	}
+	if len(manifest.Manifests) == 1 {
+		manifest = manifest.Manifests[0]
+	}
+
+	if image, ok := images[manifest.Digest]; ok {
+		return ref, image, nil
+	}
+	image, err := loadBundleImage(manifest, dirSource(outputDir), formatNative)
+	if err != nil {
+		return nil, nil, err
+	}
+	images[manifest.Digest] = image
+	return ref, image, nil
+}
+
+// checkDockerArchiveTags refuses the images declared by digest only before they
+// are pulled, docker load would import them without a name.
+func checkDockerArchiveTags(images []chartutil.DatarobotImageDeclaration) error {
+	for _, i := range images {
+		iUri, err := image_uri.NewDockerUri(i.Image)
+		if err != nil {
+			return err
+		}
+		if iUri.Tag == "" && iUri.Digest != "" && i.Tag == "" {
+			return fmt.Errorf("image %s has no tag but a docker archive names its images with one, declare it with a tag or retag it", i.Image)
+		}
+	}
+	return nil
+}
+
+// dockerArchiveName returns the file name of the archive of a single image.
+func dockerArchiveName(ref name.Reference) string {
+	replacer := strings.NewReplacer("/", "_", ":", "_", "@", "_")
+	return replacer.Replace(ref.Context().RepositoryStr()+":"+ref.Identifier()) + ".tar"
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDockerArchives(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+
+	image, err := random.Image(1024, 2)
+	assert.NoError(t, err)
+	manifest, err := exportImage(image, dirWriter(outputDir), formatNative, newBlobSet())
+	assert.NoError(t, err)
+	manifest.OriginalImage = "docker.io/datarobot/test-image:1.0.0"
+	retagged := manifest
+	retagged.OriginalImage = "docker.io/datarobot/test-image:stable"
+	manifests := []ImageManifest{manifest, retagged}
+
+	archive := filepath.Join(t.TempDir(), "images.tar")
+	assert.NoError(t, writeDockerArchives(archive, outputDir, manifests, false, nil, rootCmd))
+
+	expectedConfig, err := image.ConfigName()
+	assert.NoError(t, err)
+	for _, ref := range []string{"docker.io/datarobot/test-image:1.0.0", "docker.io/datarobot/test-image:stable"} {
+		tag, err := name.NewTag(ref)
+		assert.NoError(t, err)
+		loaded, err := tarball.ImageFromPath(archive, &tag)
+		assert.NoError(t, err)
+		config, err := loaded.ConfigName()
+		assert.NoError(t, err)
+		assert.Equal(t, expectedConfig, config)
+	}
+
+	t.Run("split", func(t *testing.T) {
+		splitDir := filepath.Join(t.TempDir(), "images")
+		assert.NoError(t, writeDockerArchives(splitDir, outputDir, manifests, true, nil, rootCmd))
+		for _, file := range []string{"datarobot_test-image_1.0.0.tar", "datarobot_test-image_stable.tar"} {
+			loaded, err := tarball.ImageFromPath(filepath.Join(splitDir, file), nil)
+			assert.NoError(t, err)
+			config, err := loaded.ConfigName()
+			assert.NoError(t, err)
+			assert.Equal(t, expectedConfig, config)
+		}
+	})
+
+	t.Run("digest-only", func(t *testing.T) {
+		pinned := manifest
+		pinned.OriginalImage = "docker.io/datarobot/test-image@" + manifest.Digest
+		err := writeDockerArchives(archive, outputDir, []ImageManifest{pinned}, false, nil, rootCmd)
+		assert.EqualError(t, err, "image "+pinned.OriginalImage+" has no tag but a docker archive names its images with one, declare it with a tag or retag it")
+
+		images := []chartutil.DatarobotImageDeclaration{{Image: pinned.OriginalImage}}
+		assert.EqualError(t, checkDockerArchiveTags(images), "image "+pinned.OriginalImage+" has no tag but a docker archive names its images with one, declare it with a tag or retag it")
+		images[0].Tag = "stable"
+		assert.NoError(t, checkDockerArchiveTags(images))
+		assert.NoError(t, checkDockerArchiveTags([]chartutil.DatarobotImageDeclaration{{Image: "docker.io/datarobot/test-image:1.0.0@" + manifest.Digest}}))
+	})
+
+	t.Run("multi-platform", func(t *testing.T) {
+		index := ImageManifest{
+			OriginalImage: "docker.io/datarobot/test-image:multi",
+			Manifests:     []ImageManifest{manifest, manifest},
+		}
+		err := writeDockerArchives(archive, outputDir, []ImageManifest{index}, false, nil, rootCmd)
+		assert.EqualError(t, err, "image docker.io/datarobot/test-image:multi has 2 platforms but a docker archive holds a single one, select it with --platform")
+	})
+}
@@ -8,7 +8,6 @@ import (
 
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
-	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/render_helper"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 )
@@ -22,33 +21,60 @@ var generateCmd = &cobra.Command{
 
 This command is designed to extract all images and generate the image document annotations from a given change
 
+Images launched dynamically by the services are looked for with --indirect-registry in the env vars,
+args and command of the containers and in the data of the ConfigMaps. These indirect images are the
+references written with one of the given registries, or registry paths, and with a tag or a digest,
+they are added to the annotation and listed in a comment before it.
+
+Charts pulling different images depending on their values are rendered with every combination of
+values listed in the file given with --profiles, see validate. The annotation has the images of all
+the profiles, the images of each profile are listed in comments before it.
+
+The images of custom resources are read at the JSONPath of their apiVersion and kind. Spark
+applications, KServe inference services and serving runtimes, Knative services, Argo workflows and
+Ray clusters are known, others are listed in the file given with --image-paths:
+
+'''yaml
+images:
+  - apiVersion: operators.example.com/v1  # or operators.example.com for every version
+    kind: Worker
+    paths:
+      - .spec.image
+      - .spec.pools[*].image
+'''
+
 Example:
 '''sh
 $ helm datarobot generate chart.tgz
+$ helm datarobot generate chart.tgz --image-paths image-paths.yaml
+$ helm datarobot generate chart.tgz --indirect-registry registry.example.com/datarobot
+$ helm datarobot generate chart.tgz --profiles profiles.yaml
 
 '''`, "'", "`", -1),
 	Args: cobra.MinimumNArgs(1), // Requires at least one argument (file path)
 	RunE: func(cmd *cobra.Command, args []string) error {
 		chartPath := args[0]
-		manifest, err := render_helper.RenderChart(chartPath, g.ValueFiles, g.Values)
+		profiles, err := loadValuesProfiles(g.Profiles, g.ValueFiles, g.Values)
+		if err != nil {
+			return err
+		}
+		imagePaths, err := loadImagePaths(g.ImagePaths)
 		if err != nil {
-			return fmt.Errorf("Error loading chart %s: %v", chartPath, err)
+			return err
 		}
 
 		uniqueEntries := make(map[string]string)
-		for _, template := range strings.Split(manifest, "\n---\n") {
-
-			if g.Debug {
-				fmt.Printf("---\n%s\n", template)
-			}
-
-			manifestImages, err := ExtractImagesFromManifest(template)
+		var indirectImages []string
+		var renders []profileImages
+		re := regexp.MustCompile("[^a-zA-Z0-9]+")
+		for _, profile := range profiles {
+			images, err := renderProfileImages(chartPath, profile, imagePaths, g.IndirectRegistries, g.Debug)
 			if err != nil {
-				return fmt.Errorf("Error ExtractImagesFromManifest chart: %v", err)
+				return err
 			}
+			renders = append(renders, images)
 
-			re := regexp.MustCompile("[^a-zA-Z0-9]+")
-			for _, item := range manifestImages {
+			for _, item := range images.Images {
 				iUri, err := image_uri.NewDockerUri(item)
 				if err != nil {
 					return err
@@ -60,7 +86,26 @@ $ helm datarobot generate chart.tgz
 					uniqueEntries[uniqueKey] = item
 				}
 			}
+			for _, item := range images.IndirectImages {
+				if !SliceHas(indirectImages, item) {
+					indirectImages = append(indirectImages, item)
+				}
+			}
+		}
 
+		// Indirect images are added once every image run by a container is in
+		var indirectEntries []string
+		sort.Strings(indirectImages)
+		for _, item := range indirectImages {
+			iUri, err := image_uri.NewDockerUri(item)
+			if err != nil {
+				return err
+			}
+			uniqueKey := iUri.ImageName + "_" + re.ReplaceAllString(iUri.Tag, "")
+			if _, exists := uniqueEntries[uniqueKey]; !exists {
+				uniqueEntries[uniqueKey] = item
+				indirectEntries = append(indirectEntries, item)
+			}
 		}
 
 		var keys []string
@@ -93,7 +138,24 @@ $ helm datarobot generate chart.tgz
 			return fmt.Errorf("Error converting to YAML: %v\n", err)
 		}
 
-		// Print the YAML output
+		// Print the YAML output, the images of each profile and the indirect
+		// images are listed in comments as the annotation has all of them
+		if g.Profiles != "" {
+			for _, images := range renders {
+				cmd.Printf("# Images of profile %s:\n", images.Profile)
+				items := append(append([]string{}, images.Images...), images.IndirectImages...)
+				sort.Strings(items)
+				for _, item := range items {
+					cmd.Printf("#   %s\n", item)
+				}
+			}
+		}
+		if len(indirectEntries) > 0 {
+			cmd.Println("# Indirect images found in env vars, args and ConfigMaps:")
+			for _, item := range indirectEntries {
+				cmd.Printf("#   %s\n", item)
+			}
+		}
 		cmd.Println(string(yamlData))
 
 		return nil
@@ -101,9 +163,12 @@ $ helm datarobot generate chart.tgz
 }
 
 type generateInput struct {
-	Values     []string
-	ValueFiles []string
-	Debug      bool
+	Values             []string
+	ValueFiles         []string
+	Profiles           string
+	ImagePaths         string
+	IndirectRegistries []string
+	Debug              bool
 }
 
 var g generateInput
@@ -113,5 +178,8 @@ func init() {
 	generateCmd.Flags().StringVarP(&annotation, "annotation", "a", "datarobot.com/images", "annotation to lookup")
 	generateCmd.Flags().BoolVarP(&g.Debug, "debug", "d", false, "debug")
 	generateCmd.Flags().StringSliceVarP(&g.ValueFiles, "values", "f", []string{}, "specify values in a YAML file or a URL (can specify multiple)")
+	generateCmd.Flags().StringVar(&g.ImagePaths, "image-paths", "", "file mapping the apiVersion and kind of custom resources to the JSONPath of their images")
+	generateCmd.Flags().StringSliceVar(&g.IndirectRegistries, "indirect-registry", []string{}, "registry, or registry path, of the indirect images to look for in env vars, args and ConfigMaps (can specify multiple)")
+	generateCmd.Flags().StringVar(&g.Profiles, "profiles", "", "file listing the named values files and --set values combinations the chart is rendered with")
 	generateCmd.Flags().StringArrayVar(&g.Values, "set", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
 }
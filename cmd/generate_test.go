@@ -32,5 +32,47 @@ func TestCommandGenerate(t *testing.T) {
       image: docker.io/datarobotdev/test-image3:3.0.0`
 		assert.Equal(t, expectedOutput, output)
 	})
+	t.Run("test-chart7/indirect", func(t *testing.T) {
+		t.Cleanup(func() { g.IndirectRegistries = nil })
+		output, err := executeCommand(rootCmd, "generate ../tests/charts/test-chart7 --indirect-registry registry.example.com")
+		assert.NoError(t, err)
+		expectedOutput := `# Indirect images found in env vars, args and ConfigMaps:
+#   registry.example.com/datarobot/job:1.0.0
+#   registry.example.com/datarobot/launcher:1.0.0
+#   registry.example.com/datarobot/worker:1.0.0
+annotations:
+  datarobot.com/images: |
+    - name: app_100
+      image: registry.example.com/datarobot/app:1.0.0
+    - name: job_100
+      image: registry.example.com/datarobot/job:1.0.0
+    - name: launcher_100
+      image: registry.example.com/datarobot/launcher:1.0.0
+    - name: worker_100
+      image: registry.example.com/datarobot/worker:1.0.0`
+		assert.Equal(t, expectedOutput, output)
+	})
+	t.Run("test-chart7/profiles", func(t *testing.T) {
+		t.Cleanup(func() { g.Profiles = "" })
+		output, err := executeCommand(rootCmd, "generate ../tests/charts/test-chart7 --profiles ../tests/charts/test-chart7/ci/profiles.yaml")
+		assert.NoError(t, err)
+		expectedOutput := `# Images of profile default:
+#   registry.example.com/datarobot/app:1.0.0
+# Images of profile gpu:
+#   registry.example.com/datarobot/app:1.0.0
+#   registry.example.com/datarobot/gpu:1.0.0
+# Images of profile legacy:
+#   registry.example.com/datarobot/app:1.0.0
+#   registry.example.com/datarobot/legacy:0.9.0
+annotations:
+  datarobot.com/images: |
+    - name: app_100
+      image: registry.example.com/datarobot/app:1.0.0
+    - name: gpu_100
+      image: registry.example.com/datarobot/gpu:1.0.0
+    - name: legacy_090
+      image: registry.example.com/datarobot/legacy:0.9.0`
+		assert.Equal(t, expectedOutput, output)
+	})
 
 }
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+// imagePathsConfig is the file given with --image-paths, listing where the
+// images of custom resources are:
+//
+//	images:
+//	  - apiVersion: sparkoperator.k8s.io/v1beta2
+//	    kind: SparkApplication
+//	    paths:
+//	      - .spec.driver.image
+//	      - .spec.executor.image
+type imagePathsConfig struct {
+	Images []resourceImagePaths `json:"images"`
+}
+
+// resourceImagePaths are the JSONPath expressions of the images of a kind. An
+// apiVersion without version, such as sparkoperator.k8s.io, matches every
+// version of the group.
+type resourceImagePaths struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Paths      []string `json:"paths"`
+
+	parsed []*jsonpath.JSONPath
+}
+
+// builtinImagePaths are the image paths of common custom resources, the ones
+// of --image-paths are added to them.
+var builtinImagePaths = []resourceImagePaths{
+	{APIVersion: "sparkoperator.k8s.io", Kind: "SparkApplication", Paths: sparkImagePaths(".spec")},
+	{APIVersion: "sparkoperator.k8s.io", Kind: "ScheduledSparkApplication", Paths: sparkImagePaths(".spec.template")},
+	{APIVersion: "serving.kserve.io", Kind: "InferenceService", Paths: []string{
+		".spec.predictor.containers[*].image",
+		".spec.predictor.initContainers[*].image",
+		".spec.transformer.containers[*].image",
+		".spec.explainer.containers[*].image",
+	}},
+	{APIVersion: "serving.kserve.io", Kind: "ServingRuntime", Paths: []string{".spec.containers[*].image"}},
+	{APIVersion: "serving.kserve.io", Kind: "ClusterServingRuntime", Paths: []string{".spec.containers[*].image"}},
+	{APIVersion: "serving.knative.dev", Kind: "Service", Paths: podTemplateImagePaths(".spec.template")},
+	{APIVersion: "argoproj.io", Kind: "Workflow", Paths: argoImagePaths(".spec")},
+	{APIVersion: "argoproj.io", Kind: "WorkflowTemplate", Paths: argoImagePaths(".spec")},
+	{APIVersion: "argoproj.io", Kind: "ClusterWorkflowTemplate", Paths: argoImagePaths(".spec")},
+	{APIVersion: "argoproj.io", Kind: "CronWorkflow", Paths: argoImagePaths(".spec.workflowSpec")},
+	{APIVersion: "ray.io", Kind: "RayCluster", Paths: rayImagePaths(".spec")},
+	{APIVersion: "ray.io", Kind: "RayJob", Paths: rayImagePaths(".spec.rayClusterSpec")},
+	{APIVersion: "ray.io", Kind: "RayService", Paths: rayImagePaths(".spec.rayClusterConfig")},
+}
+
+func podTemplateImagePaths(template string) []string {
+	return []string{
+		template + ".spec.initContainers[*].image",
+		template + ".spec.containers[*].image",
+	}
+}
+
+func sparkImagePaths(spec string) []string {
+	paths := []string{spec + ".image"}
+	for _, role := range []string{".driver", ".executor"} {
+		paths = append(paths,
+			spec+role+".image",
+			spec+role+".initContainers[*].image",
+			spec+role+".sidecars[*].image",
+		)
+	}
+	return paths
+}
+
+func argoImagePaths(spec string) []string {
+	return []string{
+		spec + ".templates[*].container.image",
+		spec + ".templates[*].script.image",
+		spec + ".templates[*].initContainers[*].image",
+		spec + ".templates[*].sidecars[*].image",
+	}
+}
+
+func rayImagePaths(spec string) []string {
+	return append(podTemplateImagePaths(spec+".headGroupSpec.template"), podTemplateImagePaths(spec+".workerGroupSpecs[*].template")...)
+}
+
+// loadImagePaths returns the built-in image paths with the ones of the given
+// file, which is optional.
+func loadImagePaths(file string) ([]resourceImagePaths, error) {
+	imagePaths := append([]resourceImagePaths{}, builtinImagePaths...)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading image paths %s: %v", file, err)
+		}
+		var config imagePathsConfig
+		err = yaml.UnmarshalStrict(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing image paths %s: %v", file, err)
+		}
+		imagePaths = append(imagePaths, config.Images...)
+	}
+
+	for i := range imagePaths {
+		r := &imagePaths[i]
+		if r.APIVersion == "" || r.Kind == "" {
+			return nil, fmt.Errorf("Error image paths %v: apiVersion and kind are required", r.Paths)
+		}
+		r.parsed = nil
+		for _, path := range r.Paths {
+			expression := path
+			if !strings.HasPrefix(expression, "{") {
+				expression = "{" + expression + "}"
+			}
+			parsed := jsonpath.New(r.Kind).AllowMissingKeys(true)
+			err := parsed.Parse(expression)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing image path %s of %s %s: %v", path, r.APIVersion, r.Kind, err)
+			}
+			r.parsed = append(r.parsed, parsed)
+		}
+	}
+	return imagePaths, nil
+}
+
+// matches reports whether the paths apply to a resource of the given
+// apiVersion and kind.
+func (r resourceImagePaths) matches(apiVersion, kind string) bool {
+	if r.Kind != kind {
+		return false
+	}
+	group, _, _ := strings.Cut(apiVersion, "/")
+	return r.APIVersion == apiVersion || r.APIVersion == group
+}
+
+// resourceImages returns the strings found at the image paths matching the
+// resource.
+func resourceImages(manifest []byte, apiVersion, kind string, imagePaths []resourceImagePaths) ([]string, error) {
+	var object interface{}
+	var images []string
+	for _, r := range imagePaths {
+		if !r.matches(apiVersion, kind) {
+			continue
+		}
+		if object == nil {
+			if err := yaml.Unmarshal(manifest, &object); err != nil {
+				return nil, err
+			}
+		}
+		for i, parsed := range r.parsed {
+			results, err := parsed.FindResults(object)
+			if err != nil {
+				return nil, fmt.Errorf("image path %s: %v", r.Paths[i], err)
+			}
+			for _, values := range results {
+				for _, value := range values {
+					if image, ok := value.Interface().(string); ok {
+						images = append(images, image)
+					}
+				}
+			}
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadImagePaths(t *testing.T) {
+	imagePaths, err := loadImagePaths("")
+	assert.NoError(t, err)
+	assert.Len(t, imagePaths, len(builtinImagePaths))
+
+	t.Run("builtin", func(t *testing.T) {
+		images, err := ExtractImagesFromManifest(`apiVersion: sparkoperator.k8s.io/v1beta2
+kind: SparkApplication
+spec:
+  image: docker.io/datarobotdev/spark:3.5.0
+  driver:
+    cores: 1
+  executor:
+    image: docker.io/datarobotdev/spark-executor:3.5.0
+    sidecars:
+      - name: logs
+        image: busybox:1.36.1`, imagePaths)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"busybox:1.36.1", "docker.io/datarobotdev/spark-executor:3.5.0", "docker.io/datarobotdev/spark:3.5.0"}, images)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "image-paths.yaml")
+		assert.NoError(t, os.WriteFile(file, []byte(`images:
+  - apiVersion: datarobot.com/v1
+    kind: Operator
+    paths:
+      - .spec.image
+      - "{.spec.workers[*].image}"
+`), 0644))
+		imagePaths, err := loadImagePaths(file)
+		assert.NoError(t, err)
+		manifest := `apiVersion: datarobot.com/v1
+kind: Operator
+spec:
+  image: docker.io/datarobotdev/operator:1.0.0
+  workers:
+    - image: docker.io/datarobotdev/worker:1.0.0
+    - replicas: 2`
+		images, err := ExtractImagesFromManifest(manifest, imagePaths)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"docker.io/datarobotdev/operator:1.0.0", "docker.io/datarobotdev/worker:1.0.0"}, images)
+
+		// Other versions of the group are not matched
+		images, err = ExtractImagesFromManifest(`apiVersion: datarobot.com/v2
+kind: Operator
+spec:
+  image: docker.io/datarobotdev/operator:2.0.0`, imagePaths)
+		assert.NoError(t, err)
+		assert.Empty(t, images)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "image-paths.yaml")
+		assert.NoError(t, os.WriteFile(file, []byte(`images:
+  - apiVersion: datarobot.com/v1
+    kind: Operator
+    paths:
+      - .spec.workers[*.image
+`), 0644))
+		_, err := loadImagePaths(file)
+		assert.ErrorContains(t, err, "Error parsing image path .spec.workers[*.image of datarobot.com/v1 Operator")
+
+		assert.NoError(t, os.WriteFile(file, []byte(`images:
+  - kind: Operator
+    path: .spec.image
+`), 0644))
+		_, err = loadImagePaths(file)
+		assert.ErrorContains(t, err, "Error parsing image paths "+file)
+	})
+}
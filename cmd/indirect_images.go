@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"sigs.k8s.io/yaml"
+)
+
+// ExtractIndirectImagesFromManifest returns the images a rendered template
+// passes to the workloads it runs rather than running them: the ones found in
+// the env vars, args and command of its containers, or in its data when it is
+// a ConfigMap. Only references written with one of the given registries, or
+// registry paths, and with a tag or a digest are returned, none when the list
+// is empty.
+func ExtractIndirectImagesFromManifest(manifest string, registries []string) ([]string, error) {
+	if len(registries) == 0 {
+		return nil, nil
+	}
+	var meta struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Data       map[string]string `json:"data"`
+	}
+	if err := yaml.Unmarshal([]byte(manifest), &meta); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling YAML: %v\n", err)
+	}
+
+	var values []string
+	if meta.Kind == "ConfigMap" {
+		for _, value := range meta.Data {
+			values = append(values, value)
+		}
+	} else {
+		spec, err := workloadPodSpec(meta.APIVersion, meta.Kind)([]byte(manifest))
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshalling %s: %v\n", meta.Kind, err)
+		}
+		if spec != nil {
+			for _, container := range podSpecContainers(spec) {
+				for _, env := range container.Env {
+					values = append(values, env.Value)
+				}
+				values = append(values, container.Command...)
+				values = append(values, container.Args...)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var images []string
+	for _, value := range values {
+		for _, image := range indirectImages(value, registries) {
+			if !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// indirectImages returns the words of a value, such as --image=<image> or the
+// lines of a config file, that are image references of the registries.
+func indirectImages(value string, registries []string) []string {
+	words := strings.FieldsFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(",;='\"`()[]{}", r)
+	})
+	var images []string
+	for _, word := range words {
+		if !hasRegistryPrefix(word, registries) {
+			continue
+		}
+		iUri, err := image_uri.NewDockerUri(word)
+		if err != nil || (iUri.Tag == "" && iUri.Digest == "") {
+			continue
+		}
+		images = append(images, word)
+	}
+	return images
+}
+
+func hasRegistryPrefix(word string, registries []string) bool {
+	for _, registry := range registries {
+		if strings.HasPrefix(word, strings.TrimSuffix(registry, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
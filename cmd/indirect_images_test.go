@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractIndirectImagesFromManifest(t *testing.T) {
+	deployment := `apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: registry.example.com/datarobot/init:1.0.0
+          command: ["sh", "-c", "pull registry.example.com/datarobot/cache:1.0.0; exit 0"]
+      containers:
+        - name: app
+          image: registry.example.com/datarobot/app:1.0.0
+          args:
+            - --worker-image=registry.example.com/datarobot/worker:1.0.0
+            - --mirror=docker.io/datarobotdev/mirror:1.0.0
+          env:
+            - name: REPOSITORY
+              value: registry.example.com/datarobot/app
+            - name: IMAGES
+              value: registry.example.com/datarobot/a:1.0.0,registry.example.com/datarobot/b@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c
+            - name: SECRET
+              valueFrom:
+                secretKeyRef:
+                  name: secret
+                  key: image`
+
+	images, err := ExtractIndirectImagesFromManifest(deployment, []string{"registry.example.com/datarobot/"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"registry.example.com/datarobot/a:1.0.0",
+		"registry.example.com/datarobot/b@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c",
+		"registry.example.com/datarobot/cache:1.0.0",
+		"registry.example.com/datarobot/worker:1.0.0",
+	}, images)
+
+	images, err = ExtractIndirectImagesFromManifest(deployment, []string{"docker.io"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/datarobotdev/mirror:1.0.0"}, images)
+
+	// Nothing is looked for without registries
+	images, err = ExtractIndirectImagesFromManifest(deployment, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+
+	images, err = ExtractIndirectImagesFromManifest(`apiVersion: v1
+kind: ConfigMap
+data:
+  config.json: '{"image": "registry.example.com/datarobot/job:2.0.0", "other": "registry.example.com:2.0.0"}'
+  WORKER: registry.example.com/datarobot/job:2.0.0`, []string{"registry.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"registry.example.com/datarobot/job:2.0.0"}, images)
+}
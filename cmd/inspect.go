@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:          "inspect",
+	Short:        "list the images of a bundle created by save",
+	SilenceUsage: true,
+	Long: strings.Replace(`
+
+This command is designed to list the images of a bundle without extracting it.
+
+For every image, and every platform of multi-architecture images, it prints the
+reference the image was pulled from, its retag, the number of layers, the compressed
+and uncompressed size of its layers and its creation date.
+
+Example:
+'''sh
+$ helm datarobot inspect images.tar.zst
+IMAGE                                  RETAG                                   PLATFORM     LAYERS  COMPRESSED  UNCOMPRESSED  CREATED
+docker.io/datarobot/test-image1:1.0.0  docker.io/datarobot/test-image1:stable  linux/amd64  3       3.6 MB      8.8 MB        2024-06-12T10:04:31Z
+
+$ helm datarobot inspect images.tar.zst -o json
+'''`, "'", "`", -1),
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if inspectCfg.Output != "table" && inspectCfg.Output != "json" && inspectCfg.Output != "yaml" {
+			return fmt.Errorf("Invalid output. Available options: table, json, yaml")
+		}
+
+		images, err := inspectBundle(args[0])
+		if err != nil {
+			return fmt.Errorf("Error inspecting tarball: %v", err)
+		}
+
+		stdout := cmd.OutOrStdout()
+		switch inspectCfg.Output {
+		case "json":
+			data, err := json.MarshalIndent(images, "", "  ")
+			if err != nil {
+				return fmt.Errorf("Error writing json: %v", err)
+			}
+			stdout.Write(append(data, '\n'))
+		case "yaml":
+			data, err := yaml.Marshal(images)
+			if err != nil {
+				return fmt.Errorf("Error writing yaml: %v", err)
+			}
+			stdout.Write(data)
+		default:
+			writeInspectTable(stdout, images)
+		}
+		return nil
+	},
+}
+
+// inspectImage describes an image of a bundle.
+type inspectImage struct {
+	Image     string            `json:"image" yaml:"image"`
+	Retag     string            `json:"retag,omitempty" yaml:"retag,omitempty"`
+	Digest    string            `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Platforms []inspectPlatform `json:"platforms" yaml:"platforms"`
+}
+
+// inspectPlatform describes a single platform image, sizes are in bytes.
+type inspectPlatform struct {
+	Platform         string `json:"platform,omitempty" yaml:"platform,omitempty"`
+	Digest           string `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Layers           int    `json:"layers" yaml:"layers"`
+	CompressedSize   int64  `json:"compressed_size" yaml:"compressed_size"`
+	UncompressedSize int64  `json:"uncompressed_size" yaml:"uncompressed_size"`
+	Created          string `json:"created,omitempty" yaml:"created,omitempty"`
+}
+
+// archiveEntrySize is the size of a layer of the archive, as stored and once
+// decompressed.
+type archiveEntrySize struct {
+	compressed   int64
+	uncompressed int64
+}
+
+// inspectBundle describes the images of a bundle archive. The layers are
+// decompressed on the fly to measure them, nothing is extracted.
+func inspectBundle(tarballPath string) ([]inspectImage, error) {
+	source := &archiveSource{files: make(map[string][]byte)}
+	sizes := make(map[string]archiveEntrySize)
+	err := walkArchive(tarballPath, func(name string, size int64, r io.Reader) error {
+		if isArchiveMetadata(name, size) {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %v", name, err)
+			}
+			source.files[name] = data
+			r = bytes.NewReader(data)
+		}
+		uncompressed, err := uncompressedSize(r)
+		if err != nil {
+			return fmt.Errorf("error decompressing %s: %v", name, err)
+		}
+		sizes[name] = archiveEntrySize{compressed: size, uncompressed: uncompressed}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifests, format, err := readBundleManifests(source)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := readBundleDelta(source)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []inspectImage{}
+	for _, manifest := range manifests {
+		image := inspectImage{Image: manifest.OriginalImage, Digest: manifest.Digest}
+		if manifest.SourceImage != "" {
+			image.Image = manifest.SourceImage
+			image.Retag = manifest.OriginalImage
+		}
+		platforms := manifest.Manifests
+		if len(platforms) == 0 {
+			platforms = []ImageManifest{manifest}
+		}
+		for _, platform := range platforms {
+			p, err := inspectPlatformImage(platform, source, format, sizes, delta)
+			if err != nil {
+				return nil, fmt.Errorf("error inspecting %s: %v", manifest.OriginalImage, err)
+			}
+			image.Platforms = append(image.Platforms, p)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// inspectPlatformImage describes a single image. Delta bundles only count the
+// layers they hold, and the images whose config is left out keep their platform
+// from the index.
+func inspectPlatformImage(manifest ImageManifest, source bundleSource, format bundleFormat, sizes map[string]archiveEntrySize, delta *bundleDelta) (inspectPlatform, error) {
+	p := inspectPlatform{
+		Platform: manifest.Platform,
+		Digest:   manifest.Digest,
+		Layers:   len(manifest.Layers),
+	}
+	for _, layer := range manifest.Layers {
+		size := sizes[filepath.ToSlash(format.layerFile(v1.Hash{Algorithm: "sha256", Hex: layer}))]
+		p.CompressedSize += size.compressed
+		p.UncompressedSize += size.uncompressed
+	}
+
+	if digest, ok := entryDigest(filepath.ToSlash(manifest.ConfigFile)); ok && delta.omits(digest) {
+		return p, nil
+	}
+	rawConfig, err := source.ReadFile(manifest.ConfigFile)
+	if err != nil {
+		return inspectPlatform{}, fmt.Errorf("error reading config file: %v", err)
+	}
+	config, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		return inspectPlatform{}, fmt.Errorf("error decoding config file: %v", err)
+	}
+	if p.Platform == "" && config.Platform() != nil {
+		p.Platform = config.Platform().String()
+	}
+	if !config.Created.IsZero() {
+		p.Created = config.Created.UTC().Format(time.RFC3339)
+	}
+	return p, nil
+}
+
+// uncompressedSize returns the size of a gzip or zstd stream once decompressed,
+// or its size when it is not compressed.
+func uncompressedSize(r io.Reader) (int64, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(4)
+
+	var decompressed io.Reader = buffered
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return 0, err
+		}
+		defer gzipReader.Close()
+		decompressed = gzipReader
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zstdReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return 0, err
+		}
+		defer zstdReader.Close()
+		decompressed = zstdReader
+	}
+	return io.Copy(io.Discard, decompressed)
+}
+
+func writeInspectTable(w io.Writer, images []inspectImage) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "IMAGE\tRETAG\tPLATFORM\tLAYERS\tCOMPRESSED\tUNCOMPRESSED\tCREATED")
+	for _, image := range images {
+		for _, p := range image.Platforms {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", image.Image, image.Retag, p.Platform, p.Layers,
+				formatSize(p.CompressedSize), formatSize(p.UncompressedSize), p.Created)
+		}
+	}
+	table.Flush()
+}
+
+// formatSize returns a size in bytes with decimal units, as printed by docker.
+func formatSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+type inspectConfig struct {
+	Output string
+}
+
+var inspectCfg inspectConfig
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+	inspectCmd.Flags().StringVarP(&inspectCfg.Output, "output", "o", "table", "output format (Available options: table, json, yaml)")
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandInspect(t *testing.T) {
+	base, err := random.Image(1024, 2)
+	assert.NoError(t, err)
+	config, err := base.ConfigFile()
+	assert.NoError(t, err)
+	config = config.DeepCopy()
+	config.Architecture = "arm64"
+	config.OS = "linux"
+	config.Created = v1.Time{Time: time.Date(2024, 6, 12, 10, 4, 31, 0, time.UTC)}
+	image, err := mutate.ConfigFile(base, config)
+	assert.NoError(t, err)
+
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+	manifest, err := exportImage(image, dirWriter(outputDir), formatNative, newBlobSet())
+	assert.NoError(t, err)
+	manifest.SourceImage = "docker.io/alpine/curl:8.9.1"
+	manifest.OriginalImage = "docker.io/alpine/curl:stable"
+	assert.NoError(t, saveManifest(dirWriter(outputDir), []ImageManifest{manifest}))
+	tarballPath := filepath.Join(t.TempDir(), "images.tar.zst")
+	assert.NoError(t, createTarball(tarballPath, outputDir, formatNative, zstd.SpeedFastest, 0))
+
+	var compressed, uncompressed int64
+	layers, err := image.Layers()
+	assert.NoError(t, err)
+	for _, layer := range layers {
+		size, err := layer.Size()
+		assert.NoError(t, err)
+		compressed += size
+		reader, err := layer.Uncompressed()
+		assert.NoError(t, err)
+		size, err = io.Copy(io.Discard, reader)
+		assert.NoError(t, err)
+		uncompressed += size
+	}
+
+	t.Run("json", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "inspect "+tarballPath+" -o json")
+		assert.NoError(t, err)
+		var images []inspectImage
+		assert.NoError(t, json.Unmarshal([]byte(output), &images))
+		assert.Equal(t, []inspectImage{{
+			Image:  "docker.io/alpine/curl:8.9.1",
+			Retag:  "docker.io/alpine/curl:stable",
+			Digest: manifest.Digest,
+			Platforms: []inspectPlatform{{
+				Platform:         "linux/arm64",
+				Digest:           manifest.Digest,
+				Layers:           2,
+				CompressedSize:   compressed,
+				UncompressedSize: uncompressed,
+				Created:          "2024-06-12T10:04:31Z",
+			}},
+		}}, images)
+	})
+
+	t.Run("table", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "inspect "+tarballPath)
+		assert.NoError(t, err)
+		assert.Contains(t, output, "IMAGE                        RETAG                         PLATFORM     LAYERS  COMPRESSED")
+		assert.Contains(t, output, "docker.io/alpine/curl:8.9.1  docker.io/alpine/curl:stable  linux/arm64  2       "+formatSize(compressed))
+	})
+
+	t.Run("wrong-output", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "inspect "+tarballPath+" -o xml")
+		assert.Error(t, err)
+		assert.Equal(t, "Error: Invalid output. Available options: table, json, yaml", output)
+	})
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", formatSize(512))
+	assert.Equal(t, "1.5 kB", formatSize(1500))
+	assert.Equal(t, "3.6 MB", formatSize(3_600_000))
+	assert.Equal(t, "1.2 GB", formatSize(1_234_567_890))
+}
@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// checksumFile returns the path of the sidecar holding the sha256 of an archive.
+func checksumFile(archivePath string) string {
+	return archivePath + ".sha256"
+}
+
+// writeChecksumFile writes the sha256 of an archive next to it, with the
+// format of sha256sum so that it can also be checked with `sha256sum -c`.
+// The volumes of a split archive are listed in order, one per line.
+func writeChecksumFile(archivePath string) error {
+	volumes := []string{archivePath}
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		volumes, err = findVolumes(archivePath)
+		if err != nil {
+			return err
+		}
+	}
+	var lines strings.Builder
+	for _, volume := range volumes {
+		digest, err := fileDigest(volume)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&lines, "%s  %s\n", digest.Hex, filepath.Base(volume))
+	}
+	err := os.WriteFile(checksumFile(archivePath), []byte(lines.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing checksum file: %v", err)
+	}
+	return nil
+}
+
+// writeArchiveChecksum writes the checksum file of an archive, signed when a
+// signing key is given.
+func writeArchiveChecksum(archivePath string, key crypto.Signer) error {
+	err := writeChecksumFile(archivePath)
+	if err != nil || key == nil {
+		return err
+	}
+	return signFile(key, checksumFile(archivePath))
+}
+
+// verifyChecksumFile checks an archive against its sidecar checksum, archives
+// without one are not checked. Every volume of a split archive is checked.
+func verifyChecksumFile(archivePath string) error {
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		return verifyVolumes(archivePath)
+	}
+	data, err := os.ReadFile(checksumFile(archivePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading checksum file: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("checksum file %s is empty", checksumFile(archivePath))
+	}
+	expected, err := v1.NewHash("sha256:" + fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid checksum file %s: %v", checksumFile(archivePath), err)
+	}
+
+	digest, err := fileDigest(archivePath)
+	if err != nil {
+		return err
+	}
+	if digest != expected {
+		return fmt.Errorf("%s does not match its checksum: expected %s, got %s", archivePath, expected, digest)
+	}
+	return nil
+}
+
+// verifyVolumes checks the volumes of a split archive against the checksum
+// file listing them, the missing and corrupted volumes are named.
+func verifyVolumes(archivePath string) error {
+	volumes, err := archiveVolumes(archivePath)
+	if err != nil {
+		return err
+	}
+	var corrupted []string
+	for _, volume := range volumes {
+		if volume.digest == (v1.Hash{}) {
+			continue
+		}
+		digest, err := fileDigest(volume.path)
+		if err != nil {
+			return err
+		}
+		if digest != volume.digest {
+			corrupted = append(corrupted, fmt.Sprintf("%s (expected %s, got %s)", filepath.Base(volume.path), volume.digest, digest))
+		}
+	}
+	if len(corrupted) > 0 {
+		return fmt.Errorf("%d of the %d volumes of %s do not match their checksum: %s", len(corrupted), len(volumes), archivePath, strings.Join(corrupted, ", "))
+	}
+	return nil
+}
+
+func fileDigest(filePath string) (v1.Hash, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("error opening %s: %v", filePath, err)
+	}
+	defer file.Close()
+	digest, _, err := v1.SHA256(file)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("error reading %s: %v", filePath, err)
+	}
+	return digest, nil
+}
+
+// entryDigest returns the digest a bundle entry is named after. Blobs are
+// stored under their digest by both formats, entries of older bundles which
+// are not content addressed are not verified.
+func entryDigest(name string) (v1.Hash, bool) {
+	dir, file := path.Split(name)
+	var digest string
+	switch {
+	case dir == "layers/":
+		digest = "sha256:" + strings.TrimSuffix(file, ".tar.gz")
+	case dir == "configs/" || dir == "manifests/":
+		digest = "sha256:" + strings.TrimSuffix(file, ".json")
+	case strings.HasPrefix(dir, "blobs/"):
+		digest = strings.Trim(strings.TrimPrefix(dir, "blobs/"), "/") + ":" + file
+	default:
+		return v1.Hash{}, false
+	}
+	h, err := v1.NewHash(digest)
+	if err != nil || h.Algorithm != "sha256" {
+		return v1.Hash{}, false
+	}
+	return h, true
+}
+
+// bundleCheck verifies the entries of a bundle against the digest they are
+// named after, and that every entry referenced by its manifest is present.
+type bundleCheck struct {
+	entries   map[string]bool
+	corrupted []string
+	// delta lists the entries a delta bundle leaves out on purpose
+	delta *bundleDelta
+	// charts are verified against the digests of chartDigests
+	charts       []bundleChart
+	chartDigests map[string]v1.Hash
+}
+
+func newBundleCheck() *bundleCheck {
+	return &bundleCheck{entries: make(map[string]bool)}
+}
+
+// add records an entry of the bundle, content addressed entries are hashed.
+func (b *bundleCheck) add(name string, r io.Reader) error {
+	name = filepath.ToSlash(name)
+	b.entries[name] = true
+	if isChartEntry(name) {
+		digest, _, err := v1.SHA256(r)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		if b.chartDigests == nil {
+			b.chartDigests = make(map[string]v1.Hash)
+		}
+		b.chartDigests[name] = digest
+		return nil
+	}
+	expected, ok := entryDigest(name)
+	if !ok {
+		return nil
+	}
+	digest, _, err := v1.SHA256(r)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", name, err)
+	}
+	if digest != expected {
+		b.corrupted = append(b.corrupted, fmt.Sprintf("%s: expected %s, got %s", name, expected, digest))
+	}
+	return nil
+}
+
+// missing returns the entries referenced by the manifests which are not in
+// the bundle.
+func (b *bundleCheck) missing(manifests []ImageManifest, format bundleFormat) []string {
+	var missing []string
+	seen := make(map[string]bool)
+	var walk func(manifest ImageManifest)
+	walk = func(manifest ImageManifest) {
+		files := []string{manifest.ManifestFile, manifest.ConfigFile}
+		for _, layer := range manifest.Layers {
+			files = append(files, format.layerFile(v1.Hash{Algorithm: "sha256", Hex: layer}))
+		}
+		for _, file := range files {
+			file = filepath.ToSlash(file)
+			if file == "" || seen[file] {
+				continue
+			}
+			seen[file] = true
+			if digest, ok := entryDigest(file); ok && b.delta.omits(digest) {
+				continue
+			}
+			if !b.entries[file] {
+				missing = append(missing, file)
+			}
+		}
+		for _, child := range manifest.Manifests {
+			walk(child)
+		}
+		for _, referrer := range manifest.Referrers {
+			walk(referrer)
+		}
+	}
+	for _, manifest := range manifests {
+		walk(manifest)
+	}
+	for _, chart := range b.charts {
+		if !b.entries[chart.File] {
+			missing = append(missing, chart.File)
+		}
+	}
+	return missing
+}
+
+// report prints the corrupted and missing entries of the bundle, it fails when
+// there is any.
+func (b *bundleCheck) report(manifests []ImageManifest, format bundleFormat, out printer) error {
+	missing := b.missing(manifests, format)
+	for _, chart := range b.charts {
+		digest, ok := b.chartDigests[chart.File]
+		if ok && digest.String() != chart.Digest {
+			b.corrupted = append(b.corrupted, fmt.Sprintf("%s: expected %s, got %s", chart.File, chart.Digest, digest))
+		}
+	}
+	for _, entry := range b.corrupted {
+		out.Printf("Corrupted entry %s\n", entry)
+	}
+	for _, entry := range missing {
+		out.Printf("Missing entry %s\n", entry)
+	}
+	if len(b.corrupted) > 0 || len(missing) > 0 {
+		return fmt.Errorf("bundle is corrupted: %d corrupted and %d missing entries", len(b.corrupted), len(missing))
+	}
+	return nil
+}
+
+// firstError returns the first non-nil error.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumFile(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "images.tar.zst")
+	assert.NoError(t, os.WriteFile(archive, []byte("bundle"), 0644))
+
+	// Archives saved without a checksum are not checked
+	assert.NoError(t, verifyChecksumFile(archive))
+
+	assert.NoError(t, writeChecksumFile(archive))
+	sidecar, err := os.ReadFile(checksumFile(archive))
+	assert.NoError(t, err)
+	assert.Equal(t, "1e6ed65d77d6364eeaed5a745ba5c4985ae2b700dd85d7cf7f027bdf294a33fc  images.tar.zst\n", string(sidecar))
+	assert.NoError(t, verifyChecksumFile(archive))
+
+	assert.NoError(t, os.WriteFile(archive, []byte("bundlf"), 0644))
+	assert.ErrorContains(t, verifyChecksumFile(archive), "does not match its checksum")
+}
+
+func TestBundleCheck(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+	image, err := random.Image(1024, 2)
+	assert.NoError(t, err)
+	manifest, err := exportImage(image, dirWriter(outputDir), formatNative, newBlobSet())
+	assert.NoError(t, err)
+	assert.NoError(t, saveManifest(dirWriter(outputDir), []ImageManifest{manifest}))
+
+	// Corrupt the first layer and lose the config on the way
+	layerFile := formatNative.layerFile(v1.Hash{Algorithm: "sha256", Hex: manifest.Layers[0]})
+	assert.NoError(t, os.WriteFile(filepath.Join(outputDir, layerFile), []byte("corrupted"), 0644))
+	assert.NoError(t, os.Remove(filepath.Join(outputDir, manifest.ConfigFile)))
+	tarballPath := filepath.Join(t.TempDir(), "bundle.tar.zst")
+	assert.NoError(t, createTarball(tarballPath, outputDir, formatNative, zstd.SpeedFastest, 0))
+
+	for name, read := range map[string]func(check *bundleCheck) error{
+		"extract": func(check *bundleCheck) error {
+			return extractTarball(tarballPath, t.TempDir(), check)
+		},
+		"stream": func(check *bundleCheck) error {
+			_, err := readArchiveMetadata(tarballPath, check)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			check := newBundleCheck()
+			assert.NoError(t, read(check))
+
+			var buf strings.Builder
+			cmd := &cobra.Command{}
+			cmd.SetOut(&buf)
+			err := check.report([]ImageManifest{manifest}, formatNative, cmd)
+			assert.EqualError(t, err, "bundle is corrupted: 1 corrupted and 1 missing entries")
+			expectedOutput := `Corrupted entry layers/` + manifest.Layers[0] + `.tar.gz: expected sha256:` + manifest.Layers[0] + `, got sha256:3dbb3963d11aa418de8b61f846c3dbd5af43b40d252842adb823f90936fe6920
+Missing entry ` + manifest.ConfigFile + `
+`
+			assert.Equal(t, expectedOutput, buf.String())
+		})
+	}
+}
@@ -1,26 +1,24 @@
 package cmd
 
 import (
-	"archive/tar"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	"github.com/klauspost/compress/zstd"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/sethvargo/go-envconfig"
 	"github.com/spf13/cobra"
 )
@@ -33,6 +31,56 @@ var loadCmd = &cobra.Command{
 
 This command is designed to load all images from a tgz file to a specific registry
 
+Bundles created with '--format oci-layout' are detected and loaded the same way.
+
+With '--stream' the images are pushed while reading the tarball, nothing is extracted to
+'--output-dir': manifests and configs are read first, then the layers are uploaded as they
+are found in the archive. Layers shared by several target repositories are kept in a
+temporary file until all of them received it.
+
+Before anything is pushed, every layer, config and manifest is checked against its
+digest, and the tarball against the '.sha256' file saved next to it when present. The
+corrupted or missing entries are reported and nothing is pushed.
+
+With '--public-key', bundles signed by 'save --sign-key' are checked before anything is
+read: the signature of the '.sha256' file and of the manifest inside the tarball must
+match the key. Unsigned bundles are reported, and refused with '--require-signature'.
+
+Signatures, SBOMs and attestations saved with '--include-referrers' are pushed next to
+their image, with the tags cosign attached them with.
+
+Delta bundles saved with 'save --base' only hold what changed since the base release. The
+layers and configs they leave out are looked up in the target registry first, and nothing
+is pushed when any of them is missing: the base bundle must be loaded before the delta.
+
+Images pinned by digest keep it: an image whose digest differs from the pinned one, when
+platforms were filtered out with 'save --platform', fails to push unless
+'--allow-digest-change' is given, it is then pushed by its new digest.
+
+Images failing to push do not stop the others. The images and layers pushed are recorded
+in 'load-journal.jsonl' in '--output-dir', which is kept with the extracted bundle when
+any image failed. Running the same command again resumes the load: the bundle is not
+extracted again when its files still match their digest, and the images and layers
+already pushed are skipped. The journal is only resumed for the same tarball, compared
+by size and modification time.
+
+Charts saved with 'save --include-charts' are extracted to '--charts-dir', and pushed with
+'--push-charts' to '<registry>/<charts-repo>' as the OCI artifacts 'helm push' creates, the
+'+' of a version with build metadata is replaced with '_' in the tag as 'helm push' does:
+
+'''sh
+$ helm datarobot load images.tar.zst -r registry.example.com --push-charts --charts-dir charts
+$ helm install test-chart1 oci://registry.example.com/charts/test-chart1 --version 0.1.0
+'''
+
+With '--report', a JSON report lists the images pushed, skipped (already in the
+registry, pushed by the previous load or excluded with '--skip-image') and failed:
+
+'''sh
+$ helm datarobot load images.tar.zst -r registry.example.com --report load-report.json
+$ jq -r '.failed[] | .image + ": " + .error' load-report.json
+'''
+
 Example:
 '''sh
 $ helm datarobot load images.tgz -r registry.example.com -u reg_username -p reg_password
@@ -58,76 +106,348 @@ $ helm datarobot load images.tgz
 		}
 
 		tarballPath := args[0]
-		// Step 1: Extract Tarball
-		err := extractTarball(tarballPath, loadCfg.OutputDir)
+		signature, err := newBundleSignature(loadCfg.PublicKey, loadCfg.RequireSignature)
+		if err == nil {
+			err = signature.checkBundle(tarballPath, cmd)
+		}
 		if err != nil {
-			fmt.Printf("Error extracting tarball: %v\n", err)
-			return nil
+			return fmt.Errorf("Error verifying signature: %v", err)
 		}
+		if loadCfg.Stream {
+			return streamLoad(tarballPath, loadCfg, signature, cmd)
+		}
+		return extractLoad(tarballPath, loadCfg, signature, cmd)
+	},
+}
 
-		// Step 2: Read Manifest
-		manifestPath := filepath.Join(loadCfg.OutputDir, "manifest.json")
-		manifests, err := readManifest(manifestPath)
+// extractLoad pushes the images of a bundle archive extracted to --output-dir.
+func extractLoad(tarballPath string, c loadConfig, signature *bundleSignature, cmd *cobra.Command) error {
+	journal, err := openLoadJournal(c.OutputDir, tarballPath, c.DryRun)
+	if err != nil {
+		return fmt.Errorf("Error reading journal: %v", err)
+	}
+	c.journal = journal
+
+	// Step 1: Verify and Extract Tarball, unless a failed load of the same
+	// bundle left it extracted
+	var checksumErr error
+	check, resumed := checkExtractedBundle(c.OutputDir, c.journal)
+	if resumed {
+		images, blobs := c.journal.counts()
+		cmd.Printf("Resuming load from %s: %d images and %d layers already pushed\n", c.OutputDir, images, blobs)
+	} else {
+		checksumErr = verifyChecksumFile(tarballPath)
+		check = newBundleCheck()
+		err = extractTarball(tarballPath, c.OutputDir, check)
 		if err != nil {
-			fmt.Printf("Error reading manifest: %v\n", err)
-			os.RemoveAll(loadCfg.OutputDir)
-			return nil
-		}
-
-		// Step 3: Rebuild and Push Images
-		for _, manifest := range manifests {
-			if len(loadCfg.ImageSkip) > 0 {
-				_skipImage := false
-				for _, imageSkip := range loadCfg.ImageSkip {
-					if manifest.ImageName == imageSkip {
-						cmd.Printf("Skipping image: %s\n", manifest.ImageName)
-						_skipImage = true
-						break
-					}
-				}
-				if _skipImage {
-					continue
-				}
-			}
-			imageUri, err := rebuildAndPushImage(manifest, loadCfg, cmd)
-			if err != nil {
-				return fmt.Errorf("Error processing image %s: %v\n", manifest.OriginalImage, err)
-			} else {
-				if loadCfg.DryRun {
-					cmd.Printf("[Dry-Run] Pushing image: %s\n", imageUri)
-				} else {
-					cmd.Printf("Successfully pushed image %s\n", imageUri)
-				}
+			os.RemoveAll(c.OutputDir)
+			return fmt.Errorf("Error extracting tarball: %v", firstError(checksumErr, err))
+		}
+	}
+	err = c.journal.create()
+	if err != nil {
+		return fmt.Errorf("Error writing journal: %v", err)
+	}
 
-			}
+	// Step 2: Read Manifest
+	source := dirSource(c.OutputDir)
+	manifests, format, err := readBundleManifests(source)
+	if err == nil {
+		err = signature.checkManifest(source, format)
+	}
+	if err == nil {
+		check.delta, err = readBundleDelta(source)
+	}
+	if err == nil {
+		check.charts, err = readBundleCharts(source)
+	}
+	if err == nil {
+		err = check.report(manifests, format, cmd)
+	}
+	err = firstError(err, checksumErr)
+	if err != nil {
+		os.RemoveAll(c.OutputDir)
+		return fmt.Errorf("Error verifying tarball: %v", err)
+	}
+	c.format = format
+
+	// Step 3: Rebuild and Push Images
+	pending := skipImages(manifests, c, cmd)
+	out := newSyncPrinter(cmd)
+	if check.delta != nil && !c.DryRun {
+		options, err := registryOptions(c)
+		if err == nil {
+			err = checkBaseBlobs(pending, check.delta, c, options, out)
+		}
+		if err != nil {
+			os.RemoveAll(c.OutputDir)
+			return fmt.Errorf("Error verifying base: %v", err)
 		}
+	}
+	uploads := newBlobUploads()
+	uploads.journal = c.journal
+	results := make([]pushResult, len(pending))
+	forEachConcurrently(len(pending), c.Concurrency, func(idx int) {
+		manifest := pending[idx]
+		imageUri, status, err := rebuildAndPushImage(manifest, c, source, uploads, out)
+		results[idx] = pushResult{image: manifest.OriginalImage, status: status, err: err}
+		printPushResult(out, c, manifest, imageUri, err)
+	})
+
+	var summaryErr error
+	if !c.DryRun {
+		summaryErr = printPushSummary(out, results)
+	}
+	summaryErr = firstError(summaryErr, loadBundleCharts(check.charts, source, c, out))
+	err = writeLoadReport(tarballPath, c, manifests, pending, results)
+	if err != nil {
+		return fmt.Errorf("Error writing report: %v", err)
+	}
 
-		err = os.RemoveAll(loadCfg.OutputDir)
+	// The extracted bundle and the journal are kept for the failed images
+	// to be pushed by running the load again
+	if summaryErr != nil {
+		out.Printf("Keeping %s, run the same command again to resume the load\n", c.OutputDir)
+		return summaryErr
+	}
+	err = os.RemoveAll(c.OutputDir)
+	if err != nil {
+		return fmt.Errorf("Error Tmp Folder: %v\n", err)
+	}
+	return nil
+}
+
+// streamLoad pushes the images of a bundle archive without extracting it: the
+// manifests and configs are read in a first pass, the layers are uploaded
+// while reading the archive a second time and the manifests are pushed last.
+func streamLoad(tarballPath string, c loadConfig, signature *bundleSignature, cmd *cobra.Command) error {
+	journal, err := openLoadJournal(c.OutputDir, tarballPath, c.DryRun)
+	if err != nil {
+		return fmt.Errorf("Error reading journal: %v", err)
+	}
+	c.journal = journal
+	if journal != nil && journal.resumed {
+		images, blobs := journal.counts()
+		cmd.Printf("Resuming load: %d images and %d layers already pushed\n", images, blobs)
+	}
+
+	checksumErr := verifyChecksumFile(tarballPath)
+	check := newBundleCheck()
+	source, err := readArchiveMetadata(tarballPath, check)
+	if err != nil {
+		return fmt.Errorf("Error reading tarball: %v", firstError(checksumErr, err))
+	}
+	manifests, format, err := readBundleManifests(source)
+	if err == nil {
+		err = signature.checkManifest(source, format)
+	}
+	if err == nil {
+		check.delta, err = readBundleDelta(source)
+	}
+	if err == nil {
+		check.charts, err = readBundleCharts(source)
+	}
+	if err == nil {
+		err = check.report(manifests, format, cmd)
+	}
+	err = firstError(err, checksumErr)
+	if err != nil {
+		return fmt.Errorf("Error verifying tarball: %v", err)
+	}
+	for _, manifest := range manifests {
+		if manifest.ManifestFile == "" {
+			return fmt.Errorf("Error streaming tarball: image %s was saved by an older version and must be loaded without --stream", manifest.OriginalImage)
+		}
+	}
+	c.format = format
+
+	pending := skipImages(manifests, c, cmd)
+	out := newSyncPrinter(cmd)
+	results := make([]pushResult, len(pending))
+	if c.DryRun {
+		for idx, manifest := range pending {
+			imageUri, _, err := rebuildAndPushImage(manifest, c, source, nil, out)
+			results[idx] = pushResult{image: manifest.OriginalImage, err: err}
+			printPushResult(out, c, manifest, imageUri, err)
+		}
+		err = loadBundleCharts(check.charts, source, c, out)
+		return firstError(err, writeLoadReport(tarballPath, c, manifests, pending, results))
+	}
+
+	options, err := registryOptions(c)
+	if err != nil {
+		return err
+	}
+	if check.delta != nil {
+		err = checkBaseBlobs(pending, check.delta, c, options, out)
 		if err != nil {
-			return fmt.Errorf("Error Tmp Folder: %v\n", err)
+			return fmt.Errorf("Error verifying base: %v", err)
 		}
-		return nil
-	},
+	}
+
+	err = c.journal.create()
+	if err != nil {
+		return fmt.Errorf("Error writing journal: %v", err)
+	}
+
+	// Step 1: Prepare the images missing from the registry
+	pushes := make([]*imagePush, len(pending))
+	layers := make(map[string]*archiveLayer)
+	for idx, manifest := range pending {
+		results[idx] = pushResult{image: manifest.OriginalImage}
+		iUri, err := targetUri(manifest, c)
+		if err == nil && c.journal.pushedImage(iUri, manifest.Digest) {
+			out.Printf("image %s was pushed by the previous load\n", iUri.String())
+			results[idx].status = statusResumed
+			printPushResult(out, c, manifest, iUri.String(), nil)
+			continue
+		}
+		if err == nil && !c.Overwrite && imageExists(iUri, options) {
+			out.Printf("image %s already exists in the registry\n", iUri.String())
+			results[idx].status = statusExists
+			printPushResult(out, c, manifest, iUri.String(), nil)
+			continue
+		}
+		if err == nil {
+			pushes[idx], err = prepareImagePush(manifest, iUri, c, source, out)
+		}
+		if err == nil {
+			err = addArchiveLayers(layers, pushes[idx], format)
+		}
+		if err != nil {
+			results[idx].err = err
+			printPushResult(out, c, manifest, "", err)
+		}
+	}
+
+	// Step 2: Upload the layers while reading the archive
+	uploads := newBlobUploads()
+	uploads.journal = c.journal
+	err = streamArchiveLayers(tarballPath, layers, uploads, out, options...)
+	if err != nil {
+		return fmt.Errorf("Error streaming tarball: %v", err)
+	}
+
+	// Step 3: Push the manifests
+	forEachConcurrently(len(pending), c.Concurrency, func(idx int) {
+		if pushes[idx] == nil {
+			return
+		}
+		err := pushes[idx].run(c, uploads, options, out)
+		results[idx].err = err
+		printPushResult(out, c, pending[idx], pushes[idx].iUri.String(), err)
+	})
+
+	summaryErr := firstError(printPushSummary(out, results), loadBundleCharts(check.charts, source, c, out))
+	err = writeLoadReport(tarballPath, c, manifests, pending, results)
+	if err != nil {
+		return fmt.Errorf("Error writing report: %v", err)
+	}
+	if summaryErr != nil {
+		out.Printf("Keeping %s, run the same command again to resume the load\n", filepath.Join(c.OutputDir, loadJournalFile))
+		return summaryErr
+	}
+	return c.journal.remove()
+}
+
+// addArchiveLayers records the repository each layer of an image is pushed to.
+func addArchiveLayers(layers map[string]*archiveLayer, push *imagePush, format bundleFormat) error {
+	for _, image := range push.images {
+		manifest, err := image.Manifest()
+		if err != nil {
+			return err
+		}
+		for _, desc := range manifest.Layers {
+			path := filepath.ToSlash(format.layerFile(desc.Digest))
+			layer, ok := layers[path]
+			if !ok {
+				layer = &archiveLayer{desc: desc}
+				layers[path] = layer
+			}
+			if !slices.ContainsFunc(layer.repos, func(repo name.Repository) bool {
+				return repo.String() == push.repo.String()
+			}) {
+				layer.repos = append(layer.repos, push.repo)
+			}
+		}
+	}
+	return nil
+}
+
+// readBundleManifests describes the images of a bundle, saved either with the
+// native format or as an OCI image layout.
+func readBundleManifests(source bundleSource) ([]ImageManifest, bundleFormat, error) {
+	if isOCILayout(source) {
+		manifests, err := readOCILayout(source)
+		return manifests, formatOCILayout, err
+	}
+	manifests, err := readManifest(source)
+	return manifests, formatNative, err
+}
+
+// skipImages returns the manifests not excluded with --skip-image.
+func skipImages(manifests []ImageManifest, c loadConfig, cmd *cobra.Command) []ImageManifest {
+	var pending []ImageManifest
+	for _, manifest := range manifests {
+		if len(c.ImageSkip) > 0 {
+			_skipImage := false
+			for _, imageSkip := range c.ImageSkip {
+				if manifest.ImageName == imageSkip {
+					cmd.Printf("Skipping image: %s\n", manifest.ImageName)
+					_skipImage = true
+					break
+				}
+			}
+			if _skipImage {
+				continue
+			}
+		}
+		pending = append(pending, manifest)
+	}
+	return pending
+}
+
+func printPushResult(out printer, c loadConfig, manifest ImageManifest, imageUri string, err error) {
+	if err != nil {
+		out.Printf("Error processing image %s: %v\n", manifest.OriginalImage, err)
+		return
+	}
+	if c.DryRun {
+		out.Printf("[Dry-Run] Pushing image: %s\n", imageUri)
+	} else {
+		out.Printf("Successfully pushed image %s\n", imageUri)
+	}
 }
 
 type loadConfig struct {
-	Username      string   `env:"REGISTRY_USERNAME"`
-	Password      string   `env:"REGISTRY_PASSWORD"`
-	Token         string   `env:"REGISTRY_TOKEN"`
-	RegistryHost  string   `env:"REGISTRY_HOST"`
-	ImagePrefix   string   `env:"IMAGE_PREFIX"`
-	ImageSuffix   string   `env:"IMAGE_SUFFIX"`
-	ImageRepo     string   `env:"IMAGE_REPO"`
-	CaCertPath    string   `env:"CA_CERT_PATH"`
-	CertPath      string   `env:"CERT_PATH"`
-	KeyPath       string   `env:"KEY_PATH"`
-	OutputDir     string   `env:"OUTPUT_DIR"`
-	ImageSkip     []string `env:"IMAGE_SKIP"`
-	SkipTlsVerify bool     `env:"SKIP_TLS_VERIFY"`
-	Overwrite     bool     `env:"OVERWRITE"`
-	DryRun        bool     `env:"DRY_RUN"`
-	RetryAttempts int      `env:"RETRY_ATTEMPTS,default=1"` // number of retries for pushing images
-	RetryDelay    int      `env:"RETRY_DELAY,default=5"`    // in seconds, delay between retries
+	Username          string   `env:"REGISTRY_USERNAME"`
+	Password          string   `env:"REGISTRY_PASSWORD"`
+	Token             string   `env:"REGISTRY_TOKEN"`
+	RegistryHost      string   `env:"REGISTRY_HOST"`
+	ImagePrefix       string   `env:"IMAGE_PREFIX"`
+	ImageSuffix       string   `env:"IMAGE_SUFFIX"`
+	ImageRepo         string   `env:"IMAGE_REPO"`
+	CaCertPath        string   `env:"CA_CERT_PATH"`
+	CertPath          string   `env:"CERT_PATH"`
+	KeyPath           string   `env:"KEY_PATH"`
+	OutputDir         string   `env:"OUTPUT_DIR"`
+	ImageSkip         []string `env:"IMAGE_SKIP"`
+	SkipTlsVerify     bool     `env:"SKIP_TLS_VERIFY"`
+	Overwrite         bool     `env:"OVERWRITE"`
+	DryRun            bool     `env:"DRY_RUN"`
+	RetryAttempts     int      `env:"RETRY_ATTEMPTS,default=1"` // number of retries for pushing images
+	RetryDelay        int      `env:"RETRY_DELAY,default=5"`    // in seconds, delay between retries
+	Concurrency       int      `env:"CONCURRENCY,default=1"`    // number of images pushed in parallel
+	Stream            bool     `env:"STREAM"`
+	PublicKey         string   `env:"PUBLIC_KEY"`
+	RequireSignature  bool     `env:"REQUIRE_SIGNATURE"`
+	Report            string   `env:"REPORT"`
+	ChartsDir         string   `env:"CHARTS_DIR"`
+	PushCharts        bool     `env:"PUSH_CHARTS"`
+	ChartsRepo        string   `env:"CHARTS_REPO,default=charts"`
+	AllowDigestChange bool     `env:"ALLOW_DIGEST_CHANGE"`
+	format            bundleFormat
+	journal           *loadJournal
 }
 
 var loadCfg loadConfig
@@ -150,75 +470,49 @@ func init() {
 	loadCmd.Flags().BoolVarP(&loadCfg.DryRun, "dry-run", "", false, "Perform a dry run without making changes")
 	loadCmd.Flags().StringArrayVarP(&loadCfg.ImageSkip, "skip-image", "", []string{}, "Specify which image should be skipped (can be used multiple times)")
 	loadCmd.Flags().IntVarP(&loadCfg.RetryAttempts, "retry-attempts", "", 1, "Number of retries for pushing images")
-	loadCmd.Flags().IntVarP(&loadCfg.RetryDelay, "retry-delay", "", 5, "Delay between retries in seconds")
+	loadCmd.Flags().IntVarP(&loadCfg.RetryDelay, "retry-delay", "", 5, "Delay before the first retry in seconds, doubled after each retry")
+	loadCmd.Flags().IntVarP(&loadCfg.Concurrency, "concurrency", "", 1, "Number of images pushed in parallel")
+	loadCmd.Flags().BoolVarP(&loadCfg.Stream, "stream", "", false, "Push the images while reading the tarball instead of extracting it to --output-dir")
+	loadCmd.Flags().StringVarP(&loadCfg.PublicKey, "public-key", "", "", "Path to the public key to verify the signature of the bundle with")
+	loadCmd.Flags().BoolVarP(&loadCfg.RequireSignature, "require-signature", "", false, "Refuse bundles which are not signed with --public-key")
+	loadCmd.Flags().StringVarP(&loadCfg.Report, "report", "", "", "Write a JSON report of the pushed, skipped and failed images to this file")
+	loadCmd.Flags().StringVarP(&loadCfg.ChartsDir, "charts-dir", "", "", "Extract the charts saved with --include-charts to this directory")
+	loadCmd.Flags().BoolVarP(&loadCfg.PushCharts, "push-charts", "", false, "Push the charts saved with --include-charts to the registry, as helm push does")
+	loadCmd.Flags().StringVarP(&loadCfg.ChartsRepo, "charts-repo", "", "charts", "Repository of the registry the charts are pushed to with --push-charts")
+	loadCmd.Flags().BoolVarP(&loadCfg.AllowDigestChange, "allow-digest-change", "", false, "Push images pinned by digest whose digest changed, when platforms were filtered out on save")
 }
 
-func extractTarball(tarballPath, outputDir string) error {
+// extractTarball extracts a bundle to outputDir, every entry is recorded in
+// check while it is written.
+func extractTarball(tarballPath, outputDir string, check *bundleCheck) error {
 	// fmt.Printf("Extracting tarball %s to %s...\n", tarballPath, outputDir)
 
-	// Open the tarball
-	file, err := os.Open(tarballPath)
-	if err != nil {
-		return fmt.Errorf("error opening tarball: %v", err)
-	}
-	defer file.Close()
-
-	zstdReader, err := zstd.NewReader(file)
-	if err != nil {
-		return fmt.Errorf("failed to create zstd reader: %v", err)
-	}
-	defer zstdReader.Close()
-
-	// Create a tar reader
-	tarReader := tar.NewReader(zstdReader)
-
-	// Extract files
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break // End of archive
-		}
+	return walkArchive(tarballPath, func(name string, size int64, r io.Reader) error {
+		outputPath := filepath.Join(outputDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(outputPath), 0755)
+		outFile, err := os.Create(outputPath)
 		if err != nil {
-			return fmt.Errorf("error reading tar header: %v", err)
-		}
-
-		// Determine the output path
-		cleanName := filepath.Clean(header.Name)
-		if strings.Contains(cleanName, "..") {
-			return fmt.Errorf("invalid file path: %s", header.Name)
+			return fmt.Errorf("error creating file %s: %v", outputPath, err)
 		}
-		outputPath := filepath.Join(outputDir, cleanName)
+		defer outFile.Close()
 
-		// Handle directories
-		if header.Typeflag == tar.TypeDir {
-			os.MkdirAll(outputPath, 0755)
-			continue
+		// check only reads the entries it hashes, the rest is copied after it
+		err = check.add(name, io.TeeReader(r, outFile))
+		if err != nil {
+			return err
 		}
-
-		// Handle files
-		if header.Typeflag == tar.TypeReg {
-			os.MkdirAll(filepath.Dir(outputPath), 0755)
-			outFile, err := os.Create(outputPath)
-			if err != nil {
-				return fmt.Errorf("error creating file %s: %v", outputPath, err)
-			}
-			defer outFile.Close()
-
-			_, err = io.Copy(outFile, tarReader)
-			if err != nil {
-				return fmt.Errorf("error writing file %s: %v", outputPath, err)
-			}
+		_, err = io.Copy(outFile, r)
+		if err != nil {
+			return fmt.Errorf("error writing file %s: %v", outputPath, err)
 		}
-	}
-
-	// fmt.Println("Extraction complete.")
-	return nil
+		return nil
+	})
 }
 
-func readManifest(manifestPath string) ([]ImageManifest, error) {
+func readManifest(source bundleSource) ([]ImageManifest, error) {
 	// fmt.Printf("Reading manifest from %s...\n", manifestPath)
 
-	file, err := os.Open(manifestPath)
+	file, err := source.Open("manifest.json")
 	if err != nil {
 		return nil, fmt.Errorf("error opening manifest file: %v", err)
 	}
@@ -234,13 +528,47 @@ func readManifest(manifestPath string) ([]ImageManifest, error) {
 	return manifests, nil
 }
 
-func rebuildAndPushImage(manifest ImageManifest, c loadConfig, cmd *cobra.Command) (string, error) {
+func rebuildAndPushImage(manifest ImageManifest, c loadConfig, source bundleSource, uploads *blobUploads, out printer) (string, pushStatus, error) {
 	// fmt.Printf("Rebuilding and pushing image: %s...\n", manifest.OriginalImage)
 
+	iUri, err := targetUri(manifest, c)
+	if err != nil {
+		return "", statusPushed, err
+	}
+	options, err := registryOptions(c)
+	if err != nil {
+		return "", statusPushed, err
+	}
+	if c.DryRun {
+		return iUri.String(), statusPushed, nil
+	}
+
+	if c.journal.pushedImage(iUri, manifest.Digest) {
+		out.Printf("image %s was pushed by the previous load\n", iUri.String())
+		return iUri.String(), statusResumed, nil
+	}
+	if !c.Overwrite && imageExists(iUri, options) {
+		out.Printf("image %s already exists in the registry\n", iUri.String())
+		return iUri.String(), statusExists, nil
+	}
+
+	push, err := prepareImagePush(manifest, iUri, c, source, out)
+	if err != nil {
+		return "", statusPushed, err
+	}
+	err = push.run(c, uploads, options, out)
+	if err != nil {
+		return "", statusPushed, err
+	}
+	return push.iUri.String(), statusPushed, nil
+}
+
+// targetUri returns the reference an image of the bundle is pushed to.
+func targetUri(manifest ImageManifest, c loadConfig) (image_uri.DockerUri, error) {
 	targetRef := fmt.Sprintf("%s/%s", c.RegistryHost, manifest.ImageName)
 	iUri, err := image_uri.NewDockerUri(targetRef)
 	if err != nil {
-		return "", err
+		return image_uri.DockerUri{}, err
 	}
 
 	iUri.Organization = iUri.Join([]string{c.ImagePrefix, iUri.Organization}, "/")
@@ -249,10 +577,14 @@ func rebuildAndPushImage(manifest ImageManifest, c loadConfig, cmd *cobra.Comman
 		iUri.Organization = c.ImageRepo
 		iUri.Project = ""
 	}
+	return iUri, nil
+}
 
+// registryOptions returns the transport and authentication of the target registry.
+func registryOptions(c loadConfig) ([]remote.Option, error) {
 	transport, err := GetTransport(c.CaCertPath, c.CertPath, c.KeyPath, c.SkipTlsVerify)
 	if err != nil {
-		return "", fmt.Errorf("failed to GetTransport: %w", err)
+		return nil, fmt.Errorf("failed to GetTransport: %w", err)
 	}
 
 	auth := authn.Anonymous
@@ -267,32 +599,204 @@ func rebuildAndPushImage(manifest ImageManifest, c loadConfig, cmd *cobra.Comman
 			Password: c.Password,
 		}
 	}
-	if c.DryRun {
-		return iUri.String(), nil
+	return []remote.Option{remote.WithTransport(transport), remote.WithAuth(auth)}, nil
+}
+
+// imageExists reports whether the target reference is already in the registry.
+func imageExists(iUri image_uri.DockerUri, options []remote.Option) bool {
+	ref, err := name.ParseReference(iUri.TagRef())
+	if err != nil {
+		return false
 	}
+	_, err = remote.Head(ref, options...)
+	return err == nil
+}
 
-	if !c.Overwrite {
-		mfs, _ := crane.Manifest(iUri.String(), crane.WithTransport(transport), crane.WithAuth(auth))
-		if len(mfs) > 0 {
-			cmd.Printf("image %s already exists in the registry\n", iUri.String())
-			return iUri.String(), nil
+// imagePush is an image, or an index, of the bundle ready to be pushed.
+type imagePush struct {
+	manifest ImageManifest
+	// target is the reference the image is journaled with, iUri the one it
+	// is pushed to
+	target    image_uri.DockerUri
+	iUri      image_uri.DockerUri
+	repo      name.Repository
+	images    []v1.Image
+	referrers []imageReferrer
+	push      func(ref name.Reference, options []remote.Option) error
+}
+
+// prepareImagePush loads the image described by a manifest entry, as saved or
+// rebuilt from its config and layers for older bundles.
+func prepareImagePush(manifest ImageManifest, iUri image_uri.DockerUri, c loadConfig, source bundleSource, out printer) (*imagePush, error) {
+	repo, err := name.NewRepository(iUri.Base())
+	if err != nil {
+		return nil, fmt.Errorf("error creating repository from URI %s: %v", iUri.String(), err)
+	}
+	push := &imagePush{manifest: manifest, target: iUri, repo: repo}
+
+	var digestFn func() (v1.Hash, error)
+	if len(manifest.Manifests) > 0 {
+		var index v1.ImageIndex
+		if manifest.ManifestFile != "" {
+			index, err = loadBundleIndex(manifest, source, c.format)
+		} else {
+			index, err = rebuildIndex(manifest, c.OutputDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		push.images, err = indexImages(index)
+		if err != nil {
+			return nil, err
+		}
+		digestFn = index.Digest
+		push.push = func(ref name.Reference, options []remote.Option) error {
+			return remote.WriteIndex(ref, index, options...)
+		}
+	} else {
+		var image v1.Image
+		if manifest.ManifestFile != "" {
+			image, err = loadBundleImage(manifest, source, c.format)
+		} else {
+			image, err = rebuildImage(manifest, c.OutputDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		push.images = []v1.Image{image}
+		digestFn = image.Digest
+		push.push = func(ref name.Reference, options []remote.Option) error {
+			return remote.Write(ref, image, options...)
 		}
 	}
 
+	for _, referrer := range manifest.Referrers {
+		image, err := loadBundleImage(referrer, source, c.format)
+		if err != nil {
+			return nil, fmt.Errorf("error loading referrer %s: %v", referrer.Digest, err)
+		}
+		push.images = append(push.images, image)
+		push.referrers = append(push.referrers, imageReferrer{image: image, tag: referrer.Tag})
+	}
+
+	// The pinned digest only differs when platforms were filtered out on save,
+	// or for bundles rebuilt from their config and layers
+	err = checkRebuiltDigest(&iUri, digestFn, c.AllowDigestChange, out)
+	if err != nil {
+		return nil, err
+	}
+	push.iUri = iUri
+	return push, nil
+}
+
+// run pushes the image and its referrers, layers shared with other images are
+// only uploaded once.
+func (p *imagePush) run(c loadConfig, uploads *blobUploads, options []remote.Option, out printer) error {
+	ref, err := name.ParseReference(p.iUri.TagRef())
+	if err != nil {
+		return fmt.Errorf("error parsing reference %s: %v", p.iUri.TagRef(), err)
+	}
+	err = pushWithRetry(c.RetryAttempts, c.RetryDelay, out, p.iUri.String(), func() error {
+		err := uploads.uploadLayers(p.images, p.repo, options...)
+		if err != nil {
+			return err
+		}
+		return p.push(ref, options)
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.manifest.ManifestFile != "" {
+		desc, err := remote.Head(ref, options...)
+		if err != nil {
+			return fmt.Errorf("error checking pushed image digest: %v", err)
+		}
+		if p.manifest.Digest != "" && desc.Digest.String() != p.manifest.Digest {
+			return fmt.Errorf("digest mismatch after push: expected %s, registry has %s", p.manifest.Digest, desc.Digest.String())
+		}
+	}
+
+	if len(p.referrers) > 0 {
+		err = pushWithRetry(c.RetryAttempts, c.RetryDelay, out, p.iUri.String(), func() error {
+			return pushReferrers(p.repo, p.referrers, options...)
+		})
+		if err != nil {
+			return err
+		}
+		out.Printf("Pushed %d referrers of image %s\n", len(p.referrers), p.iUri.String())
+	}
+	return c.journal.recordImage(p.target, p.manifest.Digest)
+}
+
+// checkRebuiltDigest compares the digest of the rebuilt image with the pinned
+// one. A pinned image must keep its digest, it is only pushed by the digest it
+// actually has when allowChange is set.
+func checkRebuiltDigest(iUri *image_uri.DockerUri, digestFn func() (v1.Hash, error), allowChange bool, out printer) error {
+	if iUri.Digest == "" {
+		return nil
+	}
+	digest, err := digestFn()
+	if err != nil {
+		return fmt.Errorf("error computing image digest: %v", err)
+	}
+	if digest.String() == iUri.Digest {
+		return nil
+	}
+	if !allowChange {
+		return fmt.Errorf("digest of image %s is %s instead of the pinned %s, use --allow-digest-change to push it anyway", iUri.Base(), digest.String(), iUri.Digest)
+	}
+	out.Printf("Warning: digest of image %s changed from %s to %s\n", iUri.Base(), iUri.Digest, digest.String())
+	iUri.Digest = digest.String()
+	return nil
+}
+
+// rebuildIndex rebuilds every platform image of a multi-architecture image and
+// assembles them into a new index.
+func rebuildIndex(manifest ImageManifest, outputDir string) (v1.ImageIndex, error) {
+	var addenda []mutate.IndexAddendum
+	for _, child := range manifest.Manifests {
+		image, err := rebuildImage(child, outputDir)
+		if err != nil {
+			return nil, fmt.Errorf("error rebuilding manifest %s: %v", child.Digest, err)
+		}
+
+		var platform *v1.Platform
+		if child.Platform != "" {
+			platform, err = v1.ParsePlatform(child.Platform)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing platform %s: %v", child.Platform, err)
+			}
+		}
+		addenda = append(addenda, mutate.IndexAddendum{
+			Add:        image,
+			Descriptor: v1.Descriptor{Platform: platform},
+		})
+	}
+
+	mediaType := types.MediaType(manifest.MediaType)
+	if !mediaType.IsIndex() {
+		mediaType = types.OCIImageIndex
+	}
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, mediaType), addenda...), nil
+}
+
+// rebuildImage reconstructs a single image from its saved config file and layers.
+func rebuildImage(manifest ImageManifest, outputDir string) (v1.Image, error) {
 	// Step 1: Load Config File
-	configPath := filepath.Join(c.OutputDir, manifest.ConfigFile)
+	configPath := filepath.Join(outputDir, manifest.ConfigFile)
 	configFile, err := loadConfigFile(configPath)
 	if err != nil {
-		return "", fmt.Errorf("error loading config file %s: %v", configPath, err)
+		return nil, fmt.Errorf("error loading config file %s: %v", configPath, err)
 	}
 
 	// Step 2: Load Layers
 	var layers []v1.Layer
 	for _, layerDigest := range manifest.Layers {
-		layerPath := filepath.Join(c.OutputDir, "layers", layerDigest+".tar.gz")
+		layerPath := filepath.Join(outputDir, "layers", layerDigest+".tar.gz")
 		layer, err := tarball.LayerFromFile(layerPath)
 		if err != nil {
-			return "", fmt.Errorf("error loading layer %s: %v", layerPath, err)
+			return nil, fmt.Errorf("error loading layer %s: %v", layerPath, err)
 		}
 		layers = append(layers, layer)
 	}
@@ -301,11 +805,11 @@ func rebuildAndPushImage(manifest ImageManifest, c loadConfig, cmd *cobra.Comman
 	emptyImage := empty.Image
 	image, err := mutate.ConfigFile(emptyImage, configFile)
 	if err != nil {
-		return "", fmt.Errorf("error setting config file: %v", err)
+		return nil, fmt.Errorf("error setting config file: %v", err)
 	}
 	image, err = mutate.AppendLayers(image, layers...)
 	if err != nil {
-		return "", fmt.Errorf("error appending layers: %v", err)
+		return nil, fmt.Errorf("error appending layers: %v", err)
 	}
 
 	// Ensure the RootFS.DiffIDs match the layers
@@ -313,7 +817,7 @@ func rebuildAndPushImage(manifest ImageManifest, c loadConfig, cmd *cobra.Comman
 	for _, layer := range layers {
 		diffID, err := layer.DiffID()
 		if err != nil {
-			return "", fmt.Errorf("error getting layer DiffID: %v", err)
+			return nil, fmt.Errorf("error getting layer DiffID: %v", err)
 		}
 		diffIDs = append(diffIDs, diffID)
 	}
@@ -325,46 +829,9 @@ func rebuildAndPushImage(manifest ImageManifest, c loadConfig, cmd *cobra.Comman
 
 	image, err = mutate.ConfigFile(image, configFile)
 	if err != nil {
-		return "", fmt.Errorf("error updating config file with RootFS: %v", err)
-	}
-
-	// Push each layer individually to ensure they are available in the registry
-	for _, layer := range layers {
-		layerDigest, err := layer.Digest()
-		if err != nil {
-			return "", fmt.Errorf("error getting layer digest: %v", err)
-		}
-		layerPath := filepath.Join(c.OutputDir, "layers", strings.TrimPrefix(layerDigest.String(), "sha256:")+".tar.gz")
-		layerFile, err := os.Open(layerPath)
-		if err != nil {
-			return "", fmt.Errorf("error opening layer file %s: %v", layerPath, err)
-		}
-		defer layerFile.Close()
-
-		layer, err := tarball.LayerFromReader(layerFile)
-		if err != nil {
-			return "", fmt.Errorf("error creating layer from file %s: %v", layerPath, err)
-		}
-
-		repo, err := name.NewRepository(iUri.Base())
-		if err != nil {
-			return "", fmt.Errorf("error creating repository from URI %s: %v", iUri.String(), err)
-		}
-		err = remote.WriteLayer(repo, layer, remote.WithTransport(transport), remote.WithAuth(auth))
-		if err != nil {
-			return "", fmt.Errorf("error pushing layer %s: %v", layerDigest.String(), err)
-		}
-	}
-
-	for i := range c.RetryAttempts + 1 {
-		err = crane.Push(image, iUri.String(), crane.WithTransport(transport), crane.WithAuth(auth))
-		if err == nil {
-			return iUri.String(), nil // Successfully pushed the image
-		}
-		cmd.Printf("Failed to push image: %s. Attempt %d/%d. Error: %v", image, i+1, c.RetryAttempts, err)
-		time.Sleep(time.Duration(c.RetryDelay) * time.Second) // Wait before retrying
+		return nil, fmt.Errorf("error updating config file with RootFS: %v", err)
 	}
-	return "", fmt.Errorf("error pushing image: %v", err)
+	return image, nil
 }
 
 func loadConfigFile(configPath string) (*v1.ConfigFile, error) {
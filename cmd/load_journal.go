@@ -0,0 +1,412 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// loadJournalFile records in --output-dir the images and blobs pushed by
+// load, so that a load which failed is resumed by running it again.
+const loadJournalFile = "load-journal.jsonl"
+
+// loadJournal lists what was pushed from a bundle, by registry. It is written
+// as JSON lines: the bundle first, then a line is appended for every image or
+// blob pushed.
+type loadJournal struct {
+	Bundle     journalBundle
+	Registries map[string]*registryJournal
+
+	mu   sync.Mutex
+	path string
+	// written is set once the journal file holds the bundle line
+	written bool
+	// resumed is set when the journal was written by a previous load of the
+	// same bundle
+	resumed bool
+}
+
+// journalEntry is a line of the journal, either the bundle it was written for,
+// an image or a blob pushed to a registry.
+type journalEntry struct {
+	Bundle     *journalBundle `json:"bundle,omitempty"`
+	Registry   string         `json:"registry,omitempty"`
+	Image      string         `json:"image,omitempty"`
+	Digest     string         `json:"digest,omitempty"`
+	Repository string         `json:"repository,omitempty"`
+	Blob       string         `json:"blob,omitempty"`
+}
+
+// journalBundle identifies the bundle a journal was written for.
+type journalBundle struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// registryJournal lists the images pushed to a registry with their digest,
+// and the blobs pushed to each of its repositories.
+type registryJournal struct {
+	Images map[string]string
+	Blobs  map[string][]string
+}
+
+// newJournalBundle identifies a bundle archive, or its volumes, by size and
+// modification time.
+func newJournalBundle(tarballPath string) (journalBundle, error) {
+	bundle := journalBundle{Name: filepath.Base(tarballPath)}
+	volumes, err := archiveVolumes(tarballPath)
+	if err != nil {
+		return bundle, err
+	}
+	for _, volume := range volumes {
+		info, err := os.Stat(volume.path)
+		if err != nil {
+			return bundle, err
+		}
+		bundle.Size += info.Size()
+		if info.ModTime().After(bundle.ModTime) {
+			bundle.ModTime = info.ModTime()
+		}
+	}
+	bundle.ModTime = bundle.ModTime.UTC()
+	return bundle, nil
+}
+
+// openLoadJournal returns the journal of the load of tarballPath. The journal
+// left in outputDir by a previous load is resumed when it was written for the
+// same bundle, otherwise it is replaced. Dry runs are not journaled.
+func openLoadJournal(outputDir string, tarballPath string, dryRun bool) (*loadJournal, error) {
+	if dryRun {
+		return nil, nil
+	}
+	bundle, err := newJournalBundle(tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	journal := &loadJournal{
+		Bundle:     bundle,
+		Registries: make(map[string]*registryJournal),
+		path:       filepath.Join(outputDir, loadJournalFile),
+	}
+
+	data, err := os.ReadFile(journal.path)
+	if os.IsNotExist(err) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", loadJournalFile, err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	var header journalEntry
+	err = json.Unmarshal(lines[0], &header)
+	if err == nil && header.Bundle == nil {
+		err = fmt.Errorf("missing bundle")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", loadJournalFile, err)
+	}
+	previous := header.Bundle
+	if previous.Name != bundle.Name || previous.Size != bundle.Size || !previous.ModTime.Equal(bundle.ModTime) {
+		return journal, nil
+	}
+	journal.resumed = true
+	for _, line := range lines[1:] {
+		var entry journalEntry
+		// The last line is left incomplete when a load is interrupted while
+		// appending it
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		journal.add(entry)
+	}
+	return journal, nil
+}
+
+// add records an entry in the journal, the lock must be held.
+func (j *loadJournal) add(entry journalEntry) {
+	r := j.registry(entry.Registry)
+	if entry.Image != "" {
+		r.Images[entry.Image] = entry.Digest
+	}
+	if entry.Blob != "" && !slices.Contains(r.Blobs[entry.Repository], entry.Blob) {
+		r.Blobs[entry.Repository] = append(r.Blobs[entry.Repository], entry.Blob)
+	}
+}
+
+// registry returns the journal of a registry, the lock must be held.
+func (j *loadJournal) registry(registry string) *registryJournal {
+	r, ok := j.Registries[registry]
+	if !ok {
+		r = &registryJournal{Images: make(map[string]string), Blobs: make(map[string][]string)}
+		j.Registries[registry] = r
+	}
+	return r
+}
+
+// pushedImage reports whether the target image was pushed from the bundle
+// with this digest.
+func (j *loadJournal) pushedImage(iUri image_uri.DockerUri, digest string) bool {
+	if j == nil {
+		return false
+	}
+	repo, err := name.NewRepository(iUri.Base())
+	if err != nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	pushed, ok := j.registry(repo.RegistryStr()).Images[iUri.String()]
+	return ok && pushed == digest
+}
+
+// recordImage adds a pushed image to the journal.
+func (j *loadJournal) recordImage(iUri image_uri.DockerUri, digest string) error {
+	if j == nil {
+		return nil
+	}
+	repo, err := name.NewRepository(iUri.Base())
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry := journalEntry{Registry: repo.RegistryStr(), Image: iUri.String(), Digest: digest}
+	j.add(entry)
+	return j.append(entry)
+}
+
+// pushedBlob reports whether the blob was pushed to the repository.
+func (j *loadJournal) pushedBlob(repo name.Repository, digest v1.Hash) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Contains(j.registry(repo.RegistryStr()).Blobs[repo.RepositoryStr()], digest.String())
+}
+
+// recordBlob adds a blob pushed to a repository to the journal.
+func (j *loadJournal) recordBlob(repo name.Repository, digest v1.Hash) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if slices.Contains(j.registry(repo.RegistryStr()).Blobs[repo.RepositoryStr()], digest.String()) {
+		return nil
+	}
+	entry := journalEntry{Registry: repo.RegistryStr(), Repository: repo.RepositoryStr(), Blob: digest.String()}
+	j.add(entry)
+	return j.append(entry)
+}
+
+// counts returns the number of images and blobs in the journal.
+func (j *loadJournal) counts() (images int, blobs int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, r := range j.Registries {
+		images += len(r.Images)
+		for _, digests := range r.Blobs {
+			blobs += len(digests)
+		}
+	}
+	return images, blobs
+}
+
+// save writes the journal with the bundle and every entry recorded so far,
+// the lock must be held.
+func (j *loadJournal) save() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	err := encoder.Encode(journalEntry{Bundle: &j.Bundle})
+	for registry, r := range j.Registries {
+		for image, digest := range r.Images {
+			if err == nil {
+				err = encoder.Encode(journalEntry{Registry: registry, Image: image, Digest: digest})
+			}
+		}
+		for repository, blobs := range r.Blobs {
+			for _, blob := range blobs {
+				if err == nil {
+					err = encoder.Encode(journalEntry{Registry: registry, Repository: repository, Blob: blob})
+				}
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", loadJournalFile, err)
+	}
+	err = os.MkdirAll(filepath.Dir(j.path), 0755)
+	if err == nil {
+		err = writeFileAtomic(j.path, buf.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", loadJournalFile, err)
+	}
+	j.written = true
+	return nil
+}
+
+// append adds a line to the journal, which is written first when it was not
+// yet. The lock must be held.
+func (j *loadJournal) append(entry journalEntry) error {
+	if !j.written {
+		return j.save()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", loadJournalFile, err)
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+		err = firstError(err, file.Close())
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", loadJournalFile, err)
+	}
+	return nil
+}
+
+// create writes the journal before anything is pushed, for a load which
+// fails to leave it behind.
+func (j *loadJournal) create() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.save()
+}
+
+// remove deletes the journal once every image is pushed, with --output-dir
+// when nothing else is in it.
+func (j *loadJournal) remove() error {
+	if j == nil {
+		return nil
+	}
+	err := os.Remove(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing journal: %v", err)
+	}
+	os.Remove(filepath.Dir(j.path))
+	return nil
+}
+
+// checkExtractedBundle verifies the bundle an interrupted load left extracted
+// to outputDir, it is pushed again without extracting the tarball when every
+// entry matches its digest.
+func checkExtractedBundle(outputDir string, journal *loadJournal) (*bundleCheck, bool) {
+	if journal == nil || !journal.resumed {
+		return nil, false
+	}
+	check := newBundleCheck()
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(outputDir, path)
+		if err != nil || name == loadJournalFile {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return check.add(name, file)
+	})
+	if err != nil {
+		return nil, false
+	}
+	source := dirSource(outputDir)
+	manifests, format, err := readBundleManifests(source)
+	if err == nil {
+		check.delta, err = readBundleDelta(source)
+	}
+	if err != nil || len(check.corrupted) > 0 || len(check.missing(manifests, format)) > 0 {
+		return nil, false
+	}
+	return check, true
+}
+
+// loadReport is the outcome of load, written as JSON with --report.
+type loadReport struct {
+	Bundle   string            `json:"bundle"`
+	Registry string            `json:"registry"`
+	DryRun   bool              `json:"dry_run,omitempty"`
+	Pushed   []loadReportImage `json:"pushed"`
+	Skipped  []loadReportImage `json:"skipped"`
+	Failed   []loadReportImage `json:"failed"`
+}
+
+type loadReportImage struct {
+	Image  string `json:"image"`
+	Target string `json:"target,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// Reason tells why an image was skipped: skip-image, exists or resumed
+	// when a previous load pushed it
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// writeLoadReport writes the report of a load to c.Report: the images
+// excluded with --skip-image, and the result of every other one.
+func writeLoadReport(tarballPath string, c loadConfig, manifests []ImageManifest, pending []ImageManifest, results []pushResult) error {
+	if c.Report == "" {
+		return nil
+	}
+	report := loadReport{
+		Bundle:   tarballPath,
+		Registry: c.RegistryHost,
+		DryRun:   c.DryRun,
+		Pushed:   []loadReportImage{},
+		Skipped:  []loadReportImage{},
+		Failed:   []loadReportImage{},
+	}
+	for _, manifest := range manifests {
+		if slices.Contains(c.ImageSkip, manifest.ImageName) {
+			report.Skipped = append(report.Skipped, loadReportImage{Image: manifest.OriginalImage, Digest: manifest.Digest, Reason: "skip-image"})
+		}
+	}
+	for idx, manifest := range pending {
+		image := loadReportImage{Image: manifest.OriginalImage, Digest: manifest.Digest}
+		if iUri, err := targetUri(manifest, c); err == nil {
+			image.Target = iUri.String()
+		}
+		result := results[idx]
+		switch {
+		case result.err != nil:
+			image.Error = result.err.Error()
+			report.Failed = append(report.Failed, image)
+		case result.status == statusExists:
+			image.Reason = "exists"
+			report.Skipped = append(report.Skipped, image)
+		case result.status == statusResumed:
+			image.Reason = "resumed"
+			report.Skipped = append(report.Skipped, image)
+		default:
+			report.Pushed = append(report.Pushed, image)
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding report: %v", err)
+	}
+	err = os.WriteFile(c.Report, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeLoad(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var images []chartutil.DatarobotImageDeclaration
+	for _, tag := range []string{"1", "2"} {
+		image, err := random.Image(512, 2)
+		assert.NoError(t, err)
+		ref, err := name.ParseReference(host + "/src/app" + tag + ":" + tag)
+		assert.NoError(t, err)
+		assert.NoError(t, remote.Write(ref, image))
+		images = append(images, chartutil.DatarobotImageDeclaration{Image: ref.String()})
+	}
+	tarballPath := filepath.Join(t.TempDir(), "images.tar.zst")
+	s := saveConfig{Output: tarballPath, OutputDir: filepath.Join(t.TempDir(), "export"), Format: string(formatNative), Concurrency: 1}
+	cmd := &cobra.Command{}
+	cmd.SetOut(io.Discard)
+	assert.NoError(t, exportSave(images, s, zstd.SpeedFastest, cmd))
+
+	for _, mode := range []string{"extract", "stream"} {
+		t.Run(mode, func(t *testing.T) {
+			// The target registry refuses the manifest of app2 while broken is
+			// set, and counts the blob uploads
+			var broken atomic.Bool
+			var uploads atomic.Int32
+			handler := registry.New()
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if broken.Load() && r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v2/dst/src/app2/manifests/") {
+					http.Error(w, "quota exceeded", http.StatusForbidden)
+					return
+				}
+				if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+					uploads.Add(1)
+				}
+				handler.ServeHTTP(w, r)
+			}))
+			defer target.Close()
+			targetHost := strings.TrimPrefix(target.URL, "http://")
+
+			outputDir := filepath.Join(t.TempDir(), "export")
+			report := filepath.Join(t.TempDir(), "report.json")
+			l := loadConfig{RegistryHost: targetHost, ImagePrefix: "dst", Concurrency: 1, OutputDir: outputDir, Report: report}
+			signature, err := newBundleSignature("", false)
+			assert.NoError(t, err)
+			run := func() (string, error) {
+				var buf strings.Builder
+				cmd := &cobra.Command{}
+				cmd.SetOut(&buf)
+				var err error
+				if mode == "stream" {
+					err = streamLoad(tarballPath, l, signature, cmd)
+				} else {
+					err = extractLoad(tarballPath, l, signature, cmd)
+				}
+				return buf.String(), err
+			}
+			readReport := func() loadReport {
+				data, err := os.ReadFile(report)
+				assert.NoError(t, err)
+				var r loadReport
+				assert.NoError(t, json.Unmarshal(data, &r))
+				return r
+			}
+
+			broken.Store(true)
+			output, err := run()
+			assert.EqualError(t, err, "failed to push 1 of 2 images")
+			assert.Contains(t, output, "run the same command again to resume the load")
+			assert.FileExists(t, filepath.Join(outputDir, loadJournalFile))
+			r := readReport()
+			assert.Len(t, r.Pushed, 1)
+			assert.Equal(t, images[0].Image, r.Pushed[0].Image)
+			assert.Equal(t, targetHost+"/dst/src/app1:1", r.Pushed[0].Target)
+			assert.Len(t, r.Failed, 1)
+			assert.Equal(t, images[1].Image, r.Failed[0].Image)
+			assert.Contains(t, r.Failed[0].Error, "quota exceeded")
+			assert.Empty(t, r.Skipped)
+
+			// The layers of app2 were uploaded before its manifest was refused,
+			// nothing is uploaded again
+			broken.Store(false)
+			uploads.Store(0)
+			output, err = run()
+			assert.NoError(t, err)
+			assert.Contains(t, output, "images and 4 layers already pushed\n")
+			assert.Contains(t, output, "image "+targetHost+"/dst/src/app1:1 was pushed by the previous load\n")
+			assert.Contains(t, output, "Summary: 1 pushed, 1 already in the registry, 0 failed\n")
+			assert.Equal(t, int32(0), uploads.Load())
+			if mode == "extract" {
+				assert.Contains(t, output, "Resuming load from "+outputDir)
+			}
+			assert.NoDirExists(t, outputDir)
+			r = readReport()
+			assert.Len(t, r.Pushed, 1)
+			assert.Equal(t, images[1].Image, r.Pushed[0].Image)
+			assert.Empty(t, r.Failed)
+			if assert.Len(t, r.Skipped, 1) {
+				assert.Equal(t, images[0].Image, r.Skipped[0].Image)
+				assert.Equal(t, "resumed", r.Skipped[0].Reason)
+				assert.NotEmpty(t, r.Skipped[0].Digest)
+			}
+
+			// The journal is removed once every image is pushed, they are now
+			// skipped as already in the registry
+			l.ImageSkip = []string{"src/app2:2"}
+			_, err = run()
+			assert.NoError(t, err)
+			r = readReport()
+			assert.Empty(t, r.Pushed)
+			assert.Len(t, r.Skipped, 2)
+			assert.Equal(t, "skip-image", r.Skipped[0].Reason)
+			assert.Equal(t, "exists", r.Skipped[1].Reason)
+		})
+	}
+}
+
+func TestOpenLoadJournal(t *testing.T) {
+	tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+	outputDir := t.TempDir()
+
+	journal, err := openLoadJournal(outputDir, tarballPath, true)
+	assert.NoError(t, err)
+	assert.Nil(t, journal)
+	assert.False(t, journal.pushedImage(image_uri.DockerUri{}, ""))
+
+	journal, err = openLoadJournal(outputDir, tarballPath, false)
+	assert.NoError(t, err)
+	assert.False(t, journal.resumed)
+	iUri, err := image_uri.NewDockerUri("registry.example.com/alpine/curl:stable")
+	assert.NoError(t, err)
+	assert.NoError(t, journal.recordImage(iUri, "sha256:1234"))
+
+	repo, err := name.NewRepository("registry.example.com/alpine/curl")
+	assert.NoError(t, err)
+	blob := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	assert.NoError(t, journal.recordBlob(repo, blob))
+	assert.NoError(t, journal.recordBlob(repo, blob))
+
+	// A line is appended for every image and blob pushed
+	data, err := os.ReadFile(filepath.Join(outputDir, loadJournalFile))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, `{"registry":"registry.example.com","repository":"alpine/curl","blob":"`+blob.String()+`"}`, lines[2])
+
+	// The line left incomplete by an interrupted load is ignored
+	assert.NoError(t, os.WriteFile(filepath.Join(outputDir, loadJournalFile), append(data, []byte(`{"registry":"regis`)...), 0644))
+	journal, err = openLoadJournal(outputDir, tarballPath, false)
+	assert.NoError(t, err)
+	assert.True(t, journal.resumed)
+	assert.True(t, journal.pushedImage(iUri, "sha256:1234"))
+	assert.False(t, journal.pushedImage(iUri, "sha256:5678"))
+	assert.True(t, journal.pushedBlob(repo, blob))
+	images, blobs := journal.counts()
+	assert.Equal(t, 1, images)
+	assert.Equal(t, 1, blobs)
+
+	// The journal of another bundle is not resumed
+	assert.NoError(t, os.Chtimes(tarballPath, time.Now(), time.Now().Add(time.Hour)))
+	journal, err = openLoadJournal(outputDir, tarballPath, false)
+	assert.NoError(t, err)
+	assert.False(t, journal.resumed)
+	assert.False(t, journal.pushedImage(iUri, "sha256:1234"))
+}
@@ -2,8 +2,12 @@ package cmd
 
 import (
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,7 +19,7 @@ func TestCommandLoad(t *testing.T) {
 		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 -a custom/loadimages --output "+LOAD_TEST_ARCHIVE)
 		assert.NoError(t, err)
 		expectedSaveOutput := `Pulling image: docker.io/alpine/curl:8.9.1
-Pulling image: docker.io/busybox:1.36.1
+Pulling image: docker.io/library/busybox:1.36.1
 Tarball created successfully: image-load.tar.zst`
 		assert.Equal(t, expectedSaveOutput, output)
 
@@ -49,7 +53,8 @@ Tarball created successfully: image-load.tar.zst`
 		output, err := executeCommand(rootCmd, "load "+LOAD_TEST_ARCHIVE+" -r localhost:5000 --insecure")
 		assert.NoError(t, err)
 		expectedLoadOutput := `Successfully pushed image localhost:5000/alpine/curl:8.9.1
-Successfully pushed image localhost:5000/busybox:1.36.1`
+Successfully pushed image localhost:5000/busybox:1.36.1
+Summary: 2 pushed, 0 already in the registry, 0 failed`
 		assert.Equal(t, expectedLoadOutput, output)
 	})
 
@@ -59,7 +64,8 @@ Successfully pushed image localhost:5000/busybox:1.36.1`
 		output, err := executeCommand(rootCmd, "load "+LOAD_TEST_ARCHIVE+" -r localhost:5000 --ca-cert ../tests/registry/certs/ca.crt --overwrite")
 		assert.NoError(t, err)
 		expectedLoadOutput := `Successfully pushed image localhost:5000/alpine/curl:8.9.1
-Successfully pushed image localhost:5000/busybox:1.36.1`
+Successfully pushed image localhost:5000/busybox:1.36.1
+Summary: 2 pushed, 0 already in the registry, 0 failed`
 		assert.Equal(t, expectedLoadOutput, output)
 	})
 
@@ -67,7 +73,8 @@ Successfully pushed image localhost:5000/busybox:1.36.1`
 		output, err := executeCommand(rootCmd, "load "+LOAD_TEST_ARCHIVE+" -r ttl.sh --prefix prefix --suffix suffix --overwrite")
 		assert.NoError(t, err)
 		expectedLoadOutput := `Successfully pushed image ttl.sh/prefix/alpine/suffix/curl:8.9.1
-Successfully pushed image ttl.sh/prefix/suffix/busybox:1.36.1`
+Successfully pushed image ttl.sh/prefix/suffix/busybox:1.36.1
+Summary: 2 pushed, 0 already in the registry, 0 failed`
 		assert.Equal(t, expectedLoadOutput, output)
 	})
 
@@ -77,7 +84,8 @@ Successfully pushed image ttl.sh/prefix/suffix/busybox:1.36.1`
 		expectedLoadOutput := `image localhost:5000/alpine/curl:8.9.1 already exists in the registry
 Successfully pushed image localhost:5000/alpine/curl:8.9.1
 image localhost:5000/busybox:1.36.1 already exists in the registry
-Successfully pushed image localhost:5000/busybox:1.36.1`
+Successfully pushed image localhost:5000/busybox:1.36.1
+Summary: 0 pushed, 2 already in the registry, 0 failed`
 		assert.Equal(t, expectedLoadOutput, output)
 	})
 
@@ -102,6 +110,32 @@ Successfully pushed image localhost:5000/busybox:1.36.1`
 		if err != nil {
 			t.Fatalf("Failed to remove file: %v", err)
 		}
+		assert.NoError(t, os.Remove(checksumFile(LOAD_TEST_ARCHIVE)))
 	})
 
 }
+
+func TestCheckRebuiltDigest(t *testing.T) {
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	digestFn := func() (v1.Hash, error) { return digest, nil }
+	pinned := "sha256:" + strings.Repeat("b", 64)
+
+	iUri, err := image_uri.NewDockerUri("registry.example.com/app:1@" + pinned)
+	assert.NoError(t, err)
+	var buf strings.Builder
+	cmd := &cobra.Command{}
+	cmd.SetOut(&buf)
+	err = checkRebuiltDigest(&iUri, digestFn, false, cmd)
+	assert.EqualError(t, err, "digest of image registry.example.com/app is "+digest.String()+" instead of the pinned "+pinned+", use --allow-digest-change to push it anyway")
+	assert.Equal(t, pinned, iUri.Digest)
+
+	err = checkRebuiltDigest(&iUri, digestFn, true, cmd)
+	assert.NoError(t, err)
+	assert.Equal(t, digest.String(), iUri.Digest)
+	assert.Equal(t, "Warning: digest of image registry.example.com/app changed from "+pinned+" to "+digest.String()+"\n", buf.String())
+
+	// Images without pinned digest are pushed by the one they have
+	iUri, err = image_uri.NewDockerUri("registry.example.com/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, checkRebuiltDigest(&iUri, digestFn, false, cmd))
+}
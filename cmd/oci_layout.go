@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+
+	// refNameAnnotation holds the full reference of an image, as used by skopeo
+	// and crane, so that images of different repositories sharing a tag are
+	// told apart. The referrers keep the tag cosign attached them with.
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+	// imageNameAnnotation holds the full reference of an image, as used by containerd
+	imageNameAnnotation = "io.containerd.image.name"
+	// sourceImageAnnotation holds the reference a retagged image was pulled from
+	sourceImageAnnotation = "com.datarobot.image.source"
+	// imagePathAnnotation holds the repository path and tag an image is loaded
+	// to, when it differs from the one of its containerd annotation
+	imagePathAnnotation = "com.datarobot.image.path"
+	// referrerAnnotation holds the digest of the image a referrer is attached to
+	referrerAnnotation = "com.datarobot.image.referrer"
+)
+
+// writeOCILayout writes the oci-layout and index.json files describing the
+// manifests saved in the blobs directory of the bundle.
+func writeOCILayout(w bundleWriter, manifests []ImageManifest) error {
+	index := v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{},
+	}
+	for _, manifest := range manifests {
+		iUri, err := image_uri.NewDockerUri(manifest.OriginalImage)
+		if err != nil {
+			return err
+		}
+		digest, err := v1.NewHash(manifest.Digest)
+		if err != nil {
+			return fmt.Errorf("error parsing digest of %s: %v", manifest.OriginalImage, err)
+		}
+		size, err := w.Size(manifest.ManifestFile)
+		if err != nil {
+			return fmt.Errorf("error reading manifest file: %v", err)
+		}
+
+		annotations := map[string]string{
+			imageNameAnnotation: iUri.TagRef(),
+			refNameAnnotation:   iUri.TagRef(),
+		}
+		if manifest.SourceImage != "" {
+			annotations[sourceImageAnnotation] = manifest.SourceImage
+		}
+		if manifest.ImageName != "" && manifest.ImageName != iUri.RefName() {
+			annotations[imagePathAnnotation] = manifest.ImageName
+		}
+		index.Manifests = append(index.Manifests, v1.Descriptor{
+			MediaType:   types.MediaType(manifest.MediaType),
+			Digest:      digest,
+			Size:        size,
+			Annotations: annotations,
+		})
+
+		for _, referrer := range manifest.Referrers {
+			desc, err := ociReferrerDescriptor(w, referrer, manifest.Digest)
+			if err != nil {
+				return err
+			}
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+
+	rawIndex, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding index: %v", err)
+	}
+	err = w.WriteFile(ociIndexFile, rawIndex)
+	if err != nil {
+		return fmt.Errorf("error writing index: %v", err)
+	}
+
+	err = w.WriteFile(ociLayoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	if err != nil {
+		return fmt.Errorf("error writing oci-layout file: %v", err)
+	}
+	return nil
+}
+
+// ociReferrerDescriptor describes a referrer in the index.json, annotated with
+// the digest of its image and the tag cosign attached it with.
+func ociReferrerDescriptor(w bundleWriter, referrer ImageManifest, subject string) (v1.Descriptor, error) {
+	digest, err := v1.NewHash(referrer.Digest)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("error parsing digest of referrer of %s: %v", subject, err)
+	}
+	size, err := w.Size(referrer.ManifestFile)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("error reading manifest file: %v", err)
+	}
+	annotations := map[string]string{referrerAnnotation: subject}
+	if referrer.Tag != "" {
+		annotations[refNameAnnotation] = referrer.Tag
+	}
+	return v1.Descriptor{
+		MediaType:   types.MediaType(referrer.MediaType),
+		Digest:      digest,
+		Size:        size,
+		Annotations: annotations,
+	}, nil
+}
+
+// isOCILayout reports whether the bundle is an OCI image layout.
+func isOCILayout(source bundleSource) bool {
+	_, err := source.ReadFile(ociLayoutFile)
+	return err == nil
+}
+
+// readOCILayout describes every image referenced by the index.json of an OCI
+// image layout. Images are named after their containerd annotation, or their
+// ref name when it holds a full reference. Referrers are attached to the image
+// their annotation points to.
+func readOCILayout(source bundleSource) ([]ImageManifest, error) {
+	rawIndex, err := source.ReadFile(ociIndexFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %v", err)
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(rawIndex))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding index: %v", err)
+	}
+
+	var manifests []ImageManifest
+	referrers := make(map[string][]ImageManifest)
+	for _, desc := range index.Manifests {
+		if subject, ok := desc.Annotations[referrerAnnotation]; ok {
+			referrer, err := readOCIManifest(source, desc)
+			if err != nil {
+				return nil, err
+			}
+			referrer.Tag = desc.Annotations[refNameAnnotation]
+			referrers[subject] = append(referrers[subject], referrer)
+			continue
+		}
+
+		ref := desc.Annotations[imageNameAnnotation]
+		if ref == "" && strings.Contains(desc.Annotations[refNameAnnotation], "/") {
+			ref = desc.Annotations[refNameAnnotation]
+		}
+		if ref == "" {
+			return nil, fmt.Errorf("manifest %s has no image reference in its %s or %s annotation", desc.Digest, imageNameAnnotation, refNameAnnotation)
+		}
+		iUri, err := image_uri.NewDockerUri(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest, err := readOCIManifest(source, desc)
+		if err != nil {
+			return nil, err
+		}
+		manifest.ImageName = iUri.RefName()
+		if imagePath := desc.Annotations[imagePathAnnotation]; imagePath != "" {
+			manifest.ImageName = imagePath
+		}
+		manifest.OriginalImage = iUri.String()
+		manifest.SourceImage = desc.Annotations[sourceImageAnnotation]
+		manifests = append(manifests, manifest)
+	}
+	for idx := range manifests {
+		manifests[idx].Referrers = referrers[manifests[idx].Digest]
+	}
+	return manifests, nil
+}
+
+// readOCIManifest describes an image or an index stored in the blobs of an OCI
+// image layout.
+func readOCIManifest(source bundleSource, desc v1.Descriptor) (ImageManifest, error) {
+	manifestFile := formatOCILayout.manifestFile(desc.Digest)
+	raw, err := source.ReadFile(manifestFile)
+	if err != nil {
+		return ImageManifest{}, fmt.Errorf("error reading manifest %s: %v", desc.Digest, err)
+	}
+
+	manifest := ImageManifest{
+		ManifestFile: manifestFile,
+		Digest:       desc.Digest.String(),
+		MediaType:    string(desc.MediaType),
+	}
+	if desc.Platform != nil {
+		manifest.Platform = desc.Platform.String()
+	}
+
+	switch {
+	case desc.MediaType.IsIndex():
+		index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+		if err != nil {
+			return ImageManifest{}, fmt.Errorf("error decoding index %s: %v", desc.Digest, err)
+		}
+		for _, child := range index.Manifests {
+			if !child.MediaType.IsImage() {
+				return ImageManifest{}, fmt.Errorf("unsupported nested manifest %s of type %s", child.Digest, child.MediaType)
+			}
+			childManifest, err := readOCIManifest(source, child)
+			if err != nil {
+				return ImageManifest{}, err
+			}
+			manifest.Manifests = append(manifest.Manifests, childManifest)
+		}
+	case desc.MediaType.IsImage():
+		parsed, err := v1.ParseManifest(bytes.NewReader(raw))
+		if err != nil {
+			return ImageManifest{}, fmt.Errorf("error decoding manifest %s: %v", desc.Digest, err)
+		}
+		manifest.ConfigFile = formatOCILayout.configFile(parsed.Config.Digest)
+		for _, layer := range parsed.Layers {
+			manifest.Layers = append(manifest.Layers, layer.Digest.Hex)
+		}
+	default:
+		return ImageManifest{}, fmt.Errorf("unsupported manifest %s of type %s", desc.Digest, desc.MediaType)
+	}
+	return manifest, nil
+}
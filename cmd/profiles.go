@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/render_helper"
+	"sigs.k8s.io/yaml"
+)
+
+// valuesProfilesConfig is the file given with --profiles, listing the values
+// the chart is rendered with:
+//
+//	profiles:
+//	  - name: default
+//	  - name: gpu
+//	    values:
+//	      - values-gpu.yaml
+//	    set:
+//	      - gpu.enabled=true
+type valuesProfilesConfig struct {
+	Profiles []valuesProfile `json:"profiles"`
+}
+
+// valuesProfile is a named combination of values files and --set values.
+type valuesProfile struct {
+	Name       string   `json:"name"`
+	ValueFiles []string `json:"values"`
+	Values     []string `json:"set"`
+}
+
+// loadValuesProfiles returns the profiles of the given file, which are
+// rendered with the values given on the command line first. Without file the
+// chart is rendered once with the values of the command line.
+func loadValuesProfiles(file string, valueFiles []string, values []string) ([]valuesProfile, error) {
+	if file == "" {
+		return []valuesProfile{{ValueFiles: valueFiles, Values: values}}, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading profiles %s: %v", file, err)
+	}
+	var config valuesProfilesConfig
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing profiles %s: %v", file, err)
+	}
+	if len(config.Profiles) == 0 {
+		return nil, fmt.Errorf("Error profiles %s: no profile", file)
+	}
+
+	var profiles []valuesProfile
+	for _, profile := range config.Profiles {
+		if profile.Name == "" {
+			return nil, fmt.Errorf("Error profiles %s: every profile must have a name", file)
+		}
+		for _, p := range profiles {
+			if p.Name == profile.Name {
+				return nil, fmt.Errorf("Error profiles %s: duplicated profile %s", file, profile.Name)
+			}
+		}
+		// Values files are relative to the profiles file
+		profileValueFiles := append([]string{}, valueFiles...)
+		for _, valueFile := range profile.ValueFiles {
+			if !filepath.IsAbs(valueFile) && !strings.Contains(valueFile, "://") {
+				valueFile = filepath.Join(filepath.Dir(file), valueFile)
+			}
+			profileValueFiles = append(profileValueFiles, valueFile)
+		}
+		profiles = append(profiles, valuesProfile{
+			Name:       profile.Name,
+			ValueFiles: profileValueFiles,
+			Values:     append(append([]string{}, values...), profile.Values...),
+		})
+	}
+	return profiles, nil
+}
+
+// profileImages are the images of the manifests of a chart rendered with a
+// profile, in the order of the templates. The indirect images are the ones not
+// run by any container.
+type profileImages struct {
+	Profile        string
+	Images         []string
+	IndirectImages []string
+}
+
+// renderProfileImages renders the chart with the values of the profile and
+// returns the images of its manifests.
+func renderProfileImages(chartPath string, profile valuesProfile, imagePaths []resourceImagePaths, indirectRegistries []string, debug bool) (profileImages, error) {
+	result := profileImages{Profile: profile.Name}
+	manifest, err := render_helper.RenderChart(chartPath, profile.ValueFiles, profile.Values)
+	if err != nil {
+		if profile.Name != "" {
+			return result, fmt.Errorf("Error loading chart %s with profile %s: %v", chartPath, profile.Name, err)
+		}
+		return result, fmt.Errorf("Error loading chart %s: %v", chartPath, err)
+	}
+
+	var indirectImages []string
+	for _, template := range strings.Split(manifest, "\n---\n") {
+		if debug {
+			fmt.Printf("---\n%s\n", template)
+		}
+
+		manifestImages, err := ExtractImagesFromManifest(template, imagePaths)
+		if err != nil {
+			return result, fmt.Errorf("Error ExtractImagesFromManifest chart: %v", err)
+		}
+		for _, image := range manifestImages {
+			if !SliceHas(result.Images, image) {
+				result.Images = append(result.Images, image)
+			}
+		}
+
+		templateIndirectImages, err := ExtractIndirectImagesFromManifest(template, indirectRegistries)
+		if err != nil {
+			return result, fmt.Errorf("Error ExtractIndirectImagesFromManifest chart: %v", err)
+		}
+		indirectImages = append(indirectImages, templateIndirectImages...)
+	}
+
+	for _, image := range indirectImages {
+		if !SliceHas(result.Images, image) && !SliceHas(result.IndirectImages, image) {
+			result.IndirectImages = append(result.IndirectImages, image)
+		}
+	}
+	sort.Strings(result.IndirectImages)
+	return result, nil
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadValuesProfiles(t *testing.T) {
+	profiles, err := loadValuesProfiles("", []string{"values.yaml"}, []string{"a=1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []valuesProfile{{ValueFiles: []string{"values.yaml"}, Values: []string{"a=1"}}}, profiles)
+
+	profiles, err = loadValuesProfiles("../tests/charts/test-chart7/ci/profiles.yaml", []string{"values.yaml"}, []string{"a=1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []valuesProfile{
+		{Name: "default", ValueFiles: []string{"values.yaml"}, Values: []string{"a=1"}},
+		{Name: "gpu", ValueFiles: []string{"values.yaml", "../tests/charts/test-chart7/ci/gpu-values.yaml"}, Values: []string{"a=1"}},
+		{Name: "legacy", ValueFiles: []string{"values.yaml"}, Values: []string{"a=1", "legacy.enabled=true"}},
+	}, profiles)
+
+	for name, content := range map[string]string{
+		"no profile":                     "profiles: []\n",
+		"every profile must have a name": "profiles:\n  - set: [a=1]\n",
+		"duplicated profile gpu":         "profiles:\n  - name: gpu\n  - name: gpu\n",
+		`unknown field "value"`:          "profiles:\n  - name: gpu\n    value: [gpu.yaml]\n",
+	} {
+		file := filepath.Join(t.TempDir(), "profiles.yaml")
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0644))
+		_, err := loadValuesProfiles(file, nil, nil)
+		assert.ErrorContains(t, err, name)
+	}
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// cosignTagSuffixes are the suffixes of the tags cosign attaches signatures,
+// attestations and SBOMs to, e.g. sha256-<hex>.sig next to the image.
+var cosignTagSuffixes = []string{"sig", "att", "sbom"}
+
+// imageReferrer is a signature, SBOM or attestation attached to an image. The
+// ones attached with the tag scheme of cosign keep their tag, OCI 1.1
+// referrers point to the image with the subject of their manifest.
+type imageReferrer struct {
+	image v1.Image
+	tag   string
+}
+
+// findReferrers lists the artifacts attached to an image, with the referrers
+// API, its fallback tag for registries without it, and the tags of cosign.
+// Referrers which are not image manifests are skipped.
+func findReferrers(subject name.Digest, options ...remote.Option) ([]imageReferrer, error) {
+	var referrers []imageReferrer
+	found := make(map[string]int)
+
+	index, err := remote.Referrers(subject, options...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing referrers of %s: %v", subject, err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error listing referrers of %s: %v", subject, err)
+	}
+	for _, desc := range indexManifest.Manifests {
+		if !desc.MediaType.IsImage() || found[desc.Digest.String()] > 0 {
+			continue
+		}
+		image, err := remote.Image(subject.Context().Digest(desc.Digest.String()), options...)
+		if err != nil {
+			return nil, fmt.Errorf("error pulling referrer %s: %v", desc.Digest, err)
+		}
+		referrers = append(referrers, imageReferrer{image: image})
+		found[desc.Digest.String()] = len(referrers)
+	}
+
+	digest, err := v1.NewHash(subject.DigestStr())
+	if err != nil {
+		return nil, err
+	}
+	for _, suffix := range cosignTagSuffixes {
+		tag := subject.Context().Tag(fmt.Sprintf("%s-%s.%s", digest.Algorithm, digest.Hex, suffix))
+		image, err := remote.Image(tag, options...)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error pulling referrer %s: %v", tag, err)
+		}
+		referrerDigest, err := image.Digest()
+		if err != nil {
+			return nil, err
+		}
+		// Cosign may also attach the same manifest with the referrers API
+		if idx := found[referrerDigest.String()]; idx > 0 {
+			referrers[idx-1].tag = tag.TagStr()
+			continue
+		}
+		referrers = append(referrers, imageReferrer{image: image, tag: tag.TagStr()})
+		found[referrerDigest.String()] = len(referrers)
+	}
+	return referrers, nil
+}
+
+// pushReferrers pushes the referrers of an image to its repository, by tag for
+// the ones cosign attached by tag and by digest otherwise. Pushing an OCI 1.1
+// referrer updates the fallback tag of registries without the referrers API.
+func pushReferrers(repo name.Repository, referrers []imageReferrer, options ...remote.Option) error {
+	for _, referrer := range referrers {
+		var ref name.Reference
+		if referrer.tag != "" {
+			ref = repo.Tag(referrer.tag)
+		} else {
+			digest, err := referrer.image.Digest()
+			if err != nil {
+				return err
+			}
+			ref = repo.Digest(digest.String())
+		}
+		err := remote.Write(ref, referrer.image, options...)
+		if err != nil {
+			return fmt.Errorf("error pushing referrer %s: %v", ref, err)
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether a registry request failed because the manifest
+// does not exist.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// pushTestReferrers pushes an image with a cosign signature attached by tag and
+// an SBOM attached with its subject, and returns the digest of each of them.
+func pushTestReferrers(t *testing.T, host string) (v1.Hash, v1.Hash, v1.Hash) {
+	image, err := random.Image(512, 1)
+	assert.NoError(t, err)
+	ref, err := name.ParseReference(host + "/src/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, image))
+	digest, err := image.Digest()
+	assert.NoError(t, err)
+
+	signature, err := random.Image(128, 1)
+	assert.NoError(t, err)
+	signatureTag := ref.Context().Tag("sha256-" + digest.Hex + ".sig")
+	assert.NoError(t, remote.Write(signatureTag, signature))
+	signatureDigest, err := signature.Digest()
+	assert.NoError(t, err)
+
+	subject, err := partial.Descriptor(image)
+	assert.NoError(t, err)
+	sbom, err := random.Image(128, 1)
+	assert.NoError(t, err)
+	sbom = mutate.ConfigMediaType(mutate.MediaType(sbom, types.OCIManifestSchema1), types.OCIConfigJSON)
+	sbom = mutate.Subject(sbom, *subject).(v1.Image)
+	sbomDigest, err := sbom.Digest()
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref.Context().Digest(sbomDigest.String()), sbom))
+	return digest, signatureDigest, sbomDigest
+}
+
+func TestFindReferrers(t *testing.T) {
+	for _, referrersAPI := range []bool{true, false} {
+		server := httptest.NewServer(registry.New(registry.WithReferrersSupport(referrersAPI)))
+		defer server.Close()
+		host := strings.TrimPrefix(server.URL, "http://")
+		digest, signatureDigest, sbomDigest := pushTestReferrers(t, host)
+
+		subject, err := name.NewDigest(host + "/src/app@" + digest.String())
+		assert.NoError(t, err)
+		referrers, err := findReferrers(subject)
+		assert.NoError(t, err)
+		assert.Len(t, referrers, 2)
+		found := make(map[v1.Hash]string)
+		for _, referrer := range referrers {
+			referrerDigest, err := referrer.image.Digest()
+			assert.NoError(t, err)
+			found[referrerDigest] = referrer.tag
+		}
+		assert.Equal(t, map[v1.Hash]string{
+			sbomDigest:      "",
+			signatureDigest: "sha256-" + digest.Hex + ".sig",
+		}, found)
+
+		// Referrers are recreated in another repository
+		repo, err := name.NewRepository(host + "/dst/app")
+		assert.NoError(t, err)
+		assert.NoError(t, pushReferrers(repo, referrers))
+		_, err = remote.Head(repo.Tag("sha256-" + digest.Hex + ".sig"))
+		assert.NoError(t, err)
+		index, err := remote.Referrers(repo.Digest(digest.String()))
+		assert.NoError(t, err)
+		indexManifest, err := index.IndexManifest()
+		assert.NoError(t, err)
+		assert.Len(t, indexManifest.Manifests, 1)
+		assert.Equal(t, sbomDigest, indexManifest.Manifests[0].Digest)
+	}
+}
+
+func TestSaveLoadReferrers(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.WithReferrersSupport(true)))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	digest, signatureDigest, sbomDigest := pushTestReferrers(t, host)
+
+	for _, format := range []bundleFormat{formatNative, formatOCILayout} {
+		t.Run(string(format), func(t *testing.T) {
+			outputDir := t.TempDir()
+			for _, dir := range format.dirs() {
+				assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+			}
+			var buf strings.Builder
+			cmd := &cobra.Command{}
+			cmd.SetOut(&buf)
+			c := saveConfig{Format: string(format), IncludeReferrers: true}
+			declaration := chartutil.DatarobotImageDeclaration{Image: host + "/src/app:1"}
+			manifest, err := exportDeclaration(declaration, c, dirWriter(outputDir), format, newBlobSet(), newSyncPrinter(cmd))
+			assert.NoError(t, err)
+			assert.Len(t, manifest.Referrers, 2)
+			assert.Contains(t, buf.String(), "Saving 2 referrers of image: "+host+"/src/app:1\n")
+			assert.NoError(t, writeBundleManifest(dirWriter(outputDir), format, []ImageManifest{manifest}))
+
+			source := dirSource(outputDir)
+			manifests, readFormat, err := readBundleManifests(source)
+			assert.NoError(t, err)
+			assert.Equal(t, format, readFormat)
+			assert.Equal(t, manifest.Referrers, manifests[0].Referrers)
+
+			l := loadConfig{RegistryHost: host, ImagePrefix: "dst-" + string(format), RetryAttempts: 1, format: format}
+			iUri, err := targetUri(manifests[0], l)
+			assert.NoError(t, err)
+			push, err := prepareImagePush(manifests[0], iUri, l, source, newSyncPrinter(cmd))
+			assert.NoError(t, err)
+			assert.NoError(t, push.run(l, newBlobUploads(), nil, newSyncPrinter(cmd)))
+			assert.Contains(t, buf.String(), "Pushed 2 referrers of image "+iUri.String()+"\n")
+
+			desc, err := remote.Head(push.repo.Tag("sha256-" + digest.Hex + ".sig"))
+			assert.NoError(t, err)
+			assert.Equal(t, signatureDigest, desc.Digest)
+			index, err := remote.Referrers(push.repo.Digest(digest.String()))
+			assert.NoError(t, err)
+			indexManifest, err := index.IndexManifest()
+			assert.NoError(t, err)
+			assert.Len(t, indexManifest.Manifests, 1)
+			assert.Equal(t, sbomDigest, indexManifest.Manifests[0].Digest)
+		})
+	}
+}
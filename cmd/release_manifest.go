@@ -23,6 +23,7 @@ type releaseManifestImage struct {
 	Source string            `yaml:"source"`
 	Name   string            `yaml:"name"`
 	Tag    string            `yaml:"tag"`
+	Digest string            `yaml:"digest,omitempty"`
 	Labels map[string]string `yaml:"labels,omitempty"`
 }
 
@@ -42,6 +43,7 @@ func getReleaseManifest(images []chartutil.DatarobotImageDeclaration, skipDuplic
 			Source: iUri.String(),
 			Name:   iUri.Base(),
 			Tag:    imageTag,
+			Digest: iUri.Digest,
 		}
 
 		if len(addLabels) > 0 || addAllLabels {
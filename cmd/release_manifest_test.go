@@ -47,8 +47,8 @@ func TestCommandReleaseManifest(t *testing.T) {
     name: docker.io/alpine/curl
     tag: stable
   test-image30.tar.zst:
-    source: docker.io/busybox:1.36.1
-    name: docker.io/busybox
+    source: docker.io/library/busybox:1.36.1
+    name: docker.io/library/busybox
     tag: simple
   test-image31.tar.zst:
     source: docker.io/alpine/curl:8.10.0
@@ -67,6 +67,22 @@ func TestCommandReleaseManifest(t *testing.T) {
     tag: 4.0.0`
 		assert.Equal(t, expectedOutput, output)
 	})
+	t.Run("digest", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "release-manifest ../tests/charts/test-chart6 -a digest")
+		assert.NoError(t, err)
+		expectedOutput := `images:
+  busybox.tar.zst:
+    source: docker.io/library/busybox@sha256:2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e
+    name: docker.io/library/busybox
+    tag: ""
+    digest: sha256:2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e
+  curl.tar.zst:
+    source: docker.io/alpine/curl:8.9.1@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c
+    name: docker.io/alpine/curl
+    tag: stable
+    digest: sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c`
+		assert.Equal(t, expectedOutput, output)
+	})
 	t.Run("selected-labels", func(t *testing.T) {
 		output, err := executeCommand(rootCmd, "release-manifest ../tests/charts/test-chart6  -a bitnamilegacy -l org.opencontainers.image.title -l org.opencontainers.image.base.name ")
 		assert.NoError(t, err)
@@ -30,7 +30,12 @@ func resetSubCommandFlagValues(root *cobra.Command) {
 	for _, c := range root.Commands() {
 		c.Flags().VisitAll(func(f *pflag.Flag) {
 			if f.Changed {
-				f.Value.Set(f.DefValue)
+				// Setting a slice flag appends to it, its defaults are empty
+				if v, ok := f.Value.(pflag.SliceValue); ok {
+					v.Replace([]string{})
+				} else {
+					f.Value.Set(f.DefValue)
+				}
 				f.Changed = false
 			}
 		})
@@ -2,19 +2,26 @@ package cmd
 
 import (
 	"archive/tar"
+	"bytes"
+	"crypto"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/spf13/cobra"
 )
 
@@ -23,6 +30,22 @@ type ImageManifest struct {
 	Layers        []string `json:"layers"`
 	ConfigFile    string   `json:"config_file"`
 	OriginalImage string   `json:"original_image"`
+	// SourceImage is the reference the image was pulled from when it was
+	// retagged, OriginalImage holds the retagged reference
+	SourceImage string `json:"source_image,omitempty"`
+	// ManifestFile holds the raw manifest as pulled, so that load can push it
+	// byte-for-byte and keep Digest. Bundles without it are rebuilt on load.
+	ManifestFile string `json:"manifest_file,omitempty"`
+	Digest       string `json:"digest,omitempty"`
+	MediaType    string `json:"media_type,omitempty"`
+	// Platform and Manifests are set for multi-architecture images: the
+	// top-level entry describes the index and each child one platform image
+	Platform  string          `json:"platform,omitempty"`
+	Manifests []ImageManifest `json:"manifests,omitempty"`
+	// Referrers are the signatures, SBOMs and attestations attached to the
+	// image, Tag is set for the ones cosign attaches by tag
+	Referrers []ImageManifest `json:"referrers,omitempty"`
+	Tag       string          `json:"tag,omitempty"`
 }
 
 var saveCmd = &cobra.Command{
@@ -44,6 +67,107 @@ Tarball created successfully: images.tar.zst
 $ du -h images.tar.zst
 14M    images.tar.zst
 
+'''
+
+Use '--concurrency' to pull several images in parallel, the order of the images
+in the bundle does not depend on it.
+
+Images are exported to '--output-dir' before the tarball is created, only the files
+written there are archived and removed afterwards. With '--stream' the layers are
+written into the tarball as they are pulled and the manifest is appended at the end,
+nothing is written to '--output-dir'. Each layer is buffered in a temporary file next
+to the tarball while it is pulled, so that failed pulls are retried. Streaming is not
+available with '--format docker-archive'.
+
+Every archive is written with a '.sha256' file next to it, which 'load' checks and can
+also be checked with 'sha256sum -c images.tar.zst.sha256'.
+
+With '--sign-key', the '.sha256' file is signed to 'images.tar.zst.sha256.sig' and the
+manifest of the bundle is signed inside it, in the format of 'cosign sign-blob'. The key
+is an ed25519 or ECDSA PEM private key, or a key generated by 'cosign generate-key-pair'
+whose password is read from COSIGN_PASSWORD. 'load' and 'verify' check the signatures
+with '--public-key'.
+
+With '--include-referrers', the signatures, SBOMs and attestations attached to each image
+are saved with it and recreated by 'load': OCI 1.1 referrers, found with the referrers
+API or its 'sha256-<digest>' fallback tag, and the 'sha256-<digest>.sig', '.att' and
+'.sbom' tags of cosign. They are left out of multi-architecture images whose platforms
+are filtered with '--platform', since the digest they describe changes.
+
+With '--include-charts', the charts given to save are packaged into the bundle as
+'helm package' does, with the dependencies vendored in their 'charts' directory, so that
+both the images and the charts reach air-gapped installs. Charts given as '.tgz' archives
+are kept as they are. 'load' extracts them with '--charts-dir' or pushes them to the
+registry with '--push-charts':
+
+'''sh
+$ helm dependency build tests/charts/test-chart1/
+$ helm datarobot save tests/charts/test-chart1/ --include-charts
+'''
+
+With '--base', the bundle only holds what changed since a previous release: the layers and
+configs of the bundle, or of the images of the release manifest, given as base are left
+out and listed in 'delta.json' when every image using them is in a repository of the base
+which had them. 'load' checks that the target registry already has them, the base must be
+loaded first:
+
+'''sh
+$ helm datarobot save tests/charts/test-chart1/ --base images-1.0.tar.zst -o images-1.1-delta.tar.zst
+$ helm datarobot release-manifest tests/charts/test-chart1/ > release-1.0.yaml
+$ helm datarobot save tests/charts/test-chart1/ --base release-1.0.yaml -o images-1.1-delta.tar.zst
+'''
+
+With '--split-size', the tarball is written as volumes of at most that size, for media and
+upload portals limited in file size: 'images.tar.zst.001', 'images.tar.zst.002', ...
+They are listed in order, with their sha256, in 'images.tar.zst.sha256'. 'load', 'verify'
+and 'inspect' read them when given 'images.tar.zst', and report missing or corrupted
+volumes. Sizes use decimal units (K, M, G, T) or binary ones (Ki, Mi, Gi, Ti), so that
+'4G' volumes fit on FAT32:
+
+'''sh
+$ helm datarobot save tests/charts/test-chart1/ --split-size 4G -o images.tar.zst
+$ sha256sum -c images.tar.zst.sha256
+$ helm datarobot load images.tar.zst -r registry.example.com
+'''
+
+Pulls failing on network errors are retried '--retry-attempts' times, waiting
+'--retry-delay' seconds before the first retry and twice as long before each next one.
+When images still cannot be pulled, save lists them and creates no tarball. What was
+downloaded stays in '--output-dir', along with 'save-state.json', and is reused with
+'--resume': the blobs already there are checked against their digest and only the
+missing ones are pulled. '--allow-partial' creates the tarball without the images which could
+not be pulled instead, invalid image references and errors writing the bundle still fail
+the save:
+
+'''sh
+$ helm datarobot save tests/charts/test-chart1/ --retry-attempts 3
+$ helm datarobot save tests/charts/test-chart1/ --resume
+'''
+
+With '--format oci-layout' the tarball contains a standard OCI image layout
+('oci-layout', 'index.json' and 'blobs/sha256/...') which can also be read by
+tools like skopeo, crane or containerd once decompressed. Images are named in the layout
+with their full reference, tag or digest included:
+
+'''sh
+$ helm datarobot save tests/charts/test-chart1/ --format oci-layout
+$ mkdir bundle && tar --zstd -xf images.tar.zst -C bundle
+$ skopeo inspect oci:bundle:docker.io/datarobotdev/test-image1:1.0.0
+'''
+
+With '--format docker-archive' the output is an uncompressed 'docker save'
+compatible archive which can be imported with 'docker load' or 'podman load'.
+Multi-architecture images are saved for a single platform, linux/amd64 unless
+'--platform' is set. Images are loaded under their tag, those declared by digest
+only must be retagged with the 'tag' field of their declaration. With '--split'
+the output is a directory holding one archive per image:
+
+'''sh
+$ helm datarobot save tests/charts/test-chart1/ --format docker-archive -o images.tar
+$ docker load -i images.tar
+$ helm datarobot save tests/charts/test-chart1/ --format docker-archive --split -o images
+$ ls images
+datarobot_test-image1_1.0.0.tar  datarobot_test-image2_2.0.0.tar
 '''`, "'", "`", -1),
 	Args: cobra.MinimumNArgs(1), // Requires at least one argument (file path)
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -60,34 +184,110 @@ $ du -h images.tar.zst
 			return fmt.Errorf("Invalid compression level. Available options: fastest, default, better, best")
 		}
 
-		images, err := chartutil.ExtractImagesFromCharts(args, annotation)
-		if err != nil {
-			return fmt.Errorf("Error ExtractImagesFromCharts: %v", err)
+		format := bundleFormat(saveCfg.Format)
+		if format != formatNative && format != formatOCILayout && format != formatDockerArchive {
+			return fmt.Errorf("Invalid format. Available options: %s, %s, %s", formatNative, formatOCILayout, formatDockerArchive)
+		}
+		if saveCfg.Concurrency < 1 {
+			return fmt.Errorf("Invalid concurrency %d, it must be at least 1", saveCfg.Concurrency)
+		}
+		if saveCfg.Split && format != formatDockerArchive {
+			return fmt.Errorf("--split is only supported with --format %s", formatDockerArchive)
+		}
+		if saveCfg.Resume && saveCfg.Stream {
+			return fmt.Errorf("--resume is not supported with --stream")
+		}
+		if saveCfg.Stream && format == formatDockerArchive {
+			return fmt.Errorf("--stream is not supported with --format %s", formatDockerArchive)
+		}
+		if saveCfg.IncludeReferrers && format == formatDockerArchive {
+			return fmt.Errorf("--include-referrers is not supported with --format %s", formatDockerArchive)
+		}
+		if saveCfg.Base != "" && format == formatDockerArchive {
+			return fmt.Errorf("--base is not supported with --format %s", formatDockerArchive)
+		}
+		if saveCfg.IncludeCharts && format == formatDockerArchive {
+			return fmt.Errorf("--include-charts is not supported with --format %s", formatDockerArchive)
+		}
+		saveCfg.splitSize = 0
+		if saveCfg.SplitSize != "" {
+			if format == formatDockerArchive {
+				return fmt.Errorf("--split-size is not supported with --format %s", formatDockerArchive)
+			}
+			splitSize, err := parseSplitSize(saveCfg.SplitSize)
+			if err != nil {
+				return fmt.Errorf("Invalid split size %s, it must be a positive size such as 4G or 700M", saveCfg.SplitSize)
+			}
+			saveCfg.splitSize = splitSize
 		}
 
-		manifestFile := filepath.Join(saveCfg.OutputDir, "manifest.json")
+		saveCfg.Platforms = nil
+		for _, platform := range saveCfg.Platform {
+			p, err := v1.ParsePlatform(platform)
+			if err != nil {
+				return fmt.Errorf("Invalid platform %s: %v", platform, err)
+			}
+			saveCfg.Platforms = append(saveCfg.Platforms, *p)
+		}
+		if format == formatDockerArchive && len(saveCfg.Platforms) == 0 {
+			saveCfg.Platforms = []v1.Platform{defaultDockerArchivePlatform}
+		}
 
-		// Step 1: Export Layers and Save Configurations
-		_, manifests := exportLayersAndConfigs(images, saveCfg, cmd)
+		saveCfg.signer = nil
+		if saveCfg.SignKey != "" {
+			signer, err := loadSigningKey(saveCfg.SignKey)
+			if err != nil {
+				return fmt.Errorf("Error loading signing key: %v", err)
+			}
+			saveCfg.signer = signer
+		}
 
-		// Step 2: Save Manifest
-		err = saveManifest(manifestFile, manifests)
-		if err != nil {
-			return fmt.Errorf("Error saving manifest: %v\n", err)
+		saveCfg.baseBlobs = nil
+		if saveCfg.Base != "" {
+			blobs, digest, err := readBaseBlobs(saveCfg.Base)
+			if err != nil {
+				return fmt.Errorf("Error reading base: %v", err)
+			}
+			saveCfg.baseBlobs = blobs
+			saveCfg.baseDigest = digest
 		}
-		// Step 3: Create a Tarball
-		err = createTarball(saveCfg.Output, saveCfg.OutputDir, level)
+
+		images, err := chartutil.ExtractImagesFromCharts(args, annotation)
 		if err != nil {
-			return fmt.Errorf("Error creating tarball: %v\n", err)
+			return fmt.Errorf("Error ExtractImagesFromCharts: %v", err)
+		}
+		if format == formatDockerArchive {
+			err = checkDockerArchiveTags(images)
+			if err != nil {
+				return fmt.Errorf("Error saving docker archive: %v", err)
+			}
+		}
+
+		saveCfg.charts = nil
+		if saveCfg.IncludeCharts {
+			saveCfg.charts, err = packageCharts(args)
+			if err != nil {
+				return fmt.Errorf("Error packaging charts: %v", err)
+			}
 		}
 
-		err = os.RemoveAll(saveCfg.OutputDir)
+		if saveCfg.Stream {
+			err = streamSave(images, saveCfg, level, cmd)
+		} else {
+			err = exportSave(images, saveCfg, level, cmd)
+		}
 		if err != nil {
-			return fmt.Errorf("Error Tmp Folder: %v\n", err)
+			return err
 		}
 
 		if saveCfg.DryRun {
 			cmd.Printf("[Dry-Run] Tarball created successfully: %s\n", saveCfg.Output)
+		} else if saveCfg.splitSize > 0 {
+			volumes, err := findVolumes(saveCfg.Output)
+			if err != nil {
+				return err
+			}
+			cmd.Printf("Tarball created successfully: %s, split into %d volumes listed in %s\n", saveCfg.Output, len(volumes), checksumFile(saveCfg.Output))
 		} else {
 			cmd.Printf("Tarball created successfully: %s\n", saveCfg.Output)
 		}
@@ -96,12 +296,214 @@ $ du -h images.tar.zst
 	},
 }
 
+// exportSave exports the images to the output directory, then writes the
+// tarball from it. Only the files written by save are removed afterwards.
+func exportSave(images []chartutil.DatarobotImageDeclaration, c saveConfig, level zstd.EncoderLevel, cmd *cobra.Command) error {
+	format := bundleFormat(c.Format)
+	created, err := prepareExportDir(c.OutputDir, format, c.Resume)
+	if err != nil {
+		return err
+	}
+	c.state, err = openSaveState(c.OutputDir, c, created, c.Resume, newSyncPrinter(cmd))
+	if err != nil {
+		return fmt.Errorf("Error resuming save: %v", err)
+	}
+	writer := signBundle(dirWriter(c.OutputDir), format, c.signer)
+
+	// Step 1: Export Layers and Save Configurations
+	manifests, err := exportLayersAndConfigs(images, c, writer, cmd)
+	err = checkPartialSave(err, c, cmd)
+	if err != nil {
+		return err
+	}
+
+	// Step 2: Save Manifest
+	err = writeSaveDelta(writer, c, manifests, cmd)
+	if err == nil {
+		err = writeBundleCharts(writer, c.charts, cmd)
+	}
+	if err == nil {
+		err = writeBundleManifest(writer, format, manifests)
+	}
+	if err != nil {
+		return fmt.Errorf("Error saving manifest: %v\n", err)
+	}
+	// Step 3: Create a Tarball
+	if format == formatDockerArchive {
+		if !c.DryRun {
+			err = writeDockerArchives(c.Output, c.OutputDir, manifests, c.Split, c.signer, cmd)
+		}
+	} else {
+		err = createTarball(c.Output, c.OutputDir, format, level, c.splitSize)
+		if err == nil {
+			err = writeArchiveChecksum(c.Output, c.signer)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating tarball: %v\n", err)
+	}
+
+	err = removeExportDir(c.OutputDir, format, c.state.CreatedOutputDir)
+	if err != nil {
+		return fmt.Errorf("Error Tmp Folder: %v\n", err)
+	}
+	return nil
+}
+
+// streamSave writes the blobs into the tarball as they are pulled, the
+// manifest is appended once every image is exported.
+func streamSave(images []chartutil.DatarobotImageDeclaration, c saveConfig, level zstd.EncoderLevel, cmd *cobra.Command) error {
+	writer, err := newArchiveWriter(c.Output, level, c.splitSize)
+	if err != nil {
+		return fmt.Errorf("Error creating tarball: %v\n", err)
+	}
+
+	format := bundleFormat(c.Format)
+	bundle := signBundle(writer, format, c.signer)
+	manifests, err := exportLayersAndConfigs(images, c, bundle, cmd)
+	err = checkPartialSave(err, c, cmd)
+	if err != nil {
+		writer.Close()
+		removeArchive(c.Output)
+		return err
+	}
+	err = writeSaveDelta(bundle, c, manifests, cmd)
+	if err == nil {
+		err = writeBundleCharts(bundle, c.charts, cmd)
+	}
+	if err == nil {
+		err = writeBundleManifest(bundle, format, manifests)
+	}
+	err = firstError(err, writer.Close())
+	if err == nil {
+		err = writeArchiveChecksum(c.Output, c.signer)
+	}
+	if err != nil {
+		removeArchive(c.Output)
+		return fmt.Errorf("Error creating tarball: %v\n", err)
+	}
+	return nil
+}
+
+// checkPartialSave refuses to create the tarball when images could not be
+// saved, unless --allow-partial is set. Only the images which could not be
+// pulled are left out, any other error fails the save.
+func checkPartialSave(err error, c saveConfig, cmd *cobra.Command) error {
+	if err == nil {
+		return nil
+	}
+	var partialErr *partialSaveError
+	if !errors.As(err, &partialErr) {
+		return fmt.Errorf("Error saving images: %v", err)
+	}
+	if c.AllowPartial {
+		cmd.Printf("Warning: creating a partial tarball, %v\n", err)
+		return nil
+	}
+	if c.Stream {
+		return fmt.Errorf("Error saving images: %v, rerun with --allow-partial to save the others", err)
+	}
+	return fmt.Errorf("Error saving images: %v, rerun with --resume to continue or with --allow-partial to save the others", err)
+}
+
+// writeSaveDelta describes the blobs left out of a bundle saved with --base.
+func writeSaveDelta(w bundleWriter, c saveConfig, manifests []ImageManifest, cmd *cobra.Command) error {
+	if c.Base == "" {
+		return nil
+	}
+	delta := newBundleDelta(c.Base, c.baseDigest, c.baseBlobs, manifests)
+	cmd.Printf("Leaving out %d layers and configs of base %s\n", len(delta.Blobs), delta.Base)
+	return writeBundleDelta(w, delta)
+}
+
+// signBundle signs the manifest of the bundle when a signing key is given.
+func signBundle(w bundleWriter, format bundleFormat, key crypto.Signer) bundleWriter {
+	if key == nil {
+		return w
+	}
+	return &signingWriter{bundleWriter: w, key: key, manifestFile: format.manifestEntry()}
+}
+
+// writeBundleManifest writes the files describing the exported images.
+func writeBundleManifest(w bundleWriter, format bundleFormat, manifests []ImageManifest) error {
+	if format == formatOCILayout {
+		return writeOCILayout(w, manifests)
+	}
+	return saveManifest(w, manifests)
+}
+
+// prepareExportDir creates the directories the images are exported to. It
+// refuses an output directory already holding a bundle, so that removing the
+// export afterwards never deletes files save did not write, unless an
+// interrupted save is resumed. It returns whether the output directory itself
+// was created.
+func prepareExportDir(outputDir string, format bundleFormat, resume bool) (bool, error) {
+	_, err := os.Stat(outputDir)
+	created := os.IsNotExist(err)
+	_, err = os.Stat(filepath.Join(outputDir, saveStateFile))
+	if err == nil && !resume {
+		return false, fmt.Errorf("Error output directory %s holds an interrupted save, rerun with --resume to continue it", outputDir)
+	}
+	for _, entry := range format.entries() {
+		if resume {
+			break
+		}
+		_, err := os.Stat(filepath.Join(outputDir, entry))
+		if err == nil {
+			return false, fmt.Errorf("Error output directory %s already contains %s", outputDir, entry)
+		}
+	}
+	for _, dir := range format.dirs() {
+		err := os.MkdirAll(filepath.Join(outputDir, dir), 0755)
+		if err != nil {
+			return false, fmt.Errorf("Error creating output directory: %v", err)
+		}
+	}
+	return created, nil
+}
+
+// removeExportDir removes the files written by save from the output
+// directory, and the directory itself when save created it.
+func removeExportDir(outputDir string, format bundleFormat, created bool) error {
+	for _, entry := range append(format.entries(), saveStateFile) {
+		err := os.RemoveAll(filepath.Join(outputDir, entry))
+		if err != nil {
+			return err
+		}
+	}
+	if created {
+		return os.Remove(outputDir)
+	}
+	return nil
+}
+
 type saveConfig struct {
 	Output           string   `env:"OUTPUT"`
 	OutputDir        string   `env:"OUTPUT_DIR"`
 	CompressionLevel string   `env:"LEVEL"`
+	Format           string   `env:"FORMAT"`
 	ImageSkipGroup   []string `env:"IMAGE_SKIP_GROUP"`
+	Platform         []string `env:"PLATFORM"`
+	Concurrency      int      `env:"CONCURRENCY"`
+	Split            bool     `env:"SPLIT"`
+	Stream           bool     `env:"STREAM"`
+	SignKey          string   `env:"SIGN_KEY"`
+	IncludeReferrers bool     `env:"INCLUDE_REFERRERS"`
+	Base             string   `env:"BASE"`
+	SplitSize        string   `env:"SPLIT_SIZE"`
+	Resume           bool     `env:"RESUME"`
+	AllowPartial     bool     `env:"ALLOW_PARTIAL"`
+	IncludeCharts    bool     `env:"INCLUDE_CHARTS"`
+	RetryAttempts    int      `env:"RETRY_ATTEMPTS,default=1"` // number of retries for pulling images
+	RetryDelay       int      `env:"RETRY_DELAY,default=5"`    // in seconds, doubled after each retry
 	DryRun           bool     `env:"DRY_RUN"`
+	Platforms        []v1.Platform
+	signer           crypto.Signer
+	baseBlobs        baseBlobs
+	baseDigest       v1.Hash
+	splitSize        int64
+	state            *saveState
+	charts           []bundleChart
 }
 
 var saveCfg saveConfig
@@ -112,25 +514,100 @@ func init() {
 	saveCmd.Flags().StringVarP(&saveCfg.Output, "output", "o", "images.tar.zst", "file to save")
 	saveCmd.Flags().StringVarP(&saveCfg.OutputDir, "output-dir", "", "export", "file to save")
 	saveCmd.Flags().StringVarP(&saveCfg.CompressionLevel, "level", "l", "best", "zstd compression level (Available options: fastest, default, better, best)")
+	saveCmd.Flags().StringVarP(&saveCfg.Format, "format", "", string(formatNative), "bundle format (Available options: native, oci-layout, docker-archive)")
 	saveCmd.Flags().StringArrayVarP(&saveCfg.ImageSkipGroup, "skip-group", "", []string{}, "Specify which image group should be skipped (can be used multiple times)")
+	saveCmd.Flags().StringArrayVarP(&saveCfg.Platform, "platform", "", []string{}, "Specify which platform of multi-architecture images should be saved, e.g. linux/amd64 (can be used multiple times, default all platforms)")
+	saveCmd.Flags().IntVarP(&saveCfg.Concurrency, "concurrency", "", 1, "Number of images pulled in parallel")
+	saveCmd.Flags().BoolVarP(&saveCfg.Split, "split", "", false, "Write one docker archive per image in the output directory (requires --format docker-archive)")
+	saveCmd.Flags().BoolVarP(&saveCfg.Stream, "stream", "", false, "Write the images into the tarball as they are pulled instead of exporting them to --output-dir first")
+	saveCmd.Flags().StringVarP(&saveCfg.SignKey, "sign-key", "", "", "Path to an ed25519 or ECDSA private key (PEM or cosign) to sign the bundle with")
+	saveCmd.Flags().BoolVarP(&saveCfg.IncludeReferrers, "include-referrers", "", false, "Save the signatures, SBOMs and attestations attached to the images")
+	saveCmd.Flags().BoolVarP(&saveCfg.IncludeCharts, "include-charts", "", false, "Save the charts, packaged with their dependencies, in the bundle")
+	saveCmd.Flags().StringVarP(&saveCfg.Base, "base", "", "", "Bundle or release manifest of the previous release, its layers and configs are left out of the bundle")
+	saveCmd.Flags().StringVarP(&saveCfg.SplitSize, "split-size", "", "", "Split the tarball into volumes of at most this size (e.g. 4G, 700M, 1Gi)")
+	saveCmd.Flags().BoolVarP(&saveCfg.Resume, "resume", "", false, "Resume an interrupted save from --output-dir, keeping the images and blobs already downloaded")
+	saveCmd.Flags().BoolVarP(&saveCfg.AllowPartial, "allow-partial", "", false, "Create the tarball even when some images could not be saved")
+	saveCmd.Flags().IntVarP(&saveCfg.RetryAttempts, "retry-attempts", "", 1, "Number of retries for pulling images")
+	saveCmd.Flags().IntVarP(&saveCfg.RetryDelay, "retry-delay", "", 5, "Delay before the first retry in seconds, doubled after each retry")
 	saveCmd.Flags().BoolVarP(&saveCfg.DryRun, "dry-run", "", false, "Perform a dry run without making changes")
 }
 
-func exportLayersAndConfigs(images []chartutil.DatarobotImageDeclaration, c saveConfig, cmd *cobra.Command) (map[string]string, []ImageManifest) {
-	layerDir := filepath.Join(c.OutputDir, "layers")
-	configDir := filepath.Join(c.OutputDir, "configs")
+// partialSaveError names the images which could not be pulled.
+type partialSaveError struct {
+	failed []string
+	total  int
+}
 
-	// Create directories
-	os.MkdirAll(layerDir, 0755)
-	os.MkdirAll(configDir, 0755)
+func (e *partialSaveError) Error() string {
+	return fmt.Sprintf("%d of the %d images could not be saved: %s", len(e.failed), e.total, strings.Join(e.failed, ", "))
+}
 
-	layerFiles := make(map[string]string)
-	var manifests []ImageManifest
+// exportWriter keeps the first error of writing the bundle, which fails the
+// save, apart from the errors of reading the blobs being pulled.
+type exportWriter struct {
+	bundleWriter
+	mu  sync.Mutex
+	err error
+}
+
+func (w *exportWriter) WriteFile(path string, data []byte) error {
+	err := w.bundleWriter.WriteFile(path, data)
+	if err != nil {
+		w.fail(err)
+	}
+	return err
+}
+
+func (w *exportWriter) WriteStream(path string, size int64, r io.Reader) error {
+	pulled := &pullReader{Reader: r}
+	err := w.bundleWriter.WriteStream(path, size, pulled)
+	if err != nil && pulled.err == nil {
+		w.fail(err)
+	}
+	return err
+}
+
+func (w *exportWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = fmt.Errorf("error writing the bundle: %v", err)
+	}
+}
+
+func (w *exportWriter) failure() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// pullReader keeps the error of reading a blob being pulled.
+type pullReader struct {
+	io.Reader
+	err error
+}
+
+func (r *pullReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// exportLayersAndConfigs exports the images to w, failed pulls are retried.
+// It returns the images exported and a partialSaveError naming the ones which
+// could not be pulled, errors parsing the images or writing the bundle and
+// the save state are returned as they are.
+func exportLayersAndConfigs(images []chartutil.DatarobotImageDeclaration, c saveConfig, bundle bundleWriter, cmd *cobra.Command) ([]ImageManifest, error) {
+	format := bundleFormat(c.Format)
+	w := &exportWriter{bundleWriter: bundle}
 
+	var pending []chartutil.DatarobotImageDeclaration
 	for _, i := range images {
 		iUri, err := image_uri.NewDockerUri(i.Image)
 		if err != nil {
-			return nil, nil
+			return nil, err
 		}
 
 		if len(c.ImageSkipGroup) > 0 {
@@ -157,188 +634,536 @@ func exportLayersAndConfigs(images []chartutil.DatarobotImageDeclaration, c save
 			continue
 		}
 
-		cmd.Printf("Pulling image: %s\n", iUri.String())
+		pending = append(pending, i)
+	}
 
-		// Pull the image
-		image, err := crane.Pull(iUri.String())
+	// Images are exported by a pool of workers, each result is stored at the
+	// position of its image so that the manifest order does not depend on it
+	out := newSyncPrinter(cmd)
+	layers := newBlobSet()
+	layers.omit(c.baseBlobs)
+	layers.written(c.state.writtenFiles()...)
+	results := make([]*ImageManifest, len(pending))
+	stateErrs := make([]error, len(pending))
+	forEachConcurrently(len(pending), c.Concurrency, func(idx int) {
+		i := pending[idx]
+		if manifest, ok := c.state.exported(i, format); ok {
+			out.Printf("Image already saved: %s\n", manifest.OriginalImage)
+			results[idx] = &manifest
+			return
+		}
+		var manifest ImageManifest
+		err := pullWithRetry(c.RetryAttempts, c.RetryDelay, out, i.Image, func() error {
+			var err error
+			manifest, err = exportDeclaration(i, c, w, format, layers, out)
+			return err
+		})
 		if err != nil {
-			fmt.Printf("Error pulling image %s: %v\n", iUri.String(), err)
-			continue
+			out.Printf("Error saving image %s: %v\n", i.Image, err)
+			return
+		}
+		stateErrs[idx] = c.state.record(i, manifest)
+		results[idx] = &manifest
+	})
+	err := firstError(append([]error{w.failure()}, stateErrs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []ImageManifest
+	var failed []string
+	for idx, manifest := range results {
+		if manifest != nil {
+			manifests = append(manifests, *manifest)
+		} else {
+			failed = append(failed, pending[idx].Image)
 		}
+	}
+	if len(failed) > 0 {
+		return manifests, &partialSaveError{failed: failed, total: len(pending)}
+	}
+	return manifests, nil
+}
 
-		// Retrieve the configuration
-		configFile, err := image.ConfigFile()
+// exportDeclaration pulls and exports a single image declaration.
+func exportDeclaration(i chartutil.DatarobotImageDeclaration, c saveConfig, w bundleWriter, format bundleFormat, layers *blobSet, out printer) (ImageManifest, error) {
+	iUri, err := image_uri.NewDockerUri(i.Image)
+	if err != nil {
+		return ImageManifest{}, err
+	}
+
+	pulled := iUri.String()
+	out.Printf("Pulling image: %s\n", pulled)
+	written := iUri.AsWritten()
+	layers = layers.forRepository(imageRepository(written.RefName()))
+
+	// Get the descriptor, which can be either a single image or an index
+	desc, err := crane.Get(iUri.String())
+	if err != nil {
+		return ImageManifest{}, fmt.Errorf("error pulling image %s: %v", iUri.String(), err)
+	}
+
+	sourceImage := ""
+	if i.Tag != "" {
+		sourceImage = iUri.String()
+		iUri.Tag = i.Tag
+		out.Printf("ReTagging image: %s > %s\n", sourceImage, iUri.String())
+	}
+
+	var manifest ImageManifest
+	if desc.MediaType.IsIndex() {
+		manifest, err = exportIndex(desc, c.Platforms, w, format, layers)
 		if err != nil {
-			fmt.Printf("Error retrieving config for image %s: %v\n", iUri.String(), err)
-			continue
+			return ImageManifest{}, fmt.Errorf("error exporting index %s: %v", iUri.String(), err)
+		}
+		if iUri.Digest != "" && iUri.Digest != manifest.Digest {
+			out.Printf("Filtering platforms of %s changes its digest to %s\n", iUri.String(), manifest.Digest)
 		}
+	} else {
+		image, err := desc.Image()
+		if err != nil {
+			return ImageManifest{}, fmt.Errorf("error pulling image %s: %v", iUri.String(), err)
+		}
+		manifest, err = exportImage(image, w, format, layers)
+		if err != nil {
+			return ImageManifest{}, fmt.Errorf("error exporting image %s: %v", iUri.String(), err)
+		}
+	}
+	if c.IncludeReferrers {
+		manifest.Referrers, err = exportReferrers(pulled, desc.Digest, manifest.Digest, w, format, layers, out)
+		if err != nil {
+			return ImageManifest{}, fmt.Errorf("error exporting referrers of %s: %v", iUri.String(), err)
+		}
+	}
+	// The image is loaded to the path written in the chart, without the
+	// library namespace docker.io official images are normalized with
+	written = iUri.AsWritten()
+	manifest.ImageName = written.RefName()
+	manifest.OriginalImage = iUri.String()
+	manifest.SourceImage = sourceImage
+
+	return manifest, nil
+}
 
-		if i.Tag != "" {
-			oldName := iUri.String()
-			iUri.Tag = i.Tag
-			cmd.Printf("ReTagging image: %s > %s\n", oldName, iUri.String())
+// exportReferrers exports the signatures, SBOMs and attestations attached to
+// an image. They describe the image as pulled, so they are left out when
+// filtering platforms changed its digest.
+func exportReferrers(image string, pulledDigest v1.Hash, digest string, w bundleWriter, format bundleFormat, layers *blobSet, out printer) ([]ImageManifest, error) {
+	if pulledDigest.String() != digest {
+		out.Printf("Skipping referrers of %s, they do not match its filtered digest\n", image)
+		return nil, nil
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	subject := ref.Context().Digest(pulledDigest.String())
+	referrers, err := findReferrers(subject, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []ImageManifest
+	for _, referrer := range referrers {
+		manifest, err := exportImage(referrer.image, w, format, layers)
+		if err != nil {
+			return nil, err
 		}
+		manifest.Tag = referrer.tag
+		manifests = append(manifests, manifest)
+	}
+	if len(manifests) > 0 {
+		out.Printf("Saving %d referrers of image: %s\n", len(manifests), image)
+	}
+	return manifests, nil
+}
 
-		// Save the ConfigFile
-		configPath := filepath.Join(configDir, sanitizeFilename(iUri.String())+".config.json")
-		saveConfigFile(configPath, configFile)
+// exportIndex exports every child image of a multi-architecture index matching
+// one of the requested platforms (all of them when none is requested). The raw
+// index is kept as pulled unless platforms are filtered out of it.
+func exportIndex(desc *remote.Descriptor, platforms []v1.Platform, w bundleWriter, format bundleFormat, layers *blobSet) (ImageManifest, error) {
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return ImageManifest{}, err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return ImageManifest{}, err
+	}
+
+	rawIndex, descriptors, err := filterIndex(indexManifest, desc.Manifest, platforms)
+	if err != nil {
+		return ImageManifest{}, err
+	}
 
-		// Get the layers
-		layers, err := image.Layers()
+	var children []ImageManifest
+	for _, child := range descriptors {
+		image, err := index.Image(child.Digest)
 		if err != nil {
-			fmt.Printf("Error retrieving layers for image %s: %v\n", iUri.String(), err)
+			return ImageManifest{}, fmt.Errorf("error pulling manifest %s: %v", child.Digest, err)
+		}
+		childManifest, err := exportImage(image, w, format, layers)
+		if err != nil {
+			return ImageManifest{}, fmt.Errorf("error exporting manifest %s: %v", child.Digest, err)
+		}
+		if child.Platform != nil {
+			childManifest.Platform = child.Platform.String()
+		}
+		children = append(children, childManifest)
+	}
+
+	digest, _, err := v1.SHA256(bytes.NewReader(rawIndex))
+	if err != nil {
+		return ImageManifest{}, err
+	}
+	manifestFile := format.manifestFile(digest)
+	err = saveManifestBlob(w, layers, manifestFile, rawIndex)
+	if err != nil {
+		return ImageManifest{}, err
+	}
+
+	return ImageManifest{
+		ManifestFile: manifestFile,
+		Digest:       digest.String(),
+		MediaType:    string(desc.MediaType),
+		Manifests:    children,
+	}, nil
+}
+
+// filterIndex keeps the child manifests of an index matching one of the
+// requested platforms. The raw index is returned unchanged when nothing is
+// filtered out, so that its digest is preserved.
+func filterIndex(indexManifest *v1.IndexManifest, rawIndex []byte, platforms []v1.Platform) ([]byte, []v1.Descriptor, error) {
+	var descriptors []v1.Descriptor
+	for _, child := range indexManifest.Manifests {
+		if !matchPlatform(child.Platform, platforms) {
 			continue
 		}
+		if !child.MediaType.IsImage() {
+			return nil, nil, fmt.Errorf("unsupported nested manifest %s of type %s", child.Digest, child.MediaType)
+		}
+		descriptors = append(descriptors, child)
+	}
+
+	if len(descriptors) == 0 {
+		return nil, nil, fmt.Errorf("no manifest matches the requested platforms")
+	}
+	if len(descriptors) == len(indexManifest.Manifests) {
+		return rawIndex, descriptors, nil
+	}
+
+	filtered := indexManifest.DeepCopy()
+	filtered.Manifests = descriptors
+	raw, err := json.Marshal(filtered)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding filtered index: %v", err)
+	}
+	return raw, descriptors, nil
+}
 
-		var layerDigests []string
-		for idx, layer := range layers {
-			digest, err := layer.Digest()
+// exportImage saves the raw manifest, the raw config file and the layers of a
+// single image, manifests, configs and layers already present in blobs are not
+// written again and the ones blobs omits are left out.
+func exportImage(image v1.Image, w bundleWriter, format bundleFormat, blobs *blobSet) (ImageManifest, error) {
+	digest, err := image.Digest()
+	if err != nil {
+		return ImageManifest{}, fmt.Errorf("error computing digest: %v", err)
+	}
+	mediaType, err := image.MediaType()
+	if err != nil {
+		return ImageManifest{}, fmt.Errorf("error retrieving media type: %v", err)
+	}
+	rawManifest, err := image.RawManifest()
+	if err != nil {
+		return ImageManifest{}, fmt.Errorf("error retrieving manifest: %v", err)
+	}
+
+	// Retrieve the configuration exactly as it was pushed
+	configName, err := image.ConfigName()
+	if err != nil {
+		return ImageManifest{}, fmt.Errorf("error retrieving config digest: %v", err)
+	}
+
+	// Save the ConfigFile
+	configFile := format.configFile(configName)
+	if !blobs.omits(configName) {
+		err = blobs.write(configFile, func() error {
+			rawConfig, err := image.RawConfigFile()
 			if err != nil {
-				fmt.Printf("Error getting digest for layer %d of image %s: %v\n", idx+1, iUri.String(), err)
-				continue
+				return fmt.Errorf("error retrieving config: %v", err)
 			}
+			err = w.WriteFile(configFile, rawConfig)
+			if err != nil {
+				return fmt.Errorf("error writing config file: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return ImageManifest{}, err
+		}
+	}
 
-			layerFile := filepath.Join(layerDir, digest.Hex+".tar.gz")
-			layerDigests = append(layerDigests, digest.Hex)
+	manifestFile := format.manifestFile(digest)
+	err = saveManifestBlob(w, blobs, manifestFile, rawManifest)
+	if err != nil {
+		return ImageManifest{}, err
+	}
 
-			// If layer is already saved, skip
-			if _, exists := layerFiles[digest.Hex]; exists {
-				continue
-			}
+	// Get the layers
+	imageLayers, err := image.Layers()
+	if err != nil {
+		return ImageManifest{}, fmt.Errorf("error retrieving layers: %v", err)
+	}
+
+	var layerDigests []string
+	for idx, layer := range imageLayers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return ImageManifest{}, fmt.Errorf("error getting digest for layer %d: %v", idx+1, err)
+		}
 
-			// Save the layer content
+		layerFile := format.layerFile(digest)
+		layerDigests = append(layerDigests, digest.Hex)
+		if blobs.omits(digest) {
+			continue
+		}
+
+		// Layers shared between images are only saved once
+		err = blobs.write(layerFile, func() error {
+			size, err := layer.Size()
+			if err != nil {
+				return fmt.Errorf("error getting size for layer %d: %v", idx+1, err)
+			}
 			layerReader, err := layer.Compressed()
 			if err != nil {
-				fmt.Printf("Error reading layer %d for image %s: %v\n", idx+1, iUri.String(), err)
-				continue
+				return fmt.Errorf("error reading layer %d: %v", idx+1, err)
 			}
 			defer layerReader.Close()
-
-			saveLayerToFile(layerReader, layerFile)
-			layerFiles[digest.Hex] = layerFile
-		}
-
-		// Add metadata to the manifest
-		manifests = append(manifests, ImageManifest{
-			ImageName:     iUri.RefName(),
-			Layers:        layerDigests,
-			ConfigFile:    filepath.Join("configs", sanitizeFilename(iUri.String())+".config.json"),
-			OriginalImage: iUri.String(),
+			err = w.WriteStream(layerFile, size, layerReader)
+			if err != nil {
+				return fmt.Errorf("error writing layer %d: %v", idx+1, err)
+			}
+			return nil
 		})
+		if err != nil {
+			return ImageManifest{}, err
+		}
 	}
 
-	return layerFiles, manifests
+	return ImageManifest{
+		Layers:       layerDigests,
+		ConfigFile:   configFile,
+		ManifestFile: manifestFile,
+		Digest:       digest.String(),
+		MediaType:    string(mediaType),
+	}, nil
 }
 
-func saveConfigFile(filePath string, configFile *v1.ConfigFile) {
-	file, err := os.Create(filePath)
-	if err != nil {
-		fmt.Printf("Error creating config file %s: %v\n", filePath, err)
-		return
-	}
-	defer file.Close()
+// blobSet records the blobs written to a bundle, so that blobs shared between
+// images are written once even when images are exported concurrently.
+type blobSet struct {
+	mu    *sync.Mutex
+	blobs map[string]*blobWrite
+	// base and repository leave out the blobs the repository of the images
+	// had in the base of a delta bundle
+	base       baseBlobs
+	repository string
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(configFile)
-	if err != nil {
-		fmt.Printf("Error writing config file %s: %v\n", filePath, err)
+type blobWrite struct {
+	once sync.Once
+	err  error
+}
+
+func newBlobSet() *blobSet {
+	return &blobSet{mu: &sync.Mutex{}, blobs: make(map[string]*blobWrite)}
+}
+
+// omit leaves the blobs of a base out of the bundle, for the images of the
+// repositories which had them.
+func (s *blobSet) omit(base baseBlobs) {
+	s.base = base
+}
+
+// forRepository returns the blobs of the images of a repository, the written
+// blobs are shared with s.
+func (s *blobSet) forRepository(repository string) *blobSet {
+	scoped := *s
+	scoped.repository = repository
+	return &scoped
+}
+
+// omits reports whether the blob is left out of the bundle.
+func (s *blobSet) omits(blob v1.Hash) bool {
+	return s.base.has(blob, s.repository)
+}
+
+// written marks files as already written.
+func (s *blobSet) written(files ...string) {
+	for _, file := range files {
+		done := &blobWrite{}
+		done.once.Do(func() {})
+		s.blobs[file] = done
 	}
 }
 
-func saveLayerToFile(reader io.Reader, filePath string) {
-	file, err := os.Create(filePath)
-	if err != nil {
-		fmt.Printf("Error creating file %s: %v\n", filePath, err)
-		return
+// write calls save the first time a blob is seen, later calls wait for it to
+// complete and return its error. A failed blob is written again by the next
+// call, when its image is pulled again.
+func (s *blobSet) write(file string, save func() error) error {
+	s.mu.Lock()
+	blob, ok := s.blobs[file]
+	if !ok {
+		blob = &blobWrite{}
+		s.blobs[file] = blob
 	}
-	defer file.Close()
+	s.mu.Unlock()
 
-	io.Copy(file, reader)
+	blob.once.Do(func() {
+		blob.err = save()
+		if blob.err != nil {
+			s.mu.Lock()
+			delete(s.blobs, file)
+			s.mu.Unlock()
+		}
+	})
+	return blob.err
 }
 
-func saveManifest(filePath string, manifests []ImageManifest) error {
-	// fmt.Printf("Saving manifest to %s...\n", filePath)
+// saveManifestBlob writes a raw manifest or index to its path relative to the
+// bundle root, once when it is shared between images.
+func saveManifestBlob(w bundleWriter, blobs *blobSet, manifestFile string, raw []byte) error {
+	return blobs.write(manifestFile, func() error {
+		err := w.WriteFile(manifestFile, raw)
+		if err != nil {
+			return fmt.Errorf("error writing manifest file: %v", err)
+		}
+		return nil
+	})
+}
 
-	file, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("error creating manifest file: %v", err)
+// matchPlatform reports whether the platform satisfies any of the requested
+// platforms, an empty list matches everything.
+func matchPlatform(platform *v1.Platform, platforms []v1.Platform) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	if platform == nil {
+		return false
+	}
+	for _, p := range platforms {
+		if platform.Satisfies(p) {
+			return true
+		}
 	}
-	defer file.Close()
+	return false
+}
 
-	encoder := json.NewEncoder(file)
+func saveManifest(w bundleWriter, manifests []ImageManifest) error {
+	// fmt.Printf("Saving manifest to %s...\n", filePath)
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
 	encoder.SetIndent("", "  ")
-	err = encoder.Encode(manifests)
+	err := encoder.Encode(manifests)
 	if err != nil {
 		return fmt.Errorf("error writing manifest: %v", err)
 	}
+	err = w.WriteFile("manifest.json", buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("error creating manifest file: %v", err)
+	}
 
 	// fmt.Println("Manifest successfully saved.")
 	return nil
 }
 
-func createTarball(outputTarball string, inputDir string, level zstd.EncoderLevel) error {
+// createTarball archives the entries of the bundle written to inputDir, other
+// files of the directory are left out.
+func createTarball(outputTarball string, inputDir string, format bundleFormat, level zstd.EncoderLevel, splitSize int64) error {
 	// fmt.Printf("Creating tarball %s...\n", outputTarball)
 
-	// Create the tar.gz file
-	tarFile, err := os.Create(outputTarball)
+	// Create the tar.gz file, split into volumes with --split-size
+	tarFile, err := createArchive(outputTarball, splitSize)
+	if err != nil {
+		return err
+	}
+	err = writeTarball(tarFile, inputDir, format, level)
 	if err != nil {
 		return fmt.Errorf("error creating tarball: %v", err)
 	}
-	defer tarFile.Close()
 
+	// fmt.Println("Tarball successfully created.")
+	return nil
+}
+
+// writeTarball writes the entries of the bundle to a zstd compressed tar
+// archive and closes it. The archive is only complete once the tar writer, the
+// encoder and the file are closed in that order, the first error is returned.
+func writeTarball(tarFile io.WriteCloser, inputDir string, format bundleFormat, level zstd.EncoderLevel) error {
 	encoder, err := zstd.NewWriter(tarFile, zstd.WithEncoderLevel(level))
 	if err != nil {
+		tarFile.Close()
 		return err
 	}
-	defer encoder.Close()
-
 	tarWriter := tar.NewWriter(encoder)
-	defer tarWriter.Close()
-
-	// Walk through the input directory and add files to the tar archive
-	err = filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	err = writeTarEntries(tarWriter, inputDir, format)
+	for _, closeErr := range []error{tarWriter.Close(), encoder.Close(), tarFile.Close()} {
+		if err == nil && closeErr != nil {
+			err = closeErr
 		}
+	}
+	return err
+}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
+// writeTarEntries adds the files of the entries of the bundle to the archive.
+func writeTarEntries(tarWriter *tar.Writer, inputDir string, format bundleFormat) error {
+	// Walk through the entries of the bundle and add files to the tar archive
+	for _, entry := range format.entries() {
+		root := filepath.Join(inputDir, entry)
+		if _, err := os.Lstat(root); os.IsNotExist(err) {
+			continue
 		}
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 
-		// Open the file
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+			// Skip directories
+			if info.IsDir() {
+				return nil
+			}
 
-		// Create a tar header
-		header, err := tar.FileInfoHeader(info, path)
-		if err != nil {
-			return err
-		}
-		relPath, err := filepath.Rel(inputDir, path)
-		if err != nil {
-			return err
-		}
-		header.Name = filepath.ToSlash(relPath) // Use relative path inside tar
+			// Open the file
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			// Create a tar header
+			header, err := tar.FileInfoHeader(info, path)
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(inputDir, path)
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(relPath) // Use relative path inside tar
 
-		// Write the header and file content to the tar archive
-		err = tarWriter.WriteHeader(header)
+			// Write the header and file content to the tar archive
+			err = tarWriter.WriteHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tarWriter, file)
+			return err
+		})
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(tarWriter, file)
-		return err
-	})
-
-	if err != nil {
-		return fmt.Errorf("error creating tarball: %v", err)
 	}
-
-	// fmt.Println("Tarball successfully created.")
 	return nil
 }
 
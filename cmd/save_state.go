@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+)
+
+// saveStateFile records the progress of save in --output-dir, so that a save
+// interrupted by network failures is resumed with --resume.
+const saveStateFile = "save-state.json"
+
+// saveState lists the images exported to the output directory so far, with
+// the options they were exported with.
+type saveState struct {
+	Options saveStateOptions         `json:"options"`
+	Images  map[string]ImageManifest `json:"images"`
+	// CreatedOutputDir is set when save created the output directory, it is
+	// removed with the export once the tarball is created
+	CreatedOutputDir bool `json:"created_output_dir,omitempty"`
+
+	mu        sync.Mutex
+	outputDir string
+	// written holds the files of the output directory matching their digest
+	written map[string]bool
+}
+
+// saveStateOptions are the options changing what is exported for an image, a
+// save is only resumed with the same ones.
+type saveStateOptions struct {
+	Format           string   `json:"format"`
+	Platforms        []string `json:"platforms,omitempty"`
+	IncludeReferrers bool     `json:"include_referrers,omitempty"`
+	BaseDigest       string   `json:"base_digest,omitempty"`
+}
+
+func newSaveStateOptions(c saveConfig) saveStateOptions {
+	options := saveStateOptions{Format: c.Format, IncludeReferrers: c.IncludeReferrers}
+	for _, platform := range c.Platforms {
+		options.Platforms = append(options.Platforms, platform.String())
+	}
+	if c.Base != "" {
+		options.BaseDigest = c.baseDigest.String()
+	}
+	return options
+}
+
+// openSaveState returns the state of the save in outputDir. When resuming,
+// the images recorded by the previous save are kept and the blobs already
+// downloaded are verified against their digest, the others are removed.
+func openSaveState(outputDir string, c saveConfig, created bool, resume bool, out printer) (*saveState, error) {
+	state := &saveState{
+		Options:          newSaveStateOptions(c),
+		Images:           make(map[string]ImageManifest),
+		CreatedOutputDir: created,
+		outputDir:        outputDir,
+		written:          make(map[string]bool),
+	}
+	if !resume {
+		return state, state.save()
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, saveStateFile))
+	if err == nil {
+		var previous saveState
+		err = json.Unmarshal(data, &previous)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", saveStateFile, err)
+		}
+		if !reflect.DeepEqual(previous.Options, state.Options) {
+			return nil, fmt.Errorf("output directory %s holds a save with other options (format, platforms, referrers or base), it cannot be resumed", outputDir)
+		}
+		state.Images = previous.Images
+		state.CreatedOutputDir = previous.CreatedOutputDir
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading %s: %v", saveStateFile, err)
+	}
+
+	check := newBundleCheck()
+	err = filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := entryDigest(filepath.ToSlash(name)); !ok {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		corrupted := len(check.corrupted)
+		err = check.add(name, file)
+		if err != nil {
+			return err
+		}
+		// Blobs left incomplete by the interrupted save are downloaded again
+		if len(check.corrupted) > corrupted {
+			delete(check.entries, filepath.ToSlash(name))
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error verifying output directory: %v", err)
+	}
+	state.written = check.entries
+	out.Printf("Resuming save: %d images and %d blobs already downloaded, %d incomplete blobs removed\n",
+		len(state.Images), len(state.written), len(check.corrupted))
+	return state, state.save()
+}
+
+// declarationKey identifies an image declaration in the state.
+func declarationKey(i chartutil.DatarobotImageDeclaration) string {
+	if i.Tag == "" {
+		return i.Image
+	}
+	return i.Image + " > " + i.Tag
+}
+
+// writtenFiles returns the blobs of the output directory matching their
+// digest, they are not downloaded again.
+func (s *saveState) writtenFiles() []string {
+	if s == nil {
+		return nil
+	}
+	var files []string
+	for file := range s.written {
+		files = append(files, file)
+	}
+	return files
+}
+
+// exported returns the image exported by the previous save, when every file
+// it references is still in the output directory.
+func (s *saveState) exported(i chartutil.DatarobotImageDeclaration, format bundleFormat) (ImageManifest, bool) {
+	if s == nil {
+		return ImageManifest{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	manifest, ok := s.Images[declarationKey(i)]
+	if !ok {
+		return ImageManifest{}, false
+	}
+	check := &bundleCheck{entries: s.written}
+	return manifest, len(check.missing([]ImageManifest{manifest}, format)) == 0
+}
+
+// record adds an exported image to the state.
+func (s *saveState) record(i chartutil.DatarobotImageDeclaration, manifest ImageManifest) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Images[declarationKey(i)] = manifest
+	return s.save()
+}
+
+// save writes the state file.
+func (s *saveState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", saveStateFile, err)
+	}
+	err = writeFileAtomic(filepath.Join(s.outputDir, saveStateFile), data)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", saveStateFile, err)
+	}
+	return nil
+}
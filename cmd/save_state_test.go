@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeSave(t *testing.T) {
+	// The registry fails to serve the layers of app:2 while broken is set, and
+	// counts the requests for the blobs of app:1
+	var broken atomic.Bool
+	var app1Blobs atomic.Int32
+	blobs := make(map[string]string)
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for digest, image := range blobs {
+			if !strings.HasSuffix(r.URL.Path, "/blobs/"+digest) || r.Method != http.MethodGet {
+				continue
+			}
+			if image == "app:2" && broken.Load() {
+				http.Error(w, "connection reset", http.StatusBadGateway)
+				return
+			}
+			if image == "app:1" {
+				app1Blobs.Add(1)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var images []chartutil.DatarobotImageDeclaration
+	for _, tag := range []string{"1", "2"} {
+		image, err := random.Image(512, 2)
+		assert.NoError(t, err)
+		ref, err := name.ParseReference(host + "/src/app:" + tag)
+		assert.NoError(t, err)
+		assert.NoError(t, remote.Write(ref, image))
+		layers, err := image.Layers()
+		assert.NoError(t, err)
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			assert.NoError(t, err)
+			blobs[digest.String()] = "app:" + tag
+		}
+		images = append(images, chartutil.DatarobotImageDeclaration{Image: ref.String()})
+	}
+
+	outputDir := filepath.Join(t.TempDir(), "export")
+	c := saveConfig{
+		Output:        filepath.Join(t.TempDir(), "images.tar.zst"),
+		OutputDir:     outputDir,
+		Format:        string(formatNative),
+		Concurrency:   1,
+		RetryAttempts: 1,
+	}
+	run := func(c saveConfig) (string, error) {
+		var buf strings.Builder
+		cmd := &cobra.Command{}
+		cmd.SetOut(&buf)
+		err := exportSave(images, c, zstd.SpeedFastest, cmd)
+		return buf.String(), err
+	}
+
+	broken.Store(true)
+	output, err := run(c)
+	assert.EqualError(t, err, "Error saving images: 1 of the 2 images could not be saved: "+images[1].Image+", rerun with --resume to continue or with --allow-partial to save the others")
+	assert.Contains(t, output, "Failed to pull image: "+images[1].Image+". Attempt 1/2, retrying in 0s.")
+	assert.Contains(t, output, "Error saving image "+images[1].Image+": error exporting image")
+	assert.NoFileExists(t, c.Output)
+	assert.FileExists(t, filepath.Join(outputDir, saveStateFile))
+
+	t.Run("without-resume", func(t *testing.T) {
+		_, err := run(c)
+		assert.EqualError(t, err, "Error output directory "+outputDir+" holds an interrupted save, rerun with --resume to continue it")
+	})
+
+	t.Run("other-options", func(t *testing.T) {
+		other := c
+		other.Resume = true
+		other.IncludeReferrers = true
+		_, err := run(other)
+		assert.ErrorContains(t, err, "holds a save with other options")
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		// A blob left incomplete by the interrupted save is downloaded again
+		var partial string
+		for digest, image := range blobs {
+			if image == "app:2" {
+				partial = filepath.Join(outputDir, "layers", strings.TrimPrefix(digest, "sha256:")+".tar.gz")
+			}
+		}
+		assert.NoError(t, os.WriteFile(partial, []byte("partial"), 0644))
+
+		broken.Store(false)
+		app1Blobs.Store(0)
+		resumed := c
+		resumed.Resume = true
+		output, err := run(resumed)
+		assert.NoError(t, err)
+		assert.Regexp(t, `Resuming save: 1 images and \d+ blobs already downloaded, 1 incomplete blobs removed\n`, output)
+		assert.Contains(t, output, "Image already saved: "+images[0].Image+"\n")
+		assert.Equal(t, int32(0), app1Blobs.Load())
+		assert.NoDirExists(t, outputDir)
+
+		check := newBundleCheck()
+		source, err := readArchiveMetadata(c.Output, check)
+		assert.NoError(t, err)
+		manifests, format, err := readBundleManifests(source)
+		assert.NoError(t, err)
+		assert.Len(t, manifests, 2)
+		assert.NoError(t, check.report(manifests, format, newSyncPrinter(&cobra.Command{})))
+		assert.NotContains(t, check.entries, saveStateFile)
+	})
+
+	t.Run("allow-partial", func(t *testing.T) {
+		broken.Store(true)
+		partial := c
+		partial.AllowPartial = true
+		partial.RetryAttempts = 0
+		output, err := run(partial)
+		assert.NoError(t, err)
+		assert.Contains(t, output, "Warning: creating a partial tarball, 1 of the 2 images could not be saved: "+images[1].Image+"\n")
+		source, err := readArchiveMetadata(c.Output, newBundleCheck())
+		assert.NoError(t, err)
+		manifests, _, err := readBundleManifests(source)
+		assert.NoError(t, err)
+		assert.Len(t, manifests, 1)
+		assert.NoDirExists(t, outputDir)
+	})
+
+	t.Run("allow-partial-invalid-image", func(t *testing.T) {
+		broken.Store(false)
+		partial := c
+		partial.Output = filepath.Join(t.TempDir(), "images.tar.zst")
+		partial.OutputDir = filepath.Join(t.TempDir(), "export")
+		partial.AllowPartial = true
+		var buf strings.Builder
+		cmd := &cobra.Command{}
+		cmd.SetOut(&buf)
+		invalid := append(images, chartutil.DatarobotImageDeclaration{Image: host + "/src/app:bad tag"})
+		err := exportSave(invalid, partial, zstd.SpeedFastest, cmd)
+		assert.ErrorContains(t, err, "Error saving images: ")
+		assert.ErrorContains(t, err, "app:bad tag")
+		assert.NotContains(t, buf.String(), "Warning: creating a partial tarball")
+		assert.NoFileExists(t, partial.Output)
+	})
+}
+
+// readOnlyBundle fails to write the manifests of the images.
+type readOnlyBundle struct {
+	bundleWriter
+}
+
+func (readOnlyBundle) WriteFile(path string, data []byte) error {
+	return fmt.Errorf("open %s: read-only file system", path)
+}
+
+func TestExportLayersAndConfigsWriteError(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	image, err := random.Image(512, 1)
+	assert.NoError(t, err)
+	ref, err := name.ParseReference(strings.TrimPrefix(server.URL, "http://") + "/src/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, image))
+
+	state, err := openSaveState(t.TempDir(), saveConfig{}, true, false, newSyncPrinter(&cobra.Command{}))
+	assert.NoError(t, err)
+	c := saveConfig{Format: string(formatNative), Concurrency: 1, AllowPartial: true, state: state}
+	cmd := &cobra.Command{}
+	cmd.SetOut(io.Discard)
+	images := []chartutil.DatarobotImageDeclaration{{Image: ref.String()}}
+	_, err = exportLayersAndConfigs(images, c, readOnlyBundle{dirWriter(t.TempDir())}, cmd)
+	assert.ErrorContains(t, err, "error writing the bundle: open ")
+	assert.EqualError(t, checkPartialSave(err, c, cmd), "Error saving images: "+err.Error())
+}
@@ -1,9 +1,16 @@
 package cmd
 
 import (
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,8 +24,8 @@ func TestCommandSave(t *testing.T) {
 		assert.NoError(t, err)
 		expectedOutput := `[Dry-Run] Pulling image: docker.io/alpine/curl:8.9.1
 [Dry-Run] ReTagging image: docker.io/alpine/curl:8.9.1 > docker.io/alpine/curl:stable
-[Dry-Run] Pulling image: docker.io/busybox:1.36.1
-[Dry-Run] ReTagging image: docker.io/busybox:1.36.1 > docker.io/busybox:simple
+[Dry-Run] Pulling image: docker.io/library/busybox:1.36.1
+[Dry-Run] ReTagging image: docker.io/library/busybox:1.36.1 > docker.io/library/busybox:simple
 [Dry-Run] Pulling image: docker.io/alpine/curl:8.10.0
 [Dry-Run] Tarball created successfully: ` + SAVE_TEST_ARCHIVE
 		assert.Equal(t, expectedOutput, output)
@@ -40,6 +47,7 @@ Tarball created successfully: ` + SAVE_TEST_ARCHIVE
 		if err != nil {
 			t.Fatalf("Failed to remove file: %v", err)
 		}
+		assert.NoError(t, os.Remove(checksumFile(SAVE_TEST_ARCHIVE)))
 	})
 
 	t.Run("full", func(t *testing.T) {
@@ -48,8 +56,8 @@ Tarball created successfully: ` + SAVE_TEST_ARCHIVE
 
 		expectedOutput := `Pulling image: docker.io/alpine/curl:8.9.1
 ReTagging image: docker.io/alpine/curl:8.9.1 > docker.io/alpine/curl:stable
-Pulling image: docker.io/busybox:1.36.1
-ReTagging image: docker.io/busybox:1.36.1 > docker.io/busybox:simple
+Pulling image: docker.io/library/busybox:1.36.1
+ReTagging image: docker.io/library/busybox:1.36.1 > docker.io/library/busybox:simple
 Pulling image: docker.io/alpine/curl:8.10.0
 Tarball created successfully: ` + SAVE_TEST_ARCHIVE
 
@@ -65,6 +73,7 @@ Tarball created successfully: ` + SAVE_TEST_ARCHIVE
 		if err != nil {
 			t.Fatalf("Failed to remove file: %v", err)
 		}
+		assert.NoError(t, os.Remove(checksumFile(SAVE_TEST_ARCHIVE)))
 	})
 	t.Run("layers", func(t *testing.T) {
 		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart6 -a layers --output "+SAVE_TEST_ARCHIVE)
@@ -88,6 +97,7 @@ Tarball created successfully: ` + SAVE_TEST_ARCHIVE
 		if err != nil {
 			t.Fatalf("Failed to remove file: %v", err)
 		}
+		assert.NoError(t, os.Remove(checksumFile(SAVE_TEST_ARCHIVE)))
 	})
 
 	t.Run("skip-image-group", func(t *testing.T) {
@@ -105,10 +115,181 @@ Skipping image: docker.io/alpine/curl:8.9.2
 		assert.Equal(t, expectedOutput, output)
 	})
 
+	t.Run("digest", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart6 --dry-run -a digest --output "+SAVE_TEST_ARCHIVE)
+		assert.NoError(t, err)
+		expectedOutput := `[Dry-Run] Pulling image: docker.io/alpine/curl:8.9.1@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c
+[Dry-Run] ReTagging image: docker.io/alpine/curl:8.9.1@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c > docker.io/alpine/curl:stable@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c
+[Dry-Run] Pulling image: docker.io/library/busybox@sha256:2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e
+[Dry-Run] Tarball created successfully: ` + SAVE_TEST_ARCHIVE
+
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("wrong-platform", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --platform linux/arm64/v8/extra")
+		assert.Error(t, err)
+		expectedOutput := `Error: Invalid platform linux/arm64/v8/extra: too many slashes in platform spec: linux/arm64/v8/extra`
+		assert.Equal(t, expectedOutput, output)
+	})
+
 	t.Run("wrong-level", func(t *testing.T) {
 		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --level=wrong")
 		assert.Error(t, err)
 		expectedOutput := `Error: Invalid compression level. Available options: fastest, default, better, best`
 		assert.Equal(t, expectedOutput, output)
 	})
+
+	t.Run("wrong-format", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --format=wrong")
+		assert.Error(t, err)
+		expectedOutput := `Error: Invalid format. Available options: native, oci-layout, docker-archive`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("wrong-concurrency", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --concurrency 0")
+		assert.Error(t, err)
+		expectedOutput := `Error: Invalid concurrency 0, it must be at least 1`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("split-without-docker-archive", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --split")
+		assert.Error(t, err)
+		expectedOutput := `Error: --split is only supported with --format docker-archive`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("stream-docker-archive", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --stream --format docker-archive")
+		assert.Error(t, err)
+		expectedOutput := `Error: --stream is not supported with --format docker-archive`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("split-size-docker-archive", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --stream=false --split-size 4G --format docker-archive")
+		assert.Error(t, err)
+		expectedOutput := `Error: --split-size is not supported with --format docker-archive`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("include-charts-docker-archive", func(t *testing.T) {
+		t.Cleanup(func() { saveCfg.IncludeCharts = false })
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --stream=false --include-charts --format docker-archive")
+		assert.Error(t, err)
+		expectedOutput := `Error: --include-charts is not supported with --format docker-archive`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("wrong-split-size", func(t *testing.T) {
+		// Flags are kept between commands, later saves are not split
+		t.Cleanup(func() { saveCfg.SplitSize = "" })
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --split-size 4X --format native")
+		assert.Error(t, err)
+		expectedOutput := `Error: Invalid split size 4X, it must be a positive size such as 4G or 700M`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("output-dir-with-bundle", func(t *testing.T) {
+		outputDir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(outputDir, "manifest.json"), []byte("[]"), 0644))
+		output, err := executeCommand(rootCmd, "save ../tests/charts/test-chart4 --output-dir "+outputDir)
+		assert.Error(t, err)
+		expectedOutput := `Error: Error output directory ` + outputDir + ` already contains manifest.json`
+		assert.Equal(t, expectedOutput, output)
+		// Files save did not write are left untouched
+		assert.FileExists(t, filepath.Join(outputDir, "manifest.json"))
+	})
+}
+
+func TestBlobSet(t *testing.T) {
+	blobs := newBlobSet()
+	var calls atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := blobs.write("shared", func() error {
+				calls.Add(1)
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	err := blobs.write("broken", func() error { return errors.New("broken layer") })
+	assert.EqualError(t, err, "broken layer")
+	// A failed blob is written again when its image is pulled again
+	err = blobs.write("broken", func() error { return nil })
+	assert.NoError(t, err)
+	err = blobs.write("broken", func() error { return errors.New("written twice") })
+	assert.NoError(t, err)
+}
+
+// countingWriter counts the writes of every file of a bundle.
+type countingWriter struct {
+	dirWriter
+	mu     sync.Mutex
+	writes map[string]int
+}
+
+func (c *countingWriter) count(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes[path]++
+}
+
+func (c *countingWriter) WriteFile(path string, data []byte) error {
+	c.count(path)
+	return c.dirWriter.WriteFile(path, data)
+}
+
+func (c *countingWriter) WriteStream(path string, size int64, r io.Reader) error {
+	c.count(path)
+	return c.dirWriter.WriteStream(path, size, r)
+}
+
+func TestExportImageOnce(t *testing.T) {
+	image, err := random.Image(512, 2)
+	assert.NoError(t, err)
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+
+	w := &countingWriter{dirWriter: dirWriter(outputDir), writes: make(map[string]int)}
+	blobs := newBlobSet()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := exportImage(image, w, formatNative, blobs)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// The manifest, the config and the 2 layers
+	assert.Len(t, w.writes, 4)
+	for path, writes := range w.writes {
+		assert.Equal(t, 1, writes, path)
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+
+	assert.True(t, matchPlatform(&amd64, nil))
+	assert.True(t, matchPlatform(nil, nil))
+	assert.True(t, matchPlatform(&amd64, []v1.Platform{arm64, {OS: "linux", Architecture: "amd64"}}))
+	assert.True(t, matchPlatform(&arm64, []v1.Platform{{OS: "linux", Architecture: "arm64"}}))
+	assert.False(t, matchPlatform(&amd64, []v1.Platform{{OS: "linux", Architecture: "arm64"}}))
+	assert.False(t, matchPlatform(nil, []v1.Platform{amd64}))
 }
@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Bundles are signed with the blob signature format of `cosign sign-blob`: the
+// base64 encoded signature of the file, next to it with a .sig extension. The
+// checksum file is signed rather than the archive, so that signing does not
+// read the archive again, and the manifest is signed inside the archive.
+//
+// Signed bundles can also be checked with cosign:
+//
+//	cosign verify-blob --key cosign.pub --signature images.tar.zst.sha256.sig images.tar.zst.sha256
+//	sha256sum -c images.tar.zst.sha256
+
+// signaturePasswordEnv holds the password of encrypted cosign private keys.
+const signaturePasswordEnv = "COSIGN_PASSWORD"
+
+// signatureFile returns the path of the detached signature of a file.
+func signatureFile(path string) string {
+	return path + ".sig"
+}
+
+// loadSigningKey reads an ed25519 or ECDSA private key, either a PEM encoded
+// PKCS#8 or SEC 1 key or a key generated by `cosign generate-key-pair`.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		var der []byte
+		der, err = decryptCosignKey(block.Bytes, []byte(os.Getenv(signaturePasswordEnv)))
+		if err == nil {
+			key, err = x509.ParsePKCS8PrivateKey(der)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key: %v", err)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key %T, use an ed25519 or ECDSA key", key)
+	}
+}
+
+// decryptCosignKey decrypts the private key of `cosign generate-key-pair`,
+// sealed with nacl/secretbox and a key derived from the password with scrypt.
+func decryptCosignKey(data []byte, password []byte) ([]byte, error) {
+	var sealed struct {
+		KDF struct {
+			Name   string `json:"name"`
+			Params struct {
+				N int `json:"N"`
+				R int `json:"r"`
+				P int `json:"p"`
+			} `json:"params"`
+			Salt []byte `json:"salt"`
+		} `json:"kdf"`
+		Cipher struct {
+			Name  string `json:"name"`
+			Nonce []byte `json:"nonce"`
+		} `json:"cipher"`
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	err := json.Unmarshal(data, &sealed)
+	if err != nil {
+		return nil, err
+	}
+	if sealed.KDF.Name != "scrypt" || sealed.Cipher.Name != "nacl/secretbox" || len(sealed.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported key encryption %s/%s", sealed.KDF.Name, sealed.Cipher.Name)
+	}
+
+	derived, err := scrypt.Key(password, sealed.KDF.Salt, sealed.KDF.Params.N, sealed.KDF.Params.R, sealed.KDF.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], derived)
+	copy(nonce[:], sealed.Cipher.Nonce)
+	plain, ok := secretbox.Open(nil, sealed.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, fmt.Errorf("wrong password, set it with %s", signaturePasswordEnv)
+	}
+	return plain, nil
+}
+
+// loadPublicKey reads a PEM encoded ed25519 or ECDSA public key.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("public key %s is not a PEM encoded public key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key: %v", err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key %T, use an ed25519 or ECDSA key", key)
+	}
+}
+
+// signBlob returns the base64 encoded signature of data: ed25519 signs the
+// data itself and ECDSA its sha256, as cosign does.
+func signBlob(key crypto.Signer, data []byte) ([]byte, error) {
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, data)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		signature, err = ecdsa.SignASN1(rand.Reader, key, digest[:])
+	default:
+		err = fmt.Errorf("unsupported signing key %T", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// verifyBlob checks a base64 encoded signature of data.
+func verifyBlob(key crypto.PublicKey, data []byte, encoded []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	valid := false
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, data, signature)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(key, digest[:], signature)
+	}
+	if !valid {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// signFile writes the detached signature of a file next to it.
+func signFile(key crypto.Signer, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signature, err := signBlob(key, data)
+	if err != nil {
+		return fmt.Errorf("error signing %s: %v", path, err)
+	}
+	return os.WriteFile(signatureFile(path), signature, 0644)
+}
+
+// signingWriter signs the manifest of a bundle when it is written, the
+// signature is stored in the bundle next to it.
+type signingWriter struct {
+	bundleWriter
+	key          crypto.Signer
+	manifestFile string
+}
+
+func (w *signingWriter) WriteFile(path string, data []byte) error {
+	err := w.bundleWriter.WriteFile(path, data)
+	if err != nil || path != w.manifestFile {
+		return err
+	}
+	signature, err := signBlob(w.key, data)
+	if err != nil {
+		return fmt.Errorf("error signing %s: %v", path, err)
+	}
+	return w.bundleWriter.WriteFile(signatureFile(path), signature)
+}
+
+// bundleSignature checks the signatures of a bundle against a public key.
+type bundleSignature struct {
+	key     crypto.PublicKey
+	require bool
+}
+
+// newBundleSignature loads the public key bundles are checked with, bundles
+// are not checked when no key is given.
+func newBundleSignature(publicKeyPath string, require bool) (*bundleSignature, error) {
+	if publicKeyPath == "" {
+		if require {
+			return nil, fmt.Errorf("--require-signature needs the --public-key the bundle was signed with")
+		}
+		return &bundleSignature{}, nil
+	}
+	key, err := loadPublicKey(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &bundleSignature{key: key, require: require}, nil
+}
+
+// checkArchive verifies the signature of the checksum file of an archive, the
+// archive itself is checked against its checksum with verifyChecksumFile. It
+// returns whether the archive is signed.
+func (s *bundleSignature) checkArchive(archivePath string) (bool, error) {
+	if s.key == nil {
+		return false, nil
+	}
+	signed := checksumFile(archivePath)
+	signature, err := os.ReadFile(signatureFile(signed))
+	if os.IsNotExist(err) {
+		if s.require {
+			return false, fmt.Errorf("%s is not signed, %s is missing", archivePath, signatureFile(signed))
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading signature: %v", err)
+	}
+	data, err := os.ReadFile(signed)
+	if err != nil {
+		return false, fmt.Errorf("error reading checksum file: %v", err)
+	}
+	err = verifyBlob(s.key, data, signature)
+	if err != nil {
+		return false, fmt.Errorf("signature of %s does not match the public key: %v", signed, err)
+	}
+	return true, nil
+}
+
+// checkBundle checks the signature of an archive before it is read, unsigned
+// archives are reported when a public key is given.
+func (s *bundleSignature) checkBundle(archivePath string, cmd *cobra.Command) error {
+	signed, err := s.checkArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	if s.key != nil && !signed {
+		cmd.Printf("Bundle %s is not signed\n", archivePath)
+	}
+	return nil
+}
+
+// checkManifest verifies the signature of the manifest stored in a bundle.
+func (s *bundleSignature) checkManifest(source bundleSource, format bundleFormat) error {
+	if s.key == nil {
+		return nil
+	}
+	manifestFile := format.manifestEntry()
+	signature, err := source.ReadFile(signatureFile(manifestFile))
+	if err != nil {
+		if s.require {
+			return fmt.Errorf("%s of the bundle is not signed", manifestFile)
+		}
+		return nil
+	}
+	data, err := source.ReadFile(manifestFile)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", manifestFile, err)
+	}
+	err = verifyBlob(s.key, data, signature)
+	if err != nil {
+		return fmt.Errorf("signature of %s does not match the public key: %v", manifestFile, err)
+	}
+	return nil
+}
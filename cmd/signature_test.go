@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// writeTestKeys writes a PEM key pair and returns the path of the private and
+// the public key.
+func writeTestKeys(t *testing.T, key crypto.Signer, privateType string, privateDer []byte) (string, string) {
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, "cosign.key")
+	publicPath := filepath.Join(dir, "cosign.pub")
+	publicDer, err := x509.MarshalPKIXPublicKey(key.Public())
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: privateType, Bytes: privateDer}), 0600))
+	assert.NoError(t, os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}), 0644))
+	return privatePath, publicPath
+}
+
+// encryptCosignKey seals a PKCS#8 key the way `cosign generate-key-pair` does.
+func encryptCosignKey(t *testing.T, der []byte, password string) []byte {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	assert.NoError(t, err)
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	assert.NoError(t, err)
+	derived, err := scrypt.Key([]byte(password), salt, 1024, 8, 1, 32)
+	assert.NoError(t, err)
+	var key [32]byte
+	copy(key[:], derived)
+
+	sealed := map[string]any{
+		"kdf": map[string]any{
+			"name":   "scrypt",
+			"params": map[string]int{"N": 1024, "r": 8, "p": 1},
+			"salt":   salt,
+		},
+		"cipher":     map[string]any{"name": "nacl/secretbox", "nonce": nonce[:]},
+		"ciphertext": secretbox.Seal(nil, der, &nonce, &key),
+	}
+	data, err := json.Marshal(sealed)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	ed25519Der, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	assert.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecdsaDer, err := x509.MarshalECPrivateKey(ecdsaKey)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		key         crypto.Signer
+		privateType string
+		privateDer  []byte
+	}{
+		{"ed25519-pkcs8", ed25519Key, "PRIVATE KEY", ed25519Der},
+		{"ecdsa-sec1", ecdsaKey, "EC PRIVATE KEY", ecdsaDer},
+		{"cosign-encrypted", ed25519Key, "ENCRYPTED SIGSTORE PRIVATE KEY", encryptCosignKey(t, ed25519Der, "secret")},
+	}
+	t.Setenv(signaturePasswordEnv, "secret")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			privatePath, publicPath := writeTestKeys(t, tt.key, tt.privateType, tt.privateDer)
+			signer, err := loadSigningKey(privatePath)
+			assert.NoError(t, err)
+			publicKey, err := loadPublicKey(publicPath)
+			assert.NoError(t, err)
+
+			signature, err := signBlob(signer, []byte("bundle"))
+			assert.NoError(t, err)
+			assert.NoError(t, verifyBlob(publicKey, []byte("bundle"), signature))
+			assert.EqualError(t, verifyBlob(publicKey, []byte("tampered"), signature), "invalid signature")
+		})
+	}
+
+	t.Run("wrong-password", func(t *testing.T) {
+		t.Setenv(signaturePasswordEnv, "wrong")
+		privatePath, _ := writeTestKeys(t, ed25519Key, "ENCRYPTED COSIGN PRIVATE KEY", encryptCosignKey(t, ed25519Der, "secret"))
+		_, err := loadSigningKey(privatePath)
+		assert.EqualError(t, err, "error parsing signing key: wrong password, set it with COSIGN_PASSWORD")
+	})
+}
+
+func TestCommandVerifySignature(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	_, publicPath := writeTestKeys(t, key, "PRIVATE KEY", der)
+
+	t.Run("signed", func(t *testing.T) {
+		tarballPath := writeSignedTestBundle(t, key, "docker.io/alpine/curl:stable")
+		output, err := executeCommand(rootCmd, "verify "+tarballPath+" --public-key "+publicPath+" --require-signature")
+		assert.NoError(t, err)
+		expectedOutput := `Signature verified with ` + publicPath + `
+Bundle ` + tarballPath + `: 1 images, 0 corrupted entries, 0 missing entries, 0 missing images, 0 extra images
+Verification passed`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+		output, err := executeCommand(rootCmd, "verify "+tarballPath+" --public-key "+publicPath)
+		assert.NoError(t, err)
+		assert.Contains(t, output, "Bundle "+tarballPath+" is not signed\n")
+
+		output, err = executeCommand(rootCmd, "verify "+tarballPath+" --public-key "+publicPath+" --require-signature")
+		assert.Error(t, err)
+		assert.Contains(t, output, "Signature mismatch: "+tarballPath+" is not signed, "+signatureFile(checksumFile(tarballPath))+" is missing\n")
+		assert.Contains(t, output, "Error: Verification failed")
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tarballPath := writeSignedTestBundle(t, key, "docker.io/alpine/curl:stable")
+		otherPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+		assert.NoError(t, os.Rename(otherPath, tarballPath))
+		assert.NoError(t, writeChecksumFile(tarballPath))
+
+		output, err := executeCommand(rootCmd, "verify "+tarballPath+" --public-key "+publicPath)
+		assert.Error(t, err)
+		assert.Contains(t, output, "Signature mismatch: signature of "+checksumFile(tarballPath)+" does not match the public key: invalid signature\n")
+	})
+
+	t.Run("load-refuses-unsigned", func(t *testing.T) {
+		tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+		output, err := executeCommand(rootCmd, "load "+tarballPath+" -r localhost:1 --public-key "+publicPath+" --require-signature")
+		assert.Error(t, err)
+		assert.Equal(t, "Error: Error verifying signature: "+tarballPath+" is not signed, "+signatureFile(checksumFile(tarballPath))+" is missing", output)
+	})
+
+	t.Run("load-requires-public-key", func(t *testing.T) {
+		tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+		output, err := executeCommand(rootCmd, "load "+tarballPath+" -r localhost:1 --require-signature")
+		assert.Error(t, err)
+		assert.Equal(t, "Error: Error verifying signature: --require-signature needs the --public-key the bundle was signed with", output)
+	})
+}
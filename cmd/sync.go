@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/sethvargo/go-envconfig"
 	"github.com/spf13/cobra"
 )
@@ -39,6 +40,14 @@ export REGISTRY_PASSWORD=reg_password
 export REGISTRY_HOST=registry.example.com
 $ helm datarobot sync tests/charts/test-chart1/
 '''
+
+Images are copied as they are in the source registry, multi-architecture images with all
+their platforms, so that images pinned by digest keep it.
+
+With '--include-referrers', the signatures, SBOMs and attestations attached to each image,
+to the index of multi-architecture images, are copied next to it: OCI 1.1 referrers,
+found with the referrers API or its 'sha256-<digest>' fallback tag, and the
+'sha256-<digest>.sig', '.att' and '.sbom' tags of cosign.
 `, "'", "`", -1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := context.Background()
@@ -55,6 +64,7 @@ $ helm datarobot sync tests/charts/test-chart1/
 			return fmt.Errorf("Error ExtractImagesFromCharts: %v", err)
 		}
 
+		var pending []syncImage
 		for _, image := range images {
 			iUri, err := image_uri.NewDockerUri(image.Image)
 			if err != nil {
@@ -65,6 +75,9 @@ $ helm datarobot sync tests/charts/test-chart1/
 				iUri.Tag = image.Tag
 			}
 
+			// Images are pushed to the path written in the chart, docker.io
+			// official images are not moved to a library namespace
+			iUri = iUri.AsWritten()
 			iUri.RegistryHost = syncCfg.RegistryHost
 			iUri.Organization = iUri.Join([]string{syncCfg.ImagePrefix, iUri.Organization}, "/")
 			iUri.Project = iUri.Join([]string{iUri.Project, syncCfg.ImageSuffix}, "/")
@@ -108,75 +121,163 @@ $ helm datarobot sync tests/charts/test-chart1/
 				continue
 			}
 
-			transport, err := GetTransport(syncCfg.CaCertPath, syncCfg.CertPath, syncCfg.KeyPath, syncCfg.SkipTlsVerify)
-			if err != nil {
-				return fmt.Errorf("failed to GetTransport: %w", err)
-			}
-			auth := authn.Anonymous
-			if syncCfg.Token != "" {
-				auth = &authn.Bearer{
-					Token: syncCfg.Token,
-				}
+			pending = append(pending, syncImage{src: srcImage, dst: iUri})
+		}
+
+		if syncCfg.DryRun {
+			return nil
+		}
+
+		transport, err := GetTransport(syncCfg.CaCertPath, syncCfg.CertPath, syncCfg.KeyPath, syncCfg.SkipTlsVerify)
+		if err != nil {
+			return fmt.Errorf("failed to GetTransport: %w", err)
+		}
+		auth := authn.Anonymous
+		if syncCfg.Token != "" {
+			auth = &authn.Bearer{
+				Token: syncCfg.Token,
 			}
-			if syncCfg.Username != "" && syncCfg.Password != "" {
-				auth = &authn.Basic{
-					Username: syncCfg.Username,
-					Password: syncCfg.Password,
-				}
+		}
+		if syncCfg.Username != "" && syncCfg.Password != "" {
+			auth = &authn.Basic{
+				Username: syncCfg.Username,
+				Password: syncCfg.Password,
 			}
+		}
+		options := []remote.Option{remote.WithTransport(transport), remote.WithAuth(auth)}
 
-			if !syncCfg.Overwrite {
-				mfs, _ := crane.Manifest(dstImage, crane.WithTransport(transport), crane.WithAuth(auth))
-				if len(mfs) > 0 {
-					cmd.Printf("image %s already exists in the registry\n", iUri.String())
-					continue
-				}
-			}
+		out := newSyncPrinter(cmd)
+		uploads := newBlobUploads()
+		results := make([]pushResult, len(pending))
+		forEachConcurrently(len(pending), syncCfg.Concurrency, func(idx int) {
+			image := pending[idx]
+			status, err := syncOneImage(image, syncCfg, options, uploads, out)
+			results[idx] = pushResult{image: image.src, status: status, err: err}
+		})
 
-			cmd.Printf("Pulling image: %s\n", srcImage)
-			img, err := crane.Pull(srcImage)
-			if err != nil {
-				return fmt.Errorf("failed to pull image: %w", err)
-			}
+		return printPushSummary(out, results)
+	},
+}
 
-			cmd.Printf("Pushing image: %s\n\n", dstImage)
-			pushStatus := false
-			for i := range syncCfg.RetryAttempts + 1 {
-				err = crane.Push(img, dstImage, crane.WithTransport(transport), crane.WithAuth(auth))
-				if err == nil {
-					pushStatus = true
-					break
-				}
-				cmd.Printf("Failed to push image: %s. Attempt %d/%d. Error: %v", image, i+1, syncCfg.RetryAttempts, err)
-				time.Sleep(time.Duration(syncCfg.RetryDelay) * time.Second) // Wait before retrying
-			}
-			if !pushStatus {
-				return fmt.Errorf("failed to push image with authentication: %w", err)
-			}
+// syncImage is an image to copy from its source to the target registry.
+type syncImage struct {
+	src string
+	dst image_uri.DockerUri
+}
+
+// syncOneImage copies an image to the target registry unless it already exists.
+func syncOneImage(image syncImage, c syncConfig, options []remote.Option, uploads *blobUploads, out printer) (pushStatus, error) {
+	iUri := image.dst
+	ref, err := name.ParseReference(iUri.TagRef())
+	if err != nil {
+		return statusPushed, fmt.Errorf("error parsing reference %s: %v", iUri.TagRef(), err)
+	}
+
+	if !c.Overwrite {
+		_, err := remote.Head(ref, options...)
+		if err == nil {
+			out.Printf("image %s already exists in the registry\n", iUri.String())
+			return statusExists, nil
+		}
+	}
+
+	out.Printf("Pulling image: %s\n", image.src)
+	srcRef, err := name.ParseReference(image.src)
+	if err != nil {
+		return statusPushed, fmt.Errorf("error parsing reference %s: %v", image.src, err)
+	}
+	desc, err := remote.Get(srcRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return statusPushed, fmt.Errorf("failed to pull image: %w", err)
+	}
+
+	// Images and multi-architecture indexes are pushed as pulled, so that the
+	// pinned digests still match
+	var images []v1.Image
+	var write func() error
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return statusPushed, fmt.Errorf("failed to pull image: %w", err)
+		}
+		images, err = indexImages(index)
+		if err != nil {
+			return statusPushed, fmt.Errorf("failed to pull image: %w", err)
+		}
+		write = func() error {
+			return remote.WriteIndex(ref, index, options...)
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return statusPushed, fmt.Errorf("failed to pull image: %w", err)
 		}
+		images = []v1.Image{img}
+		write = func() error {
+			return remote.Write(ref, img, options...)
+		}
+	}
+
+	out.Printf("Pushing image: %s\n\n", iUri.String())
+	err = pushWithRetry(c.RetryAttempts, c.RetryDelay, out, image.src, func() error {
+		// Layers shared with other images are only uploaded once
+		err := uploads.uploadLayers(images, ref.Context(), options...)
+		if err != nil {
+			return err
+		}
+		return write()
+	})
+	if err != nil {
+		return statusPushed, fmt.Errorf("failed to push image with authentication: %w", err)
+	}
+
+	if c.IncludeReferrers {
+		err = syncReferrers(srcRef.Context().Digest(desc.Digest.String()), ref.Context(), c, options, out)
+		if err != nil {
+			return statusPushed, err
+		}
+	}
+	return statusPushed, nil
+}
+
+// syncReferrers copies the signatures, SBOMs and attestations attached to the
+// source image next to the synced image.
+func syncReferrers(subject name.Digest, repo name.Repository, c syncConfig, options []remote.Option, out printer) error {
+	referrers, err := findReferrers(subject, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return err
+	}
+	if len(referrers) == 0 {
 		return nil
-	},
+	}
+
+	out.Printf("Pushing %d referrers of image: %s\n", len(referrers), repo.String())
+	return pushWithRetry(c.RetryAttempts, c.RetryDelay, out, subject.String(), func() error {
+		return pushReferrers(repo, referrers, options...)
+	})
 }
 
 type syncConfig struct {
-	Username       string   `env:"REGISTRY_USERNAME"`
-	Password       string   `env:"REGISTRY_PASSWORD"`
-	Token          string   `env:"REGISTRY_TOKEN"`
-	RegistryHost   string   `env:"REGISTRY_HOST"`
-	ImagePrefix    string   `env:"IMAGE_PREFIX"`
-	ImageSuffix    string   `env:"IMAGE_SUFFIX"`
-	ImageRepo      string   `env:"IMAGE_REPO"`
-	Transform      string   `env:"TRANSFORM"`
-	CaCertPath     string   `env:"CA_CERT_PATH"`
-	CertPath       string   `env:"CERT_PATH"`
-	KeyPath        string   `env:"KEY_PATH"`
-	SkipTlsVerify  bool     `env:"SKIP_TLS_VERIFY"`
-	ImageSkipGroup []string `env:"IMAGE_SKIP_GROUP"`
-	ImageSkip      []string `env:"IMAGE_SKIP"`
-	Overwrite      bool     `env:"OVERWRITE"`
-	DryRun         bool     `env:"DRY_RUN"`
-	RetryAttempts  int      `env:"RETRY_ATTEMPTS,default=1"` // number of retries for pushing images
-	RetryDelay     int      `env:"RETRY_DELAY,default=5"`    // in seconds, delay between retries
+	Username         string   `env:"REGISTRY_USERNAME"`
+	Password         string   `env:"REGISTRY_PASSWORD"`
+	Token            string   `env:"REGISTRY_TOKEN"`
+	RegistryHost     string   `env:"REGISTRY_HOST"`
+	ImagePrefix      string   `env:"IMAGE_PREFIX"`
+	ImageSuffix      string   `env:"IMAGE_SUFFIX"`
+	ImageRepo        string   `env:"IMAGE_REPO"`
+	Transform        string   `env:"TRANSFORM"`
+	CaCertPath       string   `env:"CA_CERT_PATH"`
+	CertPath         string   `env:"CERT_PATH"`
+	KeyPath          string   `env:"KEY_PATH"`
+	SkipTlsVerify    bool     `env:"SKIP_TLS_VERIFY"`
+	ImageSkipGroup   []string `env:"IMAGE_SKIP_GROUP"`
+	ImageSkip        []string `env:"IMAGE_SKIP"`
+	Overwrite        bool     `env:"OVERWRITE"`
+	DryRun           bool     `env:"DRY_RUN"`
+	RetryAttempts    int      `env:"RETRY_ATTEMPTS,default=1"` // number of retries for pushing images
+	RetryDelay       int      `env:"RETRY_DELAY,default=5"`    // in seconds, delay between retries
+	Concurrency      int      `env:"CONCURRENCY,default=1"`    // number of images synced in parallel
+	IncludeReferrers bool     `env:"INCLUDE_REFERRERS"`
 }
 
 var syncCfg syncConfig
@@ -200,5 +301,7 @@ func init() {
 	syncCmd.Flags().StringArrayVarP(&syncCfg.ImageSkip, "skip-image", "", []string{}, "Specify which image should be skipped (can be used multiple times)")
 	syncCmd.Flags().StringArrayVarP(&syncCfg.ImageSkipGroup, "skip-group", "", []string{}, "Specify which image group should be skipped (can be used multiple times)")
 	syncCmd.Flags().IntVarP(&syncCfg.RetryAttempts, "retry-attempts", "", 1, "Number of retries for pushing images")
-	syncCmd.Flags().IntVarP(&syncCfg.RetryDelay, "retry-delay", "", 5, "Delay between retries in seconds")
+	syncCmd.Flags().IntVarP(&syncCfg.RetryDelay, "retry-delay", "", 5, "Delay before the first retry in seconds, doubled after each retry")
+	syncCmd.Flags().IntVarP(&syncCfg.Concurrency, "concurrency", "", 1, "Number of images synced in parallel")
+	syncCmd.Flags().BoolVarP(&syncCfg.IncludeReferrers, "include-referrers", "", false, "Copy the signatures, SBOMs and attestations attached to the images")
 }
@@ -1,9 +1,18 @@
 package cmd
 
 import (
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,11 +24,13 @@ func TestCommandSyncLive(t *testing.T) {
 		expectedOutput := `Pulling image: docker.io/alpine/curl:8.9.1
 Pushing image: ttl.sh/alpine/curl:stable
 
-Pulling image: docker.io/busybox:1.36.1
+Pulling image: docker.io/library/busybox:1.36.1
 Pushing image: ttl.sh/busybox:simple
 
 Pulling image: docker.io/alpine/curl:8.10.0
-Pushing image: ttl.sh/alpine/curl:8.10.0`
+Pushing image: ttl.sh/alpine/curl:8.10.0
+
+Summary: 3 pushed, 0 already in the registry, 0 failed`
 		assert.Equal(t, expectedOutput, output)
 	})
 	// 	t.Run("test-chart4 ttl.sh with proxy", func(t *testing.T) {
@@ -42,7 +53,7 @@ Pushing image: ttl.sh/alpine/curl:8.10.0`
 	// 		expectedOutput := `Pulling image: docker.io/alpine/curl:8.9.1
 	// Pushing image: ttl.sh/alpine/curl:stable
 
-	// Pulling image: docker.io/busybox:1.36.1
+	// Pulling image: docker.io/library/busybox:1.36.1
 	// Pushing image: ttl.sh/busybox:simple
 
 	// Pulling image: docker.io/alpine/curl:8.10.0
@@ -62,7 +73,7 @@ func TestCommandSync(t *testing.T) {
 		expectedOutput := `[Dry-Run] Pulling image: docker.io/alpine/curl:8.9.1
 [Dry-Run] Pushing image: registry.example.com/alpine/curl:stable
 
-[Dry-Run] Pulling image: docker.io/busybox:1.36.1
+[Dry-Run] Pulling image: docker.io/library/busybox:1.36.1
 [Dry-Run] Pushing image: registry.example.com/busybox:simple
 
 [Dry-Run] Pulling image: docker.io/alpine/curl:8.10.0
@@ -117,6 +128,18 @@ Skipping image: docker.io/alpine/curl:8.9.2
 		assert.Equal(t, expectedOutput, output)
 	})
 
+	t.Run("digest", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "sync ../tests/charts/test-chart6 -r registry.example.com --dry-run -a digest")
+		assert.NoError(t, err)
+		expectedOutput := `[Dry-Run] Pulling image: docker.io/alpine/curl:8.9.1@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c
+[Dry-Run] Pushing image: registry.example.com/alpine/curl:stable@sha256:9a6b4e4a7e5f6b0d2c1e8f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c
+
+[Dry-Run] Pulling image: docker.io/library/busybox@sha256:2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e
+[Dry-Run] Pushing image: registry.example.com/busybox@sha256:2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e`
+
+		assert.Equal(t, expectedOutput, output)
+	})
+
 	t.Run("local-registry-insecure", func(t *testing.T) {
 		os.Setenv("REGISTRY_USERNAME", "admin")
 		os.Setenv("REGISTRY_PASSWORD", "pass")
@@ -125,7 +148,9 @@ Skipping image: docker.io/alpine/curl:8.9.2
 		output, err := executeCommand(rootCmd, "sync ../tests/charts/test-chart6 -a ex4")
 		assert.NoError(t, err)
 		expectedLoadOutput := `Pulling image: docker.io/alpine/curl:8.11.1
-Pushing image: localhost:5000/alpine/curl:8.11.1`
+Pushing image: localhost:5000/alpine/curl:8.11.1
+
+Summary: 1 pushed, 0 already in the registry, 0 failed`
 		assert.Equal(t, expectedLoadOutput, output)
 	})
 	t.Run("duplicated", func(t *testing.T) {
@@ -136,7 +161,8 @@ Pushing image: localhost:5000/alpine/curl:8.11.1`
 
 		output, err := executeCommand(rootCmd, "sync ../tests/charts/test-chart6 -a ex4")
 		assert.NoError(t, err)
-		expectedLoadOutput := `image localhost:5000/alpine/curl:8.11.1 already exists in the registry`
+		expectedLoadOutput := `image localhost:5000/alpine/curl:8.11.1 already exists in the registry
+Summary: 0 pushed, 1 already in the registry, 0 failed`
 		assert.Equal(t, expectedLoadOutput, output)
 	})
 	t.Run("overwrite", func(t *testing.T) {
@@ -148,7 +174,88 @@ Pushing image: localhost:5000/alpine/curl:8.11.1`
 		output, err := executeCommand(rootCmd, "sync ../tests/charts/test-chart6 --overwrite -a ex4")
 		assert.NoError(t, err)
 		expectedLoadOutput := `Pulling image: docker.io/alpine/curl:8.11.1
-Pushing image: localhost:5000/alpine/curl:8.11.1`
+Pushing image: localhost:5000/alpine/curl:8.11.1
+
+Summary: 1 pushed, 0 already in the registry, 0 failed`
 		assert.Equal(t, expectedLoadOutput, output)
 	})
 }
+
+func TestSyncOneImage(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	index, err := random.Index(512, 2, 2)
+	assert.NoError(t, err)
+	digest, err := index.Digest()
+	assert.NoError(t, err)
+	src, err := name.ParseReference(host + "/src/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.WriteIndex(src, index))
+
+	// Multi-architecture images pinned by digest keep it, with or without tag
+	for mode, dst := range map[string]string{
+		"digest":         host + "/dst/app@" + digest.String(),
+		"tag-and-digest": host + "/dst/tagged:1@" + digest.String(),
+	} {
+		t.Run(mode, func(t *testing.T) {
+			dstUri, err := image_uri.NewDockerUri(dst)
+			assert.NoError(t, err)
+			var buf strings.Builder
+			cmd := &cobra.Command{}
+			cmd.SetOut(&buf)
+			image := syncImage{src: host + "/src/app:1@" + digest.String(), dst: dstUri}
+			status, err := syncOneImage(image, syncConfig{}, nil, newBlobUploads(), cmd)
+			assert.NoError(t, err)
+			assert.Equal(t, statusPushed, status)
+
+			ref, err := name.ParseReference(dstUri.TagRef())
+			assert.NoError(t, err)
+			pushed, err := remote.Get(ref)
+			assert.NoError(t, err)
+			assert.Equal(t, digest, pushed.Digest)
+			assert.True(t, pushed.MediaType.IsIndex())
+			pushedIndex, err := pushed.ImageIndex()
+			assert.NoError(t, err)
+			assert.NoError(t, validate.Index(pushedIndex))
+		})
+	}
+}
+
+func TestSyncIndexReferrers(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	index, err := random.Index(512, 1, 2)
+	assert.NoError(t, err)
+	digest, err := index.Digest()
+	assert.NoError(t, err)
+	src, err := name.ParseReference(host + "/src/app:1")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.WriteIndex(src, index))
+	// The signature is attached to the index, not to its platform images
+	signature, err := random.Image(128, 1)
+	assert.NoError(t, err)
+	signatureTag := "sha256-" + digest.Hex + ".sig"
+	assert.NoError(t, remote.Write(src.Context().Tag(signatureTag), signature))
+
+	dstUri, err := image_uri.NewDockerUri(host + "/dst/app:1")
+	assert.NoError(t, err)
+	var buf strings.Builder
+	cmd := &cobra.Command{}
+	cmd.SetOut(&buf)
+	image := syncImage{src: src.String(), dst: dstUri}
+	_, err = syncOneImage(image, syncConfig{IncludeReferrers: true}, nil, newBlobUploads(), cmd)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "Pushing 1 referrers of image: "+host+"/dst/app\n")
+
+	dst, err := name.NewRepository(host + "/dst/app")
+	assert.NoError(t, err)
+	pushed, err := remote.Head(dst.Tag(signatureTag))
+	assert.NoError(t, err)
+	signatureDigest, err := signature.Digest()
+	assert.NoError(t, err)
+	assert.Equal(t, signatureDigest, pushed.Digest)
+}
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
 	"sort"
 	"strings"
 	"time"
 
 	dr_chartutil "github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
-	v1 "k8s.io/api/apps/v1"
-	batch_v1 "k8s.io/api/batch/v1"
 	"sigs.k8s.io/yaml"
 )
 
@@ -97,6 +97,38 @@ func isImageDeclared(image string, imageDoc []dr_chartutil.DatarobotImageDeclara
 	return false
 }
 
+// unusedImageDeclarations returns the images of the imageDoc that are not in
+// the used images, except the ones whose name or image matches an allowed
+// pattern.
+func unusedImageDeclarations(imageDoc []dr_chartutil.DatarobotImageDeclaration, usedImages []string, allowed []string) []string {
+	used := make(map[string]bool)
+	for _, image := range usedImages {
+		used[strings.TrimSpace(image)] = true
+	}
+	var unusedImages []string
+	for _, im := range imageDoc {
+		image := strings.TrimSpace(im.Image)
+		if used[image] || SliceHas(unusedImages, image) || isUnusedAllowed(im, allowed) {
+			continue
+		}
+		unusedImages = append(unusedImages, image)
+	}
+	sort.Strings(unusedImages)
+	return unusedImages
+}
+
+func isUnusedAllowed(im dr_chartutil.DatarobotImageDeclaration, allowed []string) bool {
+	for _, pattern := range allowed {
+		if matched, _ := path.Match(pattern, im.Name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, strings.TrimSpace(im.Image)); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func SliceHas(slice []string, str string) bool {
 	for _, item := range slice {
 		if item == str {
@@ -106,55 +138,48 @@ func SliceHas(slice []string, str string) bool {
 	return false
 }
 
-func ExtractImagesFromManifest(manifest string) ([]string, error) {
-	var manifestImages []string
-
-	var deployment v1.Deployment
-	if err := yaml.Unmarshal([]byte(manifest), &deployment); err != nil {
-		return nil, fmt.Errorf("Error unmarshalling YAML: %v\n", err)
-	}
-	// Collect images from init containers
-	for _, initContainer := range deployment.Spec.Template.Spec.InitContainers {
-		manifestImages = append(manifestImages, initContainer.Image)
+// writeFileAtomic writes a file through a temporary file renamed over it, so
+// that the previous content is replaced at once and never left incomplete.
+func writeFileAtomic(path string, data []byte) error {
+	err := os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
 	}
+	return os.Rename(path+".tmp", path)
+}
 
-	// Collect images from regular containers
-	for _, container := range deployment.Spec.Template.Spec.Containers {
-		manifestImages = append(manifestImages, container.Image)
+// ExtractImagesFromManifest returns the images of the containers of a rendered
+// template when it is a workload, see workloadPodSpec, and the ones found at
+// the image paths of its kind.
+func ExtractImagesFromManifest(manifest string, imagePaths []resourceImagePaths) ([]string, error) {
+	var meta struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
 	}
-
-	var statefulSet v1.StatefulSet
-	if err := yaml.Unmarshal([]byte(manifest), &statefulSet); err != nil {
+	if err := yaml.Unmarshal([]byte(manifest), &meta); err != nil {
 		return nil, fmt.Errorf("Error unmarshalling YAML: %v\n", err)
 	}
-	// Collect images from init containers
-	for _, initContainer := range statefulSet.Spec.Template.Spec.InitContainers {
-		manifestImages = append(manifestImages, initContainer.Image)
-	}
 
-	// Collect images from regular containers
-	for _, container := range statefulSet.Spec.Template.Spec.Containers {
-		manifestImages = append(manifestImages, container.Image)
+	var images []string
+	spec, err := workloadPodSpec(meta.APIVersion, meta.Kind)([]byte(manifest))
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling %s: %v\n", meta.Kind, err)
 	}
-
-	var job batch_v1.Job
-	if err := yaml.Unmarshal([]byte(manifest), &job); err != nil {
-		return nil, fmt.Errorf("Error unmarshalling YAML: %v\n", err)
+	if spec != nil {
+		images = podSpecImages(spec)
 	}
-	// Collect images from regular containers
-	for _, container := range job.Spec.Template.Spec.Containers {
-		manifestImages = append(manifestImages, container.Image)
+	customImages, err := resourceImages([]byte(manifest), meta.APIVersion, meta.Kind, imagePaths)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading images of %s: %v\n", meta.Kind, err)
 	}
+	images = append(images, customImages...)
 
-	var cronJob batch_v1.CronJob
-	if err := yaml.Unmarshal([]byte(manifest), &cronJob); err != nil {
-		return nil, fmt.Errorf("Error unmarshalling YAML: %v\n", err)
-	}
-	// Collect images from regular containers
-	for _, container := range cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers {
-		manifestImages = append(manifestImages, container.Image)
+	var manifestImages []string
+	for _, image := range images {
+		if image != "" {
+			manifestImages = append(manifestImages, image)
+		}
 	}
-
 	sort.Strings(manifestImages)
 	return manifestImages, nil
 }
@@ -3,7 +3,10 @@ package cmd
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetTransport(t *testing.T) {
@@ -94,3 +97,158 @@ E4bmYvhnmO/hlPwDN02OSWHYm6m0yIzWXw==
 		t.Fatal("Expected InsecureSkipVerify to be true")
 	}
 }
+
+func TestExtractImagesFromManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		expected []string
+	}{
+		{
+			name: "daemonset",
+			manifest: `apiVersion: apps/v1
+kind: DaemonSet
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: busybox:1.36.1
+      containers:
+        - name: agent
+          image: docker.io/datarobotdev/agent:1.0.0
+      ephemeralContainers:
+        - name: debug
+          image: docker.io/datarobotdev/debug:1.0.0`,
+			expected: []string{"busybox:1.36.1", "docker.io/datarobotdev/agent:1.0.0", "docker.io/datarobotdev/debug:1.0.0"},
+		},
+		{
+			name: "cronjob-init-containers",
+			manifest: `apiVersion: batch/v1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          initContainers:
+            - name: migrate
+              image: docker.io/datarobotdev/migrate:2.0.0
+          containers:
+            - name: job
+              image: docker.io/datarobotdev/job:2.0.0`,
+			expected: []string{"docker.io/datarobotdev/job:2.0.0", "docker.io/datarobotdev/migrate:2.0.0"},
+		},
+		{
+			name: "pod",
+			manifest: `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+    - name: app
+      image: docker.io/datarobotdev/app:3.0.0`,
+			expected: []string{"docker.io/datarobotdev/app:3.0.0"},
+		},
+		{
+			name: "pod-template",
+			manifest: `apiVersion: v1
+kind: PodTemplate
+template:
+  spec:
+    containers:
+      - name: app
+        image: docker.io/datarobotdev/app:3.0.0`,
+			expected: []string{"docker.io/datarobotdev/app:3.0.0"},
+		},
+		{
+			name: "replication-controller-without-template",
+			manifest: `apiVersion: v1
+kind: ReplicationController
+spec:
+  replicas: 1`,
+		},
+		{
+			name: "rollout",
+			manifest: `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: docker.io/datarobotdev/app:4.0.0`,
+			expected: []string{"docker.io/datarobotdev/app:4.0.0"},
+		},
+		{
+			name: "openshift-deployment-config",
+			manifest: `apiVersion: apps.openshift.io/v1
+kind: DeploymentConfig
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+        - name: app
+          image: docker.io/datarobotdev/app:6.0.0`,
+			expected: []string{"docker.io/datarobotdev/app:6.0.0"},
+		},
+		{
+			name: "custom-job-template",
+			manifest: `apiVersion: example.com/v1
+kind: ScheduledTask
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: task
+              image: docker.io/datarobotdev/task:7.0.0`,
+			expected: []string{"docker.io/datarobotdev/task:7.0.0"},
+		},
+		{
+			// Not decoded as a batch Job, whose completions is a number
+			name: "custom-job",
+			manifest: `apiVersion: example.com/v1
+kind: Job
+spec:
+  completions: all
+  template:
+    spec:
+      containers:
+        - name: job
+          image: docker.io/datarobotdev/job:8.0.0`,
+			expected: []string{"docker.io/datarobotdev/job:8.0.0"},
+		},
+		{
+			name: "configmap",
+			manifest: `apiVersion: v1
+kind: ConfigMap
+data:
+  image: docker.io/datarobotdev/app:5.0.0`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images, err := ExtractImagesFromManifest(tt.manifest, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, images)
+		})
+	}
+
+	_, err := ExtractImagesFromManifest("kind: Deployment\nspec: [", nil)
+	assert.Error(t, err)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	assert.NoError(t, writeFileAtomic(path, []byte("first")))
+	assert.NoError(t, writeFileAtomic(path, []byte("second")))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	assert.NoFileExists(t, path+".tmp")
+
+	err = writeFileAtomic(filepath.Join(t.TempDir(), "missing", "state.json"), []byte("data"))
+	assert.Error(t, err)
+}
@@ -3,11 +3,11 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"path"
 	"sort"
 	"strings"
 
 	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
-	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/render_helper"
 	"github.com/spf13/cobra"
 )
 
@@ -20,17 +20,83 @@ var validateCmd = &cobra.Command{
 
 This command is designed to validate all images presnet in a chart are declared inside the annotation
 
+The images of the init, regular and ephemeral containers are read from every workload kind:
+Pod, PodTemplate, ReplicationController, Deployment, StatefulSet, DaemonSet, ReplicaSet, Job,
+CronJob and Argo Rollout. The pod template of other kinds, such as OpenShift DeploymentConfig, is read
+at spec.template or spec.jobTemplate.spec.template.
+
+Images launched dynamically by the services are looked for with --indirect-registry in the env vars,
+args and command of the containers and in the data of the ConfigMaps. These indirect images are the
+references written with one of the given registries, or registry paths, and with a tag or a digest,
+they are reported separately when they are not declared.
+
+The declared images that no manifest uses, and that would still be shipped by save and sync, are
+reported with --unused and fail the validation with --strict. Images launched dynamically can be
+allowed to be unused with --allow-unused, by name or by image pattern such as
+registry.example.com/datarobot/*.
+
+Charts pulling different images depending on their values are validated against every combination
+of values listed in the file given with --profiles. The images each profile needs are listed with the
+ones not declared, the validation fails when any profile uses undeclared images and only the images
+no profile uses are reported as unused. The values given with -f and --set apply to every profile,
+the values files of the profiles are relative to the profiles file:
+
+'''yaml
+profiles:
+  - name: default
+  - name: gpu
+    values:
+      - values-gpu.yaml
+  - name: external-db
+    set:
+      - postgresql.enabled=false
+'''
+
+The images of custom resources are read at the JSONPath of their apiVersion and kind. Spark
+applications, KServe inference services and serving runtimes, Knative services, Argo workflows and
+Ray clusters are known, others are listed in the file given with --image-paths:
+
+'''yaml
+images:
+  - apiVersion: operators.example.com/v1  # or operators.example.com for every version
+    kind: Worker
+    paths:
+      - .spec.image
+      - .spec.pools[*].image
+'''
+
 Example:
 '''sh
 $ helm datarobot validate chart.tgz
+$ helm datarobot validate chart.tgz --image-paths image-paths.yaml
+$ helm datarobot validate chart.tgz --indirect-registry registry.example.com/datarobot
+$ helm datarobot validate chart.tgz --strict --allow-unused 'registry.example.com/datarobot/worker:*'
+$ helm datarobot validate chart.tgz --profiles profiles.yaml
 
 '''`, "'", "`", -1),
 	Args: cobra.MinimumNArgs(1), // Requires at least one argument (file path)
 	RunE: func(cmd *cobra.Command, args []string) error {
 		chartPath := args[0]
-		manifest, err := render_helper.RenderChart(chartPath, v.ValueFiles, v.Values)
+		profiles, err := loadValuesProfiles(v.Profiles, v.ValueFiles, v.Values)
+		if err != nil {
+			return err
+		}
+		imagePaths, err := loadImagePaths(v.ImagePaths)
 		if err != nil {
-			return fmt.Errorf("Error loading chart %s: %v", chartPath, err)
+			return err
+		}
+		for _, pattern := range v.AllowUnused {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Invalid --allow-unused pattern %s: %v", pattern, err)
+			}
+		}
+		var renders []profileImages
+		for _, profile := range profiles {
+			images, err := renderProfileImages(chartPath, profile, imagePaths, v.IndirectRegistries, v.Debug)
+			if err != nil {
+				return err
+			}
+			renders = append(renders, images)
 		}
 
 		imageDoc, err := chartutil.ExtractImagesFromCharts(args, annotation)
@@ -48,31 +114,60 @@ $ helm datarobot validate chart.tgz
 		if len(imageDoc) == 0 {
 			return fmt.Errorf("imageDoc is empty")
 		}
-		var errorImageAllowed []string
-		for _, template := range strings.Split(manifest, "\n---\n") {
-			if v.Debug {
-				fmt.Printf("---\n%s\n", template)
-			}
-
-			manifestImages, err := ExtractImagesFromManifest(template)
-			if err != nil {
-				return fmt.Errorf("Error ExtractImagesFromManifest chart: %v", err)
+		var errorImageAllowed, errorIndirectImages, usedImages []string
+		for _, images := range renders {
+			if v.Profiles != "" {
+				printProfileImages(cmd, images, imageDoc)
 			}
-			// Validate manifestImages against the imageDoc
-			for _, image := range manifestImages {
+			usedImages = append(usedImages, images.Images...)
+			usedImages = append(usedImages, images.IndirectImages...)
+			// Validate the images against the imageDoc
+			for _, image := range images.Images {
 				if !isImageDeclared(image, imageDoc) {
 					if !SliceHas(errorImageAllowed, image) {
 						errorImageAllowed = append(errorImageAllowed, image)
 					}
 				}
 			}
+			for _, image := range images.IndirectImages {
+				if !isImageDeclared(image, imageDoc) && !SliceHas(errorIndirectImages, image) {
+					errorIndirectImages = append(errorIndirectImages, image)
+				}
+			}
+		}
 
+		// Images run by a container with any profile are only reported once
+		var indirectNotDeclared []string
+		for _, image := range errorIndirectImages {
+			if !SliceHas(errorImageAllowed, image) {
+				indirectNotDeclared = append(indirectNotDeclared, image)
+			}
+		}
+
+		var unusedImages []string
+		if v.Unused || v.Strict {
+			unusedImages = unusedImageDeclarations(imageDoc, usedImages, v.AllowUnused)
 		}
+		unusedReport := fmt.Sprintf("Images declared as ImageDoc but not used:\n%s", strings.Join(unusedImages, "\n"))
 
-		if len(errorImageAllowed) > 0 {
-			sort.Strings(errorImageAllowed)
-			return fmt.Errorf("Images not declared as ImageDoc:\n%s", strings.Join(errorImageAllowed, "\n"))
+		if len(errorImageAllowed) > 0 || len(indirectNotDeclared) > 0 || (v.Strict && len(unusedImages) > 0) {
+			var reports []string
+			if len(errorImageAllowed) > 0 {
+				sort.Strings(errorImageAllowed)
+				reports = append(reports, fmt.Sprintf("Images not declared as ImageDoc:\n%s", strings.Join(errorImageAllowed, "\n")))
+			}
+			if len(indirectNotDeclared) > 0 {
+				sort.Strings(indirectNotDeclared)
+				reports = append(reports, fmt.Sprintf("Indirect images not declared as ImageDoc:\n%s", strings.Join(indirectNotDeclared, "\n")))
+			}
+			if v.Strict && len(unusedImages) > 0 {
+				reports = append(reports, unusedReport)
+			}
+			return fmt.Errorf("%s", strings.Join(reports, "\n"))
 		} else {
+			if len(unusedImages) > 0 {
+				cmd.Println(unusedReport)
+			}
 			cmd.Print("Image Doc Valid")
 		}
 
@@ -80,10 +175,38 @@ $ helm datarobot validate chart.tgz
 	},
 }
 
+// printProfileImages prints the images a profile needs and which of them are
+// not declared.
+func printProfileImages(out printer, images profileImages, imageDoc []chartutil.DatarobotImageDeclaration) {
+	out.Printf("Profile %s:\n", images.Profile)
+	sortedImages := append([]string{}, images.Images...)
+	sort.Strings(sortedImages)
+	for _, image := range sortedImages {
+		if isImageDeclared(image, imageDoc) {
+			out.Printf("  %s\n", image)
+		} else {
+			out.Printf("  %s (not declared)\n", image)
+		}
+	}
+	for _, image := range images.IndirectImages {
+		if isImageDeclared(image, imageDoc) {
+			out.Printf("  %s (indirect)\n", image)
+		} else {
+			out.Printf("  %s (indirect, not declared)\n", image)
+		}
+	}
+}
+
 type validateInput struct {
-	Values     []string
-	ValueFiles []string
-	Debug      bool
+	Values             []string
+	ValueFiles         []string
+	Profiles           string
+	ImagePaths         string
+	IndirectRegistries []string
+	Unused             bool
+	Strict             bool
+	AllowUnused        []string
+	Debug              bool
 }
 
 var v validateInput
@@ -93,6 +216,12 @@ func init() {
 	validateCmd.Flags().StringVarP(&annotation, "annotation", "a", "datarobot.com/images", "annotation to lookup")
 	validateCmd.Flags().BoolVarP(&v.Debug, "debug", "d", false, "debug")
 	validateCmd.Flags().StringSliceVarP(&v.ValueFiles, "values", "f", []string{}, "specify values in a YAML file or a URL (can specify multiple)")
+	validateCmd.Flags().StringVar(&v.ImagePaths, "image-paths", "", "file mapping the apiVersion and kind of custom resources to the JSONPath of their images")
+	validateCmd.Flags().StringSliceVar(&v.IndirectRegistries, "indirect-registry", []string{}, "registry, or registry path, of the indirect images to look for in env vars, args and ConfigMaps (can specify multiple)")
+	validateCmd.Flags().BoolVar(&v.Unused, "unused", false, "report the images declared as ImageDoc that no manifest uses")
+	validateCmd.Flags().BoolVar(&v.Strict, "strict", false, "fail when images declared as ImageDoc are not used by any manifest")
+	validateCmd.Flags().StringSliceVar(&v.AllowUnused, "allow-unused", []string{}, "name or image pattern of the declared images allowed to be unused, such as images launched dynamically (can specify multiple)")
+	validateCmd.Flags().StringVar(&v.Profiles, "profiles", "", "file listing the named values files and --set values combinations the chart is rendered with")
 	validateCmd.Flags().StringArrayVar(&v.Values, "set", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
 
 }
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,5 +38,81 @@ func TestCommandValidate(t *testing.T) {
 		expectedOutput := `Image Doc Valid`
 		assert.Equal(t, expectedOutput, output)
 	})
+	t.Run("test-chart7/indirect", func(t *testing.T) {
+		t.Cleanup(func() { v.IndirectRegistries = nil })
+		output, err := executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --indirect-registry registry.example.com/datarobot")
+		assert.Error(t, err)
+		expectedOutput := "Error: Indirect images not declared as ImageDoc:\nregistry.example.com/datarobot/job:1.0.0\nregistry.example.com/datarobot/launcher:1.0.0"
+		assert.Equal(t, expectedOutput, output)
+	})
+	t.Run("test-chart7", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "validate ../tests/charts/test-chart7")
+		assert.NoError(t, err)
+		expectedOutput := `Image Doc Valid`
+		assert.Equal(t, expectedOutput, output)
+	})
+	t.Run("test-chart7/unused", func(t *testing.T) {
+		t.Cleanup(func() { v.Unused = false })
+		output, err := executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --unused")
+		assert.NoError(t, err)
+		expectedOutput := `Images declared as ImageDoc but not used:
+registry.example.com/datarobot/legacy:0.9.0
+registry.example.com/datarobot/worker:1.0.0
+Image Doc Valid`
+		assert.Equal(t, expectedOutput, output)
+	})
+	t.Run("test-chart7/strict", func(t *testing.T) {
+		t.Cleanup(func() {
+			v.Strict = false
+			v.IndirectRegistries = nil
+			v.AllowUnused = nil
+		})
+		output, err := executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --strict")
+		assert.Error(t, err)
+		expectedOutput := "Error: Images declared as ImageDoc but not used:\nregistry.example.com/datarobot/legacy:0.9.0\nregistry.example.com/datarobot/worker:1.0.0"
+		assert.Equal(t, expectedOutput, output)
+
+		// Indirect images are used
+		output, err = executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --strict --indirect-registry registry.example.com")
+		assert.Error(t, err)
+		expectedOutput = "Error: Indirect images not declared as ImageDoc:\nregistry.example.com/datarobot/job:1.0.0\nregistry.example.com/datarobot/launcher:1.0.0\nImages declared as ImageDoc but not used:\nregistry.example.com/datarobot/legacy:0.9.0"
+		assert.Equal(t, expectedOutput, output)
+		v.IndirectRegistries = nil
+
+		output, err = executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --strict --allow-unused legacy --allow-unused registry.example.com/datarobot/worker:*")
+		assert.NoError(t, err)
+		assert.Equal(t, `Image Doc Valid`, output)
+
+		_, err = executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --allow-unused [x")
+		assert.EqualError(t, err, "Invalid --allow-unused pattern [x: syntax error in pattern")
+	})
+	t.Run("test-chart7/profiles", func(t *testing.T) {
+		t.Cleanup(func() {
+			v.Profiles = ""
+			v.Strict = false
+			v.Values = nil
+		})
+		output, err := executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --profiles ../tests/charts/test-chart7/ci/profiles.yaml --strict")
+		assert.Error(t, err)
+		expectedOutput := `Profile default:
+  registry.example.com/datarobot/app:1.0.0
+Profile gpu:
+  registry.example.com/datarobot/app:1.0.0
+  registry.example.com/datarobot/gpu:1.0.0 (not declared)
+Profile legacy:
+  registry.example.com/datarobot/app:1.0.0
+  registry.example.com/datarobot/legacy:0.9.0
+Error: Images not declared as ImageDoc:
+registry.example.com/datarobot/gpu:1.0.0
+Images declared as ImageDoc but not used:
+registry.example.com/datarobot/worker:1.0.0`
+		assert.Equal(t, expectedOutput, output)
+
+		// The values of the command line apply to every profile
+		output, err = executeCommand(rootCmd, "validate ../tests/charts/test-chart7 --profiles ../tests/charts/test-chart7/ci/profiles.yaml --strict --set gpu.image=registry.example.com/datarobot/worker:1.0.0")
+		assert.NoError(t, err)
+		assert.Contains(t, output, "Profile gpu:\n  registry.example.com/datarobot/app:1.0.0\n  registry.example.com/datarobot/worker:1.0.0\n")
+		assert.True(t, strings.HasSuffix(output, "Image Doc Valid"))
+	})
 
 }
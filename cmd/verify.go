@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/chartutil"
+	"github.com/datarobot-oss/helm-datarobot-plugin/pkg/image_uri"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:          "verify",
+	Short:        "verify a bundle created by save",
+	SilenceUsage: true,
+	Long: strings.Replace(`
+
+This command is designed to verify a bundle before shipping it, without a registry.
+
+Every layer, config and manifest referenced by the bundle must be present and match its
+digest, and the bundle must match the '.sha256' file saved next to it when present. When
+charts are given, every image of their annotation (with its retag) must be in the bundle,
+and the bundle must not hold any other image.
+
+With '--public-key', the signatures written by 'save --sign-key' must match the key, and
+with '--require-signature' the bundle must be signed.
+
+Delta bundles saved with 'save --base' are checked without the layers and configs they
+leave out, those are listed with the base they belong to.
+
+Example:
+'''sh
+$ helm datarobot verify images.tar.zst tests/charts/test-chart1/ --public-key cosign.pub
+Signature verified with cosign.pub
+Bundle images.tar.zst: 2 images, 0 corrupted entries, 0 missing entries, 0 missing images, 0 extra images
+Verification passed
+
+'''`, "'", "`", -1),
+	Args: cobra.MinimumNArgs(1), // Requires at least one argument (file path)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tarballPath := args[0]
+		charts := args[1:]
+
+		signature, err := newBundleSignature(verifyCfg.PublicKey, verifyCfg.RequireSignature)
+		if err != nil {
+			return fmt.Errorf("Error verifying signature: %v", err)
+		}
+		signed, signatureErr := signature.checkArchive(tarballPath)
+
+		checksumErr := verifyChecksumFile(tarballPath)
+		if checksumErr != nil {
+			cmd.Printf("Checksum mismatch: %v\n", checksumErr)
+		}
+
+		check := newBundleCheck()
+		source, err := readArchiveMetadata(tarballPath, check)
+		if err != nil {
+			return fmt.Errorf("Error reading tarball: %v", firstError(checksumErr, err))
+		}
+		manifests, format, err := readBundleManifests(source)
+		if err == nil {
+			check.delta, err = readBundleDelta(source)
+		}
+		if err == nil {
+			check.charts, err = readBundleCharts(source)
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading manifest: %v", err)
+		}
+		if check.delta != nil {
+			cmd.Printf("Delta of %s: %d layers and configs expected in the target registry\n", check.delta.Base, len(check.delta.Blobs))
+		}
+		for _, chart := range check.charts {
+			cmd.Printf("Chart %s %s: %s\n", chart.Name, chart.Version, chart.File)
+		}
+		if signatureErr == nil {
+			signatureErr = signature.checkManifest(source, format)
+		}
+		switch {
+		case signatureErr != nil:
+			cmd.Printf("Signature mismatch: %v\n", signatureErr)
+		case signed:
+			cmd.Printf("Signature verified with %s\n", verifyCfg.PublicKey)
+		case signature.key != nil:
+			cmd.Printf("Bundle %s is not signed\n", tarballPath)
+		}
+		entriesErr := check.report(manifests, format, cmd)
+		missingEntries := check.missing(manifests, format)
+
+		var missingImages, extraImages []string
+		if len(charts) > 0 {
+			images, err := chartutil.ExtractImagesFromCharts(charts, annotation)
+			if err != nil {
+				return fmt.Errorf("Error ExtractImagesFromCharts: %v", err)
+			}
+			missingImages, extraImages, err = compareBundleImages(manifests, images, verifyCfg.ImageSkipGroup)
+			if err != nil {
+				return err
+			}
+			for _, image := range missingImages {
+				cmd.Printf("Missing image %s\n", image)
+			}
+			for _, image := range extraImages {
+				cmd.Printf("Extra image %s\n", image)
+			}
+		}
+
+		cmd.Printf("Bundle %s: %d images, %d corrupted entries, %d missing entries, %d missing images, %d extra images\n",
+			tarballPath, len(manifests), len(check.corrupted), len(missingEntries), len(missingImages), len(extraImages))
+		if checksumErr != nil || signatureErr != nil || entriesErr != nil || len(missingImages) > 0 || len(extraImages) > 0 {
+			return fmt.Errorf("Verification failed")
+		}
+		cmd.Printf("Verification passed\n")
+		return nil
+	},
+}
+
+// compareBundleImages returns the images declared by the charts which are not
+// in the bundle, and the images of the bundle no chart declares.
+func compareBundleImages(manifests []ImageManifest, images []chartutil.DatarobotImageDeclaration, skipGroups []string) ([]string, []string, error) {
+	bundled := make(map[string]string)
+	for _, manifest := range manifests {
+		key, err := bundleImageKey(manifest.OriginalImage)
+		if err != nil {
+			return nil, nil, err
+		}
+		bundled[key] = manifest.OriginalImage
+	}
+
+	var missing []string
+	declared := make(map[string]bool)
+	for _, image := range images {
+		if SliceHas(skipGroups, image.Group) {
+			continue
+		}
+		iUri, err := image_uri.NewDockerUri(image.Image)
+		if err != nil {
+			return nil, nil, err
+		}
+		if image.Tag != "" {
+			iUri.Tag = image.Tag
+		}
+		key, err := bundleImageKey(iUri.String())
+		if err != nil {
+			return nil, nil, err
+		}
+		if declared[key] {
+			continue
+		}
+		declared[key] = true
+		if _, ok := bundled[key]; !ok {
+			missing = append(missing, iUri.String())
+		}
+	}
+
+	var extra []string
+	for key, image := range bundled {
+		if !declared[key] {
+			extra = append(extra, image)
+		}
+	}
+	sort.Strings(extra)
+	return missing, extra, nil
+}
+
+// bundleImageKey identifies an image by its tag when it has one, OCI layout
+// bundles only record the tag of images pinned by digest.
+func bundleImageKey(image string) (string, error) {
+	iUri, err := image_uri.NewDockerUri(image)
+	if err != nil {
+		return "", err
+	}
+	if iUri.Tag != "" {
+		return iUri.TagRef(), nil
+	}
+	return iUri.String(), nil
+}
+
+type verifyConfig struct {
+	ImageSkipGroup   []string
+	PublicKey        string
+	RequireSignature bool
+}
+
+var verifyCfg verifyConfig
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVarP(&annotation, "annotation", "a", "datarobot.com/images", "annotation to lookup")
+	verifyCmd.Flags().StringArrayVarP(&verifyCfg.ImageSkipGroup, "skip-group", "", []string{}, "Specify which image group was skipped when saving the bundle (can be used multiple times)")
+	verifyCmd.Flags().StringVarP(&verifyCfg.PublicKey, "public-key", "", "", "Path to the public key to verify the signature of the bundle with")
+	verifyCmd.Flags().BoolVarP(&verifyCfg.RequireSignature, "require-signature", "", false, "Fail when the bundle is not signed with --public-key")
+}
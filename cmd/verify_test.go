@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestBundle saves a random image for every original image name and
+// returns the path of the archive.
+func writeTestBundle(t *testing.T, originalImages ...string) string {
+	return writeSignedTestBundle(t, nil, originalImages...)
+}
+
+// writeSignedTestBundle saves a test bundle signed with key, when not nil.
+func writeSignedTestBundle(t *testing.T, key crypto.Signer, originalImages ...string) string {
+	outputDir := t.TempDir()
+	for _, dir := range formatNative.dirs() {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outputDir, dir), 0755))
+	}
+	var manifests []ImageManifest
+	for _, originalImage := range originalImages {
+		image, err := random.Image(256, 1)
+		assert.NoError(t, err)
+		manifest, err := exportImage(image, dirWriter(outputDir), formatNative, newBlobSet())
+		assert.NoError(t, err)
+		manifest.OriginalImage = originalImage
+		manifests = append(manifests, manifest)
+	}
+	assert.NoError(t, saveManifest(signBundle(dirWriter(outputDir), formatNative, key), manifests))
+
+	tarballPath := filepath.Join(t.TempDir(), "images.tar.zst")
+	assert.NoError(t, createTarball(tarballPath, outputDir, formatNative, zstd.SpeedFastest, 0))
+	assert.NoError(t, writeArchiveChecksum(tarballPath, key))
+	return tarballPath
+}
+
+func TestCommandVerify(t *testing.T) {
+	t.Run("bundle-only", func(t *testing.T) {
+		tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+		output, err := executeCommand(rootCmd, "verify "+tarballPath)
+		assert.NoError(t, err)
+		expectedOutput := `Bundle ` + tarballPath + `: 1 images, 0 corrupted entries, 0 missing entries, 0 missing images, 0 extra images
+Verification passed`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("chart", func(t *testing.T) {
+		tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable", "docker.io/library/busybox:simple", "docker.io/alpine/curl:8.10.0")
+		output, err := executeCommand(rootCmd, "verify "+tarballPath+" ../tests/charts/test-chart4")
+		assert.NoError(t, err)
+		expectedOutput := `Bundle ` + tarballPath + `: 3 images, 0 corrupted entries, 0 missing entries, 0 missing images, 0 extra images
+Verification passed`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("missing-extra-images", func(t *testing.T) {
+		tarballPath := writeTestBundle(t, "docker.io/alpine/curl:8.9.1", "docker.io/library/busybox:simple", "docker.io/library/nginx:1.27")
+		output, err := executeCommand(rootCmd, "verify "+tarballPath+" ../tests/charts/test-chart4")
+		assert.Error(t, err)
+		expectedOutput := `Missing image docker.io/alpine/curl:stable
+Missing image docker.io/alpine/curl:8.10.0
+Extra image docker.io/alpine/curl:8.9.1
+Extra image docker.io/library/nginx:1.27
+Bundle ` + tarballPath + `: 3 images, 0 corrupted entries, 0 missing entries, 2 missing images, 2 extra images
+Error: Verification failed`
+		assert.Equal(t, expectedOutput, output)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+		assert.NoError(t, os.WriteFile(checksumFile(tarballPath), []byte("0000000000000000000000000000000000000000000000000000000000000000  images.tar.zst\n"), 0644))
+		output, err := executeCommand(rootCmd, "verify "+tarballPath)
+		assert.Error(t, err)
+		digest, err := fileDigest(tarballPath)
+		assert.NoError(t, err)
+		expectedOutput := `Checksum mismatch: ` + tarballPath + ` does not match its checksum: expected sha256:0000000000000000000000000000000000000000000000000000000000000000, got ` + digest.String() + `
+Bundle ` + tarballPath + `: 1 images, 0 corrupted entries, 0 missing entries, 0 missing images, 0 extra images
+Error: Verification failed`
+		assert.Equal(t, expectedOutput, output)
+	})
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// volumeFile returns the path of a volume of an archive split with
+// --split-size, volumes are numbered from 001.
+func volumeFile(archivePath string, idx int) string {
+	return fmt.Sprintf("%s.%03d", archivePath, idx+1)
+}
+
+// parseSplitSize parses a volume size in bytes, with an optional decimal
+// (K, M, G, T) or binary (Ki, Mi, Gi, Ti) unit. Decimal units keep a 4G volume
+// under the 4 GiB limit of FAT32.
+func parseSplitSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+	value := strings.TrimSuffix(strings.TrimSpace(size), "B")
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+// createArchive creates the file an archive is written to, or its volumes when
+// splitSize is set. Volumes left by a previous save are removed so that they
+// are not mistaken for part of the new archive.
+func createArchive(archivePath string, splitSize int64) (io.WriteCloser, error) {
+	err := removeArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if splitSize == 0 {
+		file, err := os.Create(archivePath)
+		if err != nil {
+			return nil, fmt.Errorf("error creating tarball: %v", err)
+		}
+		return file, nil
+	}
+	return &volumeWriter{archivePath: archivePath, size: splitSize}, nil
+}
+
+// removeArchive removes an archive and its volumes.
+func removeArchive(archivePath string) error {
+	volumes, err := findVolumes(archivePath)
+	if err != nil {
+		return err
+	}
+	for _, volume := range append(volumes, archivePath) {
+		err := os.Remove(volume)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing %s: %v", volume, err)
+		}
+	}
+	return nil
+}
+
+// volumeWriter writes an archive into volumes of at most size bytes, a new
+// volume is created once the current one is full.
+type volumeWriter struct {
+	archivePath string
+	size        int64
+	volumes     int
+	file        *os.File
+	written     int64
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.file == nil || w.written == w.size {
+			err := w.next()
+			if err != nil {
+				return total, err
+			}
+		}
+		n, err := w.file.Write(p[:min(int64(len(p)), w.size-w.written)])
+		total += n
+		w.written += int64(n)
+		p = p[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// next closes the current volume and creates the following one.
+func (w *volumeWriter) next() error {
+	if w.file != nil {
+		err := w.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	file, err := os.Create(volumeFile(w.archivePath, w.volumes))
+	if err != nil {
+		return fmt.Errorf("error creating volume: %v", err)
+	}
+	w.file = file
+	w.volumes++
+	w.written = 0
+	return nil
+}
+
+func (w *volumeWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// findVolumes returns the volumes of a split archive found next to it, in
+// order.
+func findVolumes(archivePath string) ([]string, error) {
+	volumes, err := filepath.Glob(globEscape(archivePath) + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(volumes)
+	return volumes, nil
+}
+
+// globEscape escapes the metacharacters of filepath.Match in a path.
+func globEscape(path string) string {
+	var escaped strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// archiveVolume is a file an archive is stored in, with the digest listed for
+// it in the checksum file when known.
+type archiveVolume struct {
+	path   string
+	digest v1.Hash
+}
+
+// archiveVolumes returns the files an archive is stored in: the archive itself,
+// or its volumes when it was split with --split-size. The checksum file lists
+// the volumes in order, otherwise they are found next to the archive. Missing
+// volumes are reported.
+func archiveVolumes(archivePath string) ([]archiveVolume, error) {
+	_, err := os.Stat(archivePath)
+	if err == nil || !os.IsNotExist(err) {
+		return []archiveVolume{{path: archivePath}}, nil
+	}
+
+	var volumes []archiveVolume
+	data, err := os.ReadFile(checksumFile(archivePath))
+	switch {
+	case err == nil:
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid checksum file %s: %q", checksumFile(archivePath), line)
+			}
+			digest, err := v1.NewHash("sha256:" + fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid checksum file %s: %v", checksumFile(archivePath), err)
+			}
+			volumes = append(volumes, archiveVolume{
+				path:   filepath.Join(filepath.Dir(archivePath), filepath.Base(fields[1])),
+				digest: digest,
+			})
+		}
+	case os.IsNotExist(err):
+		found, err := findVolumes(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return []archiveVolume{{path: archivePath}}, nil
+		}
+		// The volumes are numbered without gaps, up to the last one found
+		last, _ := strconv.Atoi(strings.TrimPrefix(filepath.Ext(found[len(found)-1]), "."))
+		for idx := 0; idx < last; idx++ {
+			volumes = append(volumes, archiveVolume{path: volumeFile(archivePath, idx)})
+		}
+	default:
+		return nil, fmt.Errorf("error reading checksum file: %v", err)
+	}
+
+	var missing []string
+	for _, volume := range volumes {
+		_, err := os.Stat(volume.path)
+		if err != nil {
+			missing = append(missing, filepath.Base(volume.path))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%d of the %d volumes of %s are missing: %s", len(missing), len(volumes), archivePath, strings.Join(missing, ", "))
+	}
+	return volumes, nil
+}
+
+// openArchive opens an archive, or the concatenation of its volumes when it
+// was split. Volumes with a known digest are verified as they are read.
+func openArchive(archivePath string) (io.ReadCloser, error) {
+	volumes, err := archiveVolumes(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 1 && volumes[0].path == archivePath {
+		return os.Open(archivePath)
+	}
+	return &volumeReader{volumes: volumes}, nil
+}
+
+// volumeReader reads the volumes of an archive one after the other, a volume
+// which does not match its digest fails the read once it is fully read.
+type volumeReader struct {
+	volumes []archiveVolume
+	file    *os.File
+	hash    hash.Hash
+	reader  io.Reader
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.file == nil {
+			if len(r.volumes) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(r.volumes[0].path)
+			if err != nil {
+				return 0, fmt.Errorf("error opening volume: %v", err)
+			}
+			r.file = file
+			r.hash = sha256.New()
+			r.reader = io.TeeReader(file, r.hash)
+		}
+
+		n, err := r.reader.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		volume := r.volumes[0]
+		r.file.Close()
+		r.file = nil
+		r.volumes = r.volumes[1:]
+		digest := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(r.hash.Sum(nil))}
+		if volume.digest != (v1.Hash{}) && digest != volume.digest {
+			return n, fmt.Errorf("volume %s is corrupted: expected %s, got %s", filepath.Base(volume.path), volume.digest, digest)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *volumeReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
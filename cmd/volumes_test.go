@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// splitTestBundle rewrites a bundle archive as volumes of size bytes, listed
+// in its checksum file, and returns the number of volumes.
+func splitTestBundle(t *testing.T, tarballPath string, size int64) int {
+	data, err := os.ReadFile(tarballPath)
+	assert.NoError(t, err)
+	writer, err := createArchive(tarballPath, size)
+	assert.NoError(t, err)
+	_, err = writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, writeChecksumFile(tarballPath))
+	volumes, err := findVolumes(tarballPath)
+	assert.NoError(t, err)
+	return len(volumes)
+}
+
+func TestParseSplitSize(t *testing.T) {
+	for size, expected := range map[string]int64{
+		"1024": 1024,
+		"700M": 700_000_000,
+		"4G":   4_000_000_000,
+		"4GB":  4_000_000_000,
+		"1Gi":  1 << 30,
+		"2KiB": 2048,
+	} {
+		n, err := parseSplitSize(size)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n, size)
+	}
+	for _, size := range []string{"", "0", "-1G", "4X", "G"} {
+		_, err := parseSplitSize(size)
+		assert.ErrorContains(t, err, "invalid size")
+	}
+}
+
+func TestSplitArchive(t *testing.T) {
+	tarballPath := writeTestBundle(t, "docker.io/alpine/curl:stable")
+	data, err := os.ReadFile(tarballPath)
+	assert.NoError(t, err)
+	volumes := splitTestBundle(t, tarballPath, 256)
+	assert.Equal(t, (len(data)+255)/256, volumes)
+	assert.NoFileExists(t, tarballPath)
+
+	// The checksum file lists the volumes in order, as sha256sum does
+	sidecar, err := os.ReadFile(checksumFile(tarballPath))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(sidecar)), "\n")
+	assert.Len(t, lines, volumes)
+	assert.True(t, strings.HasSuffix(lines[0], "  images.tar.zst.001"))
+
+	file, err := openArchive(tarballPath)
+	assert.NoError(t, err)
+	read, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	assert.Equal(t, data, read)
+	assert.NoError(t, verifyChecksumFile(tarballPath))
+
+	check := newBundleCheck()
+	source, err := readArchiveMetadata(tarballPath, check)
+	assert.NoError(t, err)
+	manifests, format, err := readBundleManifests(source)
+	assert.NoError(t, err)
+	assert.NoError(t, check.report(manifests, format, newSyncPrinter(rootCmd)))
+
+	// Volumes are found without the checksum file too
+	assert.NoError(t, os.Rename(checksumFile(tarballPath), checksumFile(tarballPath)+".bak"))
+	_, err = readArchiveMetadata(tarballPath, newBundleCheck())
+	assert.NoError(t, err)
+	assert.NoError(t, os.Rename(checksumFile(tarballPath)+".bak", checksumFile(tarballPath)))
+
+	t.Run("corrupted", func(t *testing.T) {
+		volume := volumeFile(tarballPath, 1)
+		original, err := os.ReadFile(volume)
+		assert.NoError(t, err)
+		defer os.WriteFile(volume, original, 0644)
+		corrupted := append([]byte{}, original...)
+		corrupted[0] ^= 0xff
+		assert.NoError(t, os.WriteFile(volume, corrupted, 0644))
+
+		err = verifyChecksumFile(tarballPath)
+		assert.ErrorContains(t, err, "1 of the "+strconv.Itoa(volumes)+" volumes of "+tarballPath+" do not match their checksum: images.tar.zst.002")
+		_, err = readArchiveMetadata(tarballPath, newBundleCheck())
+		assert.ErrorContains(t, err, "volume images.tar.zst.002 is corrupted")
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		volume := volumeFile(tarballPath, 1)
+		assert.NoError(t, os.Rename(volume, volume+".bak"))
+		defer os.Rename(volume+".bak", volume)
+
+		output, err := executeCommand(rootCmd, "verify "+tarballPath)
+		assert.Error(t, err)
+		assert.Contains(t, output, "1 of the "+strconv.Itoa(volumes)+" volumes of "+tarballPath+" are missing: images.tar.zst.002")
+		output, err = executeCommand(rootCmd, "inspect "+tarballPath)
+		assert.Error(t, err)
+		assert.Contains(t, output, "images.tar.zst.002")
+
+		// Without the checksum file, the gap in the numbering is reported
+		assert.NoError(t, os.Rename(checksumFile(tarballPath), checksumFile(tarballPath)+".bak"))
+		defer os.Rename(checksumFile(tarballPath)+".bak", checksumFile(tarballPath))
+		_, err = openArchive(tarballPath)
+		assert.ErrorContains(t, err, "are missing: images.tar.zst.002")
+	})
+
+	t.Run("command", func(t *testing.T) {
+		output, err := executeCommand(rootCmd, "verify "+tarballPath)
+		assert.NoError(t, err)
+		assert.Contains(t, output, "Verification passed")
+		output, err = executeCommand(rootCmd, "inspect "+tarballPath)
+		assert.NoError(t, err)
+		assert.Contains(t, output, "docker.io/alpine/curl:stable")
+	})
+
+	// Saving again removes the volumes of the previous archive
+	writer, err := createArchive(tarballPath, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	found, err := filepath.Glob(tarballPath + ".0*")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
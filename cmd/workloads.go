@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"strings"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	core_v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// podSpecFunc decodes a manifest of a workload kind and returns its pod spec,
+// nil when the workload has none.
+type podSpecFunc func(manifest []byte) (*core_v1.PodSpec, error)
+
+// groupKind identifies a kind by its API group, empty for the core group.
+type groupKind struct {
+	group string
+	kind  string
+}
+
+// workloadKinds maps the kinds running pods to the path of their pod spec.
+var workloadKinds = map[groupKind]podSpecFunc{
+	{"", "Pod"}: podSpecOf(func(pod *core_v1.Pod) *core_v1.PodSpec {
+		return &pod.Spec
+	}),
+	{"", "PodTemplate"}: podSpecOf(func(template *core_v1.PodTemplate) *core_v1.PodSpec {
+		return &template.Template.Spec
+	}),
+	{"", "ReplicationController"}: podSpecOf(func(rc *core_v1.ReplicationController) *core_v1.PodSpec {
+		if rc.Spec.Template == nil {
+			return nil
+		}
+		return &rc.Spec.Template.Spec
+	}),
+	{"apps", "Deployment"}: podSpecOf(func(deployment *apps_v1.Deployment) *core_v1.PodSpec {
+		return &deployment.Spec.Template.Spec
+	}),
+	{"apps", "StatefulSet"}: podSpecOf(func(statefulSet *apps_v1.StatefulSet) *core_v1.PodSpec {
+		return &statefulSet.Spec.Template.Spec
+	}),
+	{"apps", "DaemonSet"}: podSpecOf(func(daemonSet *apps_v1.DaemonSet) *core_v1.PodSpec {
+		return &daemonSet.Spec.Template.Spec
+	}),
+	{"apps", "ReplicaSet"}: podSpecOf(func(replicaSet *apps_v1.ReplicaSet) *core_v1.PodSpec {
+		return &replicaSet.Spec.Template.Spec
+	}),
+	{"batch", "Job"}: podSpecOf(func(job *batch_v1.Job) *core_v1.PodSpec {
+		return &job.Spec.Template.Spec
+	}),
+	{"batch", "CronJob"}: podSpecOf(func(cronJob *batch_v1.CronJob) *core_v1.PodSpec {
+		return &cronJob.Spec.JobTemplate.Spec.Template.Spec
+	}),
+	// Argo Rollouts referencing a Deployment with workloadRef have no template
+	{"argoproj.io", "Rollout"}: podSpecOf(func(rollout *argoRollout) *core_v1.PodSpec {
+		return &rollout.Spec.Template.Spec
+	}),
+}
+
+// argoRollout is the part of an argoproj.io Rollout holding its pods.
+type argoRollout struct {
+	Spec struct {
+		Template core_v1.PodTemplateSpec `json:"template"`
+	} `json:"spec"`
+}
+
+// podTemplateWorkload is the part holding the pods of the kinds which are not
+// in workloadKinds, such as OpenShift DeploymentConfigs or custom resources,
+// when they follow the layout of Deployments or CronJobs.
+type podTemplateWorkload struct {
+	Spec struct {
+		Template    *core_v1.PodTemplateSpec `json:"template"`
+		JobTemplate *struct {
+			Spec struct {
+				Template *core_v1.PodTemplateSpec `json:"template"`
+			} `json:"spec"`
+		} `json:"jobTemplate"`
+	} `json:"spec"`
+}
+
+// workloadPodSpec returns the function decoding the pod spec of a manifest of
+// the given apiVersion and kind, the spec.template.spec or
+// spec.jobTemplate.spec.template.spec of the kinds not in workloadKinds.
+func workloadPodSpec(apiVersion string, kind string) podSpecFunc {
+	group, _, found := strings.Cut(apiVersion, "/")
+	if !found {
+		group = ""
+	}
+	if podSpec, ok := workloadKinds[groupKind{group, kind}]; ok {
+		return podSpec
+	}
+	return podSpecOf(func(workload *podTemplateWorkload) *core_v1.PodSpec {
+		if workload.Spec.Template != nil {
+			return &workload.Spec.Template.Spec
+		}
+		if workload.Spec.JobTemplate != nil && workload.Spec.JobTemplate.Spec.Template != nil {
+			return &workload.Spec.JobTemplate.Spec.Template.Spec
+		}
+		return nil
+	})
+}
+
+func podSpecOf[T any](spec func(*T) *core_v1.PodSpec) podSpecFunc {
+	return func(manifest []byte) (*core_v1.PodSpec, error) {
+		var workload T
+		if err := yaml.Unmarshal(manifest, &workload); err != nil {
+			return nil, err
+		}
+		return spec(&workload), nil
+	}
+}
+
+// podSpecContainers returns the init, regular and ephemeral containers of a
+// pod spec.
+func podSpecContainers(spec *core_v1.PodSpec) []core_v1.Container {
+	var containers []core_v1.Container
+	containers = append(containers, spec.InitContainers...)
+	containers = append(containers, spec.Containers...)
+	for _, container := range spec.EphemeralContainers {
+		containers = append(containers, core_v1.Container(container.EphemeralContainerCommon))
+	}
+	return containers
+}
+
+// podSpecImages returns the images of the containers of a pod spec.
+func podSpecImages(spec *core_v1.PodSpec) []string {
+	var images []string
+	for _, container := range podSpecContainers(spec) {
+		images = append(images, container.Image)
+	}
+	return images
+}
@@ -1,94 +1,211 @@
 package image_uri
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
 )
 
-// DockerImage represents a parsed Docker image URL.
+const (
+	// DefaultRegistry is the registry used when a reference does not declare one.
+	DefaultRegistry = "docker.io"
+	// OfficialRepoPrefix is the namespace of single-component docker.io repositories.
+	OfficialRepoPrefix = "library"
+	// NameTotalLengthMax is the maximum length of the registry and repository path.
+	NameTotalLengthMax = 255
+
+	legacyDefaultRegistry = "index.docker.io"
+)
+
+var (
+	// ErrReferenceInvalidFormat is returned when the reference does not match the grammar.
+	ErrReferenceInvalidFormat = errors.New("invalid reference format")
+	// ErrNameEmpty is returned when the reference has no repository name.
+	ErrNameEmpty = errors.New("repository name must have at least one component")
+	// ErrNameContainsUppercase is returned when the repository path has capital letters.
+	ErrNameContainsUppercase = errors.New("repository name must be lowercase")
+	// ErrNameTooLong is returned when the repository name is longer than NameTotalLengthMax.
+	ErrNameTooLong = fmt.Errorf("repository name must not be more than %d characters", NameTotalLengthMax)
+	// ErrRegistryInvalidFormat is returned when the registry host is malformed.
+	ErrRegistryInvalidFormat = errors.New("invalid registry host format")
+	// ErrTagInvalidFormat is returned when the tag is malformed.
+	ErrTagInvalidFormat = errors.New("invalid tag format")
+	// ErrDigestInvalidFormat is returned when the digest is malformed.
+	ErrDigestInvalidFormat = errors.New("invalid digest format")
+)
+
+// Patterns follow the reference grammar of the distribution project, see
+// https://github.com/distribution/reference/blob/main/reference.go
+var (
+	registryPattern      = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+	pathComponentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagPattern           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern        = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+)
+
+// ParseError describes a reference that could not be parsed. The underlying
+// Err is one of the Err* variables of this package.
+type ParseError struct {
+	Reference string
+	Err       error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid Docker image URL %q: %v", e.Reference, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// DockerUri represents a parsed Docker image URL.
 type DockerUri struct {
 	RegistryHost string
 	Organization string
 	Project      string
 	ImageName    string
 	Tag          string
+	Digest       string
+	// ImplicitLibrary is set when the library namespace was added to a
+	// single-component docker.io repository written without it.
+	ImplicitLibrary bool
 }
 
-// ParseDockerImage parses a Docker image URL and extracts its components.
+// NewDockerUri parses a Docker image URL and extracts its components.
+//
+// The first path component is only treated as a registry host when it contains
+// a "." or a ":" or is "localhost", bare names are normalized to docker.io and
+// single-component docker.io repositories to docker.io/library.
 func NewDockerUri(imageURL string) (DockerUri, error) {
-	// Define a regex pattern to match the Docker image URL
-	pattern := `^(?:(?P<registry>[^/]+)/)?(?:(?P<org>[^/]+)/)?(?:(?P<projects>.+?)/)?(?P<imageName>[^:]+)(?::(?P<tag>.+))?$`
-	re := regexp.MustCompile(pattern)
-	dockerImage := DockerUri{
-		RegistryHost: "docker.io", // Default registry
-		Tag:          "latest",    // Default tag
+	dockerImage := DockerUri{}
+	fail := func(err error) (DockerUri, error) {
+		return DockerUri{}, &ParseError{Reference: imageURL, Err: err}
 	}
 
-	// Match the image URL against the regex pattern
-	matches := re.FindStringSubmatch(imageURL)
-	if matches == nil {
-		return dockerImage, fmt.Errorf("invalid Docker image URL: %s", imageURL)
+	if imageURL == "" {
+		return fail(ErrNameEmpty)
 	}
 
-	groupNames := re.SubexpNames()
-	result := make(map[string]string)
-	for i, match := range matches {
-		if i != 0 { // Skip the full match
-			result[groupNames[i]] = match
+	remainder := imageURL
+	if idx := strings.Index(remainder, "@"); idx != -1 {
+		dockerImage.Digest = remainder[idx+1:]
+		remainder = remainder[:idx]
+		if !digestPattern.MatchString(dockerImage.Digest) {
+			return fail(ErrDigestInvalidFormat)
 		}
 	}
 
-	// Split the projects by '/' if it exists
-	var projects []string
-	if projectsStr, ok := result["projects"]; ok && projectsStr != "" {
-		projects = regexp.MustCompile(`/`).Split(projectsStr, -1)
+	// The tag separator is the last ":" after the last "/", any other ":" is
+	// part of the registry port
+	if idx := strings.LastIndex(remainder, ":"); idx != -1 && idx > strings.LastIndex(remainder, "/") {
+		dockerImage.Tag = remainder[idx+1:]
+		remainder = remainder[:idx]
+		if !tagPattern.MatchString(dockerImage.Tag) {
+			return fail(ErrTagInvalidFormat)
+		}
 	}
 
-	dockerImage.RegistryHost = result["registry"] // Optional registry host
-	dockerImage.Organization = result["org"]      // Optional organization
-	dockerImage.Project = strings.Join(projects, "/")
-	dockerImage.ImageName = result["imageName"]
-	dockerImage.Tag = result["tag"] // Optional tag
+	if remainder == "" {
+		return fail(ErrNameEmpty)
+	}
+	if len(remainder) > NameTotalLengthMax {
+		return fail(ErrNameTooLong)
+	}
+
+	registry, path := splitRegistry(remainder)
+	if !registryPattern.MatchString(registry) {
+		return fail(ErrRegistryInvalidFormat)
+	}
+	if registry == legacyDefaultRegistry {
+		registry = DefaultRegistry
+	}
+	if path == "" {
+		return fail(ErrNameEmpty)
+	}
 
-	// If the registry host is not provided, set it to "docker.io" (default)
-	if dockerImage.RegistryHost == "" {
-		dockerImage.RegistryHost = "docker.io"
+	components := strings.Split(path, "/")
+	for _, component := range components {
+		if pathComponentPattern.MatchString(component) {
+			continue
+		}
+		if pathComponentPattern.MatchString(strings.ToLower(component)) {
+			return fail(ErrNameContainsUppercase)
+		}
+		return fail(ErrReferenceInvalidFormat)
 	}
 
-	if dockerImage.ImageName == "" && dockerImage.Project != "" {
-		dockerImage.ImageName = dockerImage.Project
-		dockerImage.Project = ""
+	if registry == DefaultRegistry && len(components) == 1 {
+		components = append([]string{OfficialRepoPrefix}, components...)
+		dockerImage.ImplicitLibrary = true
 	}
 
-	if strings.Contains(dockerImage.ImageName, "/") {
-		parts := strings.Split(dockerImage.ImageName, "/")
-		dockerImage.ImageName = parts[len(parts)-1]
-		dockerImage.Project += "/" + strings.Join(parts[:len(parts)-1], "/")
+	dockerImage.RegistryHost = registry
+	dockerImage.ImageName = components[len(components)-1]
+	if len(components) > 1 {
+		dockerImage.Organization = components[0]
+		dockerImage.Project = strings.Join(components[1:len(components)-1], "/")
 	}
 
 	return dockerImage, nil
 }
 
+// splitRegistry splits the registry host from the repository path.
+func splitRegistry(name string) (string, string) {
+	idx := strings.Index(name, "/")
+	if idx == -1 {
+		return DefaultRegistry, name
+	}
+	candidate := name[:idx]
+	if !strings.ContainsAny(candidate, ".:") && candidate != "localhost" && strings.ToLower(candidate) == candidate {
+		return DefaultRegistry, name
+	}
+	return candidate, name[idx+1:]
+}
+
+// AsWritten returns the reference without the library namespace added by
+// NewDockerUri. Normalized references identify and compare images, the path
+// as written is kept for the repositories images are pushed to.
+func (d DockerUri) AsWritten() DockerUri {
+	if d.ImplicitLibrary {
+		d.Organization = ""
+		d.ImplicitLibrary = false
+	}
+	return d
+}
+
 func (d *DockerUri) Base() string {
 	return d.Join([]string{d.RegistryHost, d.Organization, d.Project, d.ImageName}, "/")
 }
 
 func (d *DockerUri) RefName() string {
 	path := d.Join([]string{d.Organization, d.Project, d.ImageName}, "/")
-	tag := ""
+	return fmt.Sprintf("%s%s", path, d.identifier())
+}
+
+func (d *DockerUri) String() string {
+	return fmt.Sprintf("%s%s", d.Base(), d.identifier())
+}
+
+// TagRef returns the reference used to push the image: the tag when one is
+// set, otherwise the digest.
+func (d *DockerUri) TagRef() string {
 	if d.Tag != "" {
-		tag = ":" + d.Tag
+		return fmt.Sprintf("%s:%s", d.Base(), d.Tag)
 	}
-	return fmt.Sprintf("%s%s", path, tag)
+	return d.String()
 }
 
-func (d *DockerUri) String() string {
-	tag := ""
+// identifier returns the ":tag", "@digest" or ":tag@digest" suffix.
+func (d *DockerUri) identifier() string {
+	id := ""
 	if d.Tag != "" {
-		tag = ":" + d.Tag
+		id = ":" + d.Tag
+	}
+	if d.Digest != "" {
+		id += "@" + d.Digest
 	}
-	return fmt.Sprintf("%s%s", d.Base(), tag)
+	return id
 }
 
 func (d *DockerUri) Join(s []string, delimit string) string {
@@ -1,6 +1,8 @@
 package image_uri
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -13,11 +15,12 @@ func TestParseDockerImage(t *testing.T) {
 		{
 			image: "nginx:1.19",
 			expected: DockerUri{
-				RegistryHost: "docker.io",
-				Organization: "",
-				Project:      "",
-				ImageName:    "nginx",
-				Tag:          "1.19",
+				RegistryHost:    "docker.io",
+				Organization:    "library",
+				ImplicitLibrary: true,
+				Project:         "",
+				ImageName:       "nginx",
+				Tag:             "1.19",
 			},
 			expectErr: false,
 		},
@@ -57,23 +60,122 @@ func TestParseDockerImage(t *testing.T) {
 		{
 			image: "myimage:latest",
 			expected: DockerUri{
-				RegistryHost: "docker.io",
-				Project:      "",
-				ImageName:    "myimage",
-				Tag:          "latest",
+				RegistryHost:    "docker.io",
+				Organization:    "library",
+				ImplicitLibrary: true,
+				Project:         "",
+				ImageName:       "myimage",
+				Tag:             "latest",
 			},
 			expectErr: false,
 		},
 		{
 			image: "myimage",
 			expected: DockerUri{
-				RegistryHost: "docker.io",
-				Project:      "",
+				RegistryHost:    "docker.io",
+				Organization:    "library",
+				ImplicitLibrary: true,
+				Project:         "",
+				ImageName:       "myimage",
+				Tag:             "",
+			},
+			expectErr: false,
+		},
+		{
+			image: "myregistry.com/myrepo/myimage@sha256:0fd4e4a5cb9b1d39b7fb8e1e3d5dfde4a5e8d4f8e1b8b0f3f13b8e6e4a2d7c9b",
+			expected: DockerUri{
+				RegistryHost: "myregistry.com",
+				Organization: "myrepo",
+				ImageName:    "myimage",
+				Digest:       "sha256:0fd4e4a5cb9b1d39b7fb8e1e3d5dfde4a5e8d4f8e1b8b0f3f13b8e6e4a2d7c9b",
+			},
+			expectErr: false,
+		},
+		{
+			image: "myregistry.com/myrepo/myimage:1.0.0@sha256:0fd4e4a5cb9b1d39b7fb8e1e3d5dfde4a5e8d4f8e1b8b0f3f13b8e6e4a2d7c9b",
+			expected: DockerUri{
+				RegistryHost: "myregistry.com",
+				Organization: "myrepo",
 				ImageName:    "myimage",
-				Tag:          "",
+				Tag:          "1.0.0",
+				Digest:       "sha256:0fd4e4a5cb9b1d39b7fb8e1e3d5dfde4a5e8d4f8e1b8b0f3f13b8e6e4a2d7c9b",
 			},
 			expectErr: false,
 		},
+		{
+			image: "datarobot/app:1",
+			expected: DockerUri{
+				RegistryHost: "docker.io",
+				Organization: "datarobot",
+				ImageName:    "app",
+				Tag:          "1",
+			},
+		},
+		{
+			image: "docker.io/busybox:1.36.1",
+			expected: DockerUri{
+				RegistryHost:    "docker.io",
+				Organization:    "library",
+				ImplicitLibrary: true,
+				ImageName:       "busybox",
+				Tag:             "1.36.1",
+			},
+		},
+		{
+			image: "index.docker.io/datarobot/app",
+			expected: DockerUri{
+				RegistryHost: "docker.io",
+				Organization: "datarobot",
+				ImageName:    "app",
+			},
+		},
+		{
+			image: "localhost/app:1",
+			expected: DockerUri{
+				RegistryHost: "localhost",
+				ImageName:    "app",
+				Tag:          "1",
+			},
+		},
+		{
+			image: "localhost:5000/app",
+			expected: DockerUri{
+				RegistryHost: "localhost:5000",
+				ImageName:    "app",
+			},
+		},
+		{
+			image: "registry:5000/org/app:1.0",
+			expected: DockerUri{
+				RegistryHost: "registry:5000",
+				Organization: "org",
+				ImageName:    "app",
+				Tag:          "1.0",
+			},
+		},
+		{
+			image: "[::1]:5000/org/team/app@sha256:0fd4e4a5cb9b1d39b7fb8e1e3d5dfde4a5e8d4f8e1b8b0f3f13b8e6e4a2d7c9b",
+			expected: DockerUri{
+				RegistryHost: "[::1]:5000",
+				Organization: "org",
+				Project:      "team",
+				ImageName:    "app",
+				Digest:       "sha256:0fd4e4a5cb9b1d39b7fb8e1e3d5dfde4a5e8d4f8e1b8b0f3f13b8e6e4a2d7c9b",
+			},
+		},
+		{
+			image: "ghcr.io/my_org/my-app__x:v1.2.3-rc.1",
+			expected: DockerUri{
+				RegistryHost: "ghcr.io",
+				Organization: "my_org",
+				ImageName:    "my-app__x",
+				Tag:          "v1.2.3-rc.1",
+			},
+		},
+		{
+			image:     "myregistry.com/myrepo/myimage:1.0.0@sha256:nothex",
+			expectErr: true,
+		},
 	}
 
 	for _, test := range tests {
@@ -93,3 +195,99 @@ func TestParseDockerImage(t *testing.T) {
 		}
 	}
 }
+
+func TestDockerUriDigestRoundTrip(t *testing.T) {
+	digest := "sha256:0fd4e4a5cb9b1d39b7fb8e1e3d5dfde4a5e8d4f8e1b8b0f3f13b8e6e4a2d7c9b"
+	tests := []struct {
+		image   string
+		base    string
+		refName string
+		tagRef  string
+	}{
+		{
+			image:   "myregistry.com/myrepo/myimage@" + digest,
+			base:    "myregistry.com/myrepo/myimage",
+			refName: "myrepo/myimage@" + digest,
+			tagRef:  "myregistry.com/myrepo/myimage@" + digest,
+		},
+		{
+			image:   "myregistry.com/myrepo/myproject/myimage:1.0.0@" + digest,
+			base:    "myregistry.com/myrepo/myproject/myimage",
+			refName: "myrepo/myproject/myimage:1.0.0@" + digest,
+			tagRef:  "myregistry.com/myrepo/myproject/myimage:1.0.0",
+		},
+	}
+
+	for _, test := range tests {
+		result, err := NewDockerUri(test.image)
+		if err != nil {
+			t.Fatalf("did not expect an error for image %s, got: %v", test.image, err)
+		}
+		if result.String() != test.image {
+			t.Errorf("for image %s, expected String() %s, got %s", test.image, test.image, result.String())
+		}
+		if result.Base() != test.base {
+			t.Errorf("for image %s, expected Base() %s, got %s", test.image, test.base, result.Base())
+		}
+		if result.RefName() != test.refName {
+			t.Errorf("for image %s, expected RefName() %s, got %s", test.image, test.refName, result.RefName())
+		}
+		if result.TagRef() != test.tagRef {
+			t.Errorf("for image %s, expected TagRef() %s, got %s", test.image, test.tagRef, result.TagRef())
+		}
+	}
+}
+
+func TestParseDockerImageErrors(t *testing.T) {
+	tests := []struct {
+		image       string
+		expectedErr error
+	}{
+		{image: "", expectedErr: ErrNameEmpty},
+		{image: ":1.0", expectedErr: ErrNameEmpty},
+		{image: "myregistry.com/", expectedErr: ErrNameEmpty},
+		{image: "myregistry.com/MyRepo/app:1", expectedErr: ErrNameContainsUppercase},
+		{image: "myregistry.com/my..repo/app:1", expectedErr: ErrReferenceInvalidFormat},
+		{image: "myregistry.com/app:-1", expectedErr: ErrTagInvalidFormat},
+		{image: "myregistry.com/app:" + strings.Repeat("a", 129), expectedErr: ErrTagInvalidFormat},
+		{image: "myregistry.com/app@sha256:abc", expectedErr: ErrDigestInvalidFormat},
+		{image: "myregistry.com/app@md5", expectedErr: ErrDigestInvalidFormat},
+		{image: "my_registry.com:5000/app", expectedErr: ErrRegistryInvalidFormat},
+		{image: "myregistry.com/" + strings.Repeat("a", 256), expectedErr: ErrNameTooLong},
+	}
+
+	for _, test := range tests {
+		_, err := NewDockerUri(test.image)
+		if !errors.Is(err, test.expectedErr) {
+			t.Errorf("for image %q, expected error %v, got %v", test.image, test.expectedErr, err)
+		}
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || parseErr.Reference != test.image {
+			t.Errorf("for image %q, expected a *ParseError, got %T", test.image, err)
+		}
+	}
+}
+
+func TestDockerUriAsWritten(t *testing.T) {
+	tests := []struct {
+		image   string
+		refName string
+	}{
+		{image: "busybox:1.36.1", refName: "busybox:1.36.1"},
+		{image: "docker.io/busybox:1.36.1", refName: "busybox:1.36.1"},
+		{image: "docker.io/library/busybox:1.36.1", refName: "library/busybox:1.36.1"},
+		{image: "docker.io/alpine/curl:8.9.1", refName: "alpine/curl:8.9.1"},
+		{image: "myregistry.com/myimage:latest", refName: "myimage:latest"},
+	}
+
+	for _, test := range tests {
+		result, err := NewDockerUri(test.image)
+		if err != nil {
+			t.Fatalf("did not expect an error for image %s, got: %v", test.image, err)
+		}
+		written := result.AsWritten()
+		if written.RefName() != test.refName {
+			t.Errorf("for image %s, expected RefName() as written %s, got %s", test.image, test.refName, written.RefName())
+		}
+	}
+}